@@ -11,12 +11,27 @@ import (
 
 const defaultCap = 1024
 
+// ArgNumError is returned for wrong number of arguments, negative number
+// means that at least -n arguments are required
 type ArgNumError int
 
 func (e ArgNumError) Error() string {
+	if e < 0 {
+		return fmt.Sprintf("Wrong number of arguments, must be at least %v", -int(e))
+	}
 	return fmt.Sprintf("Wrong number of arguments, must be %v", int(e))
 }
 
+// CheckArgs checks that n arguments are allowed by argNum, which is exact
+// number of arguments or minimal one with optional trailing arguments if it
+// is negative
+func CheckArgs(n, argNum int) error {
+	if (argNum >= 0 && n != argNum) || (argNum < 0 && n < -argNum) {
+		return ArgNumError(argNum)
+	}
+	return nil
+}
+
 func SplitCommand(input string) (command, argpart string) {
 	index := strings.IndexRune(input, ' ')
 	if index == -1 {
@@ -29,20 +44,26 @@ func SplitCommand(input string) (command, argpart string) {
 }
 
 func ParseArgs(argString string, argNum int) ([]string, error) {
+	if argNum == 0 && argString != "" {
+		return []string{}, ArgNumError(argNum)
+	}
+	res, err := SplitArgs(argString)
+	if err != nil {
+		return res, err
+	}
+	return res, CheckArgs(len(res), argNum)
+}
+
+// SplitArgs splits string to arguments separated by spaces, arguments in
+// double quotes are unquoted like Go strings
+func SplitArgs(argString string) ([]string, error) {
 
 	var isq bool // is we in quote
 
-	res := make([]string, 0, argNum)
+	res := make([]string, 0, 4)
 	buf := make([]byte, 0, defaultCap)
 
-	if argNum == 0 && argString != "" {
-		return res, ArgNumError(argNum)
-	}
-
 	for i := 0; i < len(argString); i++ {
-		if len(res) == argNum {
-			return res, ArgNumError(argNum)
-		}
 		ch := argString[i]
 		if ch == '"' {
 			buf = append(buf, '"')
@@ -62,7 +83,7 @@ func ParseArgs(argString string, argNum int) ([]string, error) {
 		}
 		if isq {
 			buf = append(buf, ch)
-			if ch == '\\' {
+			if ch == '\\' && i+1 < len(argString) {
 				i++
 				buf = append(buf, argString[i])
 			}
@@ -84,9 +105,109 @@ func ParseArgs(argString string, argNum int) ([]string, error) {
 		res = append(res, string(buf))
 	}
 
-	if len(res) != argNum {
-		return res, ArgNumError(argNum)
+	return res, nil
+}
+
+// ParseLiteral checks if line ends with literal {N}, which means that N bytes
+// of data follow the line and are used as next argument
+//
+// returns part of line before literal and size of data
+func ParseLiteral(line string) (prefix string, size int64, ok bool) {
+	if !strings.HasSuffix(line, "}") {
+		return line, 0, false
+	}
+	open := strings.LastIndexByte(line, '{')
+	if open == -1 || (open > 0 && line[open-1] != ' ') {
+		return line, 0, false
+	}
+	digits := line[open+1 : len(line)-1]
+	if digits == "" || digits[0] == '+' || digits[0] == '-' {
+		return line, 0, false
+	}
+	size, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return line, 0, false
+	}
+	return line[:open], size, true
+}
+
+// Literal returns literal for data of size n
+func Literal(n int) string {
+	return "{" + strconv.Itoa(n) + "}"
+}
+
+// Match reports if s matches glob pattern: * matches any sequence, ? any
+// byte, [abc], [a-z] and [^a] classes match one byte from set and \ escapes
+// special character
+func Match(pattern, s string) bool {
+	px, sx := 0, 0
+	// position of last star and of string after it for backtracking
+	star, next := -1, 0
+	for {
+		if px < len(pattern) && pattern[px] == '*' {
+			star, next = px, sx
+			px++
+			continue
+		}
+		if px < len(pattern) && sx < len(s) {
+			if width, ok := matchOne(pattern[px:], s[sx]); ok {
+				px += width
+				sx++
+				continue
+			}
+		} else if px == len(pattern) && sx == len(s) {
+			return true
+		}
+		// star takes one more byte
+		if star >= 0 && next < len(s) {
+			next++
+			px, sx = star+1, next
+			continue
+		}
+		return false
+	}
+}
+
+// matchOne matches byte with token of pattern, which is not star
+//
+// returns width of token
+func matchOne(pattern string, b byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == b
+		}
+	case '[':
+		return matchClass(pattern, b)
 	}
+	return 1, pattern[0] == b
+}
 
-	return res, nil
+// matchClass matches byte with class, unterminated class ends with pattern
+func matchClass(pattern string, b byte) (int, bool) {
+	i := 1
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+	matched := false
+	for ; i < len(pattern) && pattern[i] != ']'; i++ {
+		switch {
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			matched = matched || pattern[i] == b
+		case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+			lo, hi := pattern[i], pattern[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (lo <= b && b <= hi)
+			i += 2
+		default:
+			matched = matched || pattern[i] == b
+		}
+	}
+	return min(i+1, len(pattern)), matched != negate
 }
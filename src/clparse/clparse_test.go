@@ -20,6 +20,8 @@ var argTable = []struct {
 	{`set "a\\" 1`, 3, []string{"set", "a\\", "1"}},
 	{`set "a" "x y "`, 3, []string{"set", "a", "x y "}},
 	{`юникод "арг1" "x y "`, 3, []string{"юникод", "арг1", "x y "}},
+	{`a b`, -2, []string{"a", "b"}},
+	{`a b ex 10`, -2, []string{"a", "b", "ex", "10"}},
 }
 
 func isEqual(input, expected []string) bool {
@@ -56,6 +58,7 @@ var argTableErr = []struct {
 	{`"a b" 1`, 1, "Wrong number of arguments, must be 1"},
 	{`"a b"`, 2, "Wrong number of arguments, must be 2"},
 	{`a`, 2, "Wrong number of arguments, must be 2"},
+	{`a`, -2, "Wrong number of arguments, must be at least 2"},
 	{`"a b 1`, 1, "Unbalanced quotes"},
 	{`"a b"1`, 1, "Closing quote must follow by space character or nothing at all"},
 }
@@ -101,3 +104,83 @@ func TestSplit(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitArgs(t *testing.T) {
+	result, err := SplitArgs(`set  "a b" 1 `)
+	if err != nil {
+		t.Fatalf("Split error: %v", err)
+	}
+	if !isEqual(result, []string{"set", "a b", "1"}) {
+		t.Errorf("Result: %q, expected: %q", result, []string{"set", "a b", "1"})
+	}
+	if result, err := SplitArgs(""); err != nil || len(result) != 0 {
+		t.Errorf("Result of empty string: %q, error %v", result, err)
+	}
+	if _, err := SplitArgs(`"a\`); err == nil {
+		t.Error("Must be error for unbalanced quotes")
+	}
+}
+
+var literalTable = []struct {
+	input  string
+	prefix string
+	size   int64
+	ok     bool
+}{
+	{`set a {5}`, `set a `, 5, true},
+	{`{0}`, ``, 0, true},
+	{`set a {5} 1`, `set a {5} 1`, 0, false},
+	{`set a b{5}`, `set a b{5}`, 0, false},
+	{`set a {-5}`, `set a {-5}`, 0, false},
+	{`set a {}`, `set a {}`, 0, false},
+	{`set a "{5}"`, `set a "{5}"`, 0, false},
+}
+
+func TestParseLiteral(t *testing.T) {
+	for _, l := range literalTable {
+		prefix, size, ok := ParseLiteral(l.input)
+		if prefix != l.prefix || size != l.size || ok != l.ok {
+			t.Errorf("Result: %q %v %v, expected: %q %v %v, input was: %q",
+				prefix, size, ok, l.prefix, l.size, l.ok, l.input)
+		}
+	}
+	if Literal(12) != "{12}" {
+		t.Errorf("Wrong literal %s", Literal(12))
+	}
+}
+
+var matchTable = []struct {
+	pattern, s string
+	match      bool
+}{
+	{"*", "", true},
+	{"*", "anything", true},
+	{"user:*", "user:42", true},
+	{"user:*", "users", false},
+	{"*:name", "user:1:name", true},
+	{"a*b*c", "axxbyyc", true},
+	{"a*b*c", "axxbyy", false},
+	{"h?llo", "hello", true},
+	{"h?llo", "hllo", false},
+	{"h[ae]llo", "hallo", true},
+	{"h[ae]llo", "hillo", false},
+	{"h[^e]llo", "hallo", true},
+	{"h[^e]llo", "hello", false},
+	{"h[a-c]llo", "hbllo", true},
+	{"h[c-a]llo", "hbllo", true},
+	{"h[a-c]llo", "hdllo", false},
+	{`a\*`, "a*", true},
+	{`a\*`, "ab", false},
+	{`[\]]`, "]", true},
+	{"[ab", "b", true},
+	{"", "", true},
+	{"", "a", false},
+}
+
+func TestMatch(t *testing.T) {
+	for _, m := range matchTable {
+		if res := Match(m.pattern, m.s); res != m.match {
+			t.Errorf("Match(%q, %q) is %v, expected: %v", m.pattern, m.s, res, m.match)
+		}
+	}
+}
@@ -2,25 +2,54 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"gocache/server"
+	dict "godict"
 	log "logging"
+	"math"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var (
-	host    string
-	ncpu    int
-	port    int
-	sig     chan os.Signal
-	verbose int
+	host     string
+	ncpu     int
+	port     int
+	respPort int
+	mcPort   int
+	shards   int
+	sig      chan os.Signal
+	verbose  int
+
+	shutdownTimeout time.Duration
 
 	cpuprofile  string
 	httpprofile bool
+
+	maxmemory      string
+	maxValue       string
+	maxkeys        int
+	evictionPolicy string
+
+	expireConfig = dict.DefaultExpireConfig
+
+	aofRewriteSize  string
+	replBacklogSize string
+	pubsubLimit     string
+	notifyEvents    string
+
+	config = server.DefaultConfig
 )
 
 func flagBool(f *bool, aliases []string, value bool, usage string) {
@@ -35,6 +64,12 @@ func flagInt(f *int, aliases []string, value int, usage string) {
 	}
 }
 
+func flagDuration(f *time.Duration, aliases []string, value time.Duration, usage string) {
+	for _, alias := range aliases {
+		flag.DurationVar(f, alias, value, usage)
+	}
+}
+
 func flagString(f *string, aliases []string, value string, usage string) {
 	for _, alias := range aliases {
 		flag.StringVar(f, alias, value, usage)
@@ -43,13 +78,33 @@ func flagString(f *string, aliases []string, value string, usage string) {
 
 func init() {
 	flagInt(&port, []string{"port", "p"}, 6090, "Port for incomming connections")
+	flagInt(&respPort, []string{"resp-port"}, 0, "Port for redis protocol connections, 0 disables it")
+	flagInt(&mcPort, []string{"memcache-port"}, 0, "Port for memcached protocol connections, 0 disables it")
 	flagString(&host, []string{"host", "h"}, "127.0.0.1", "Host for incomming connections")
 	flagInt(&verbose, []string{"verbose", "v"}, 4, "Logging verbosity")
 	flagInt(&ncpu, []string{"ncpu", "n"}, 1, "Number of max used cores")
+	flagInt(&shards, []string{"shards"}, 16, "Number of independently locked storage shards")
 	flagBool(&httpprofile, []string{"httpprofile"}, false, "Run net/http/pprof server")
 	flagString(&cpuprofile, []string{"cpuprofile"}, "", "Write cpuprofile info to file")
+	flagString(&maxmemory, []string{"maxmemory"}, "0", "Memory limit for keys and values, e.g. 512mb, 0 is unlimited")
+	flagString(&maxValue, []string{"max-value-size"}, "512mb", "Max size of key or value in text and redis protocol requests")
+	flagInt(&maxkeys, []string{"maxkeys"}, 0, "Limit for number of keys, 0 is unlimited")
+	flagString(&evictionPolicy, []string{"eviction-policy"}, "noeviction", "Eviction policy on memory limit: noeviction, lru, lfu, random")
+	flagDuration(&expireConfig.Interval, []string{"expire-interval"}, expireConfig.Interval, "Interval between active expiration cycles, 0 disables active expiration")
+	flagDuration(&expireConfig.Budget, []string{"expire-budget"}, expireConfig.Budget, "Max time spent by one active expiration cycle")
+	flagInt(&expireConfig.SampleSize, []string{"expire-sample"}, expireConfig.SampleSize, "Number of keys checked at once by active expiration")
+	flagString(&config.DBFile, []string{"dbfile"}, "", "Snapshot file, loaded on start and written by SAVE and BGSAVE")
+	flagDuration(&config.SaveInterval, []string{"save-interval"}, 0, "Interval between background snapshots, 0 disables them")
+	flagString(&config.AOFFile, []string{"aof"}, "", "Append only file, every write command is logged to it and replayed on start")
+	flagString(&config.AOFFsync, []string{"aof-fsync"}, "everysec", "When append only file is synced to disk: always, everysec, no")
+	flagString(&config.ReplicaOf, []string{"replicaof"}, "", "Address of leader redis protocol port to replicate from, e.g. 10.0.0.1:6379")
+	flagString(&replBacklogSize, []string{"repl-backlog-size"}, "1mb", "Size of stream kept for partial resync of followers")
+	flagString(&pubsubLimit, []string{"pubsub-output-limit"}, "32mb", "Messages queued for slow subscriber before it is disconnected, 0 is unlimited")
+	flagString(&notifyEvents, []string{"notify-keyspace-events"}, "", "Events of keys published to subscribers: comma separated set, del, expired, evicted or all")
+	flagString(&aofRewriteSize, []string{"aof-rewrite-size"}, "64mb", "Append only file is rewritten when it doubles and is bigger than this, 0 disables rewrite")
+	flagDuration(&shutdownTimeout, []string{"shutdown-timeout"}, 10*time.Second, "Time given to connections to finish current command on shutdown")
 	sig = make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, os.Kill)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 }
 
 func main() {
@@ -57,22 +112,150 @@ func main() {
 	if httpprofile {
 		go func() {
 			log.Info("Run profile on localhost:6060")
-			log.Err(http.ListenAndServe("localhost:6060", nil).Error())
+			log.Err("%v", http.ListenAndServe("localhost:6060", nil))
 		}()
 	}
 	if cpuprofile != "" {
 		f, err := os.Create(cpuprofile)
 		if err != nil {
-			log.Err(err.Error())
+			log.Err("%v", err)
 		}
 		log.Info("Writing cpuprofile to %v", cpuprofile)
 		pprof.StartCPUProfile(f)
-		defer pprof.StopCPUProfile()
 	}
 	log.SetVerbosity(verbose)
+	if err := configureStorage(); err != nil {
+		log.Crit("%v", err)
+		os.Exit(2)
+	}
+	srv, err := server.New(config)
+	if err != nil {
+		log.Crit("%v", err)
+		os.Exit(2)
+	}
 	log.Info("Running gocache on %v cores", ncpu)
 	runtime.GOMAXPROCS(ncpu)
-	go runServer(host, port)
-	s := <-sig
-	log.Info("Got signal: %v", s)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+	status := 0
+	select {
+	case s := <-sig:
+		log.Info("Got signal: %v, shutting down", s)
+	case err := <-served:
+		log.Crit("%v", err)
+		status = 1
+	}
+	os.Exit(shutdown(srv, status))
+}
+
+// shutdown drains connections and saves data, second signal stops waiting.
+// Returns exit status, which is not 0 if shutdown failed or status is not 0.
+func shutdown(srv *server.Server, status int) int {
+	defer pprof.StopCPUProfile()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Shutdown(ctx)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Err("Shutdown failed: %v", err)
+			return 1
+		}
+		log.Info("Shutdown complete")
+		return status
+	case s := <-sig:
+		log.Warn("Got signal: %v, exiting without waiting for shutdown", s)
+		return 1
+	}
+}
+
+// parseSize parses size in bytes with optional kb, mb or gb suffix
+func parseSize(s string) (uint64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	mul := uint64(1)
+	for _, u := range []struct {
+		suffix string
+		mul    uint64
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"b", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mul = strings.TrimSuffix(s, u.suffix), u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n > math.MaxUint64/mul {
+		return 0, fmt.Errorf("Wrong size %q", s)
+	}
+	return n * mul, nil
+}
+
+func configureStorage() error {
+	mem, err := parseSize(maxmemory)
+	if err != nil {
+		return err
+	}
+	policy, err := dict.ParseEvictionPolicy(evictionPolicy)
+	if err != nil {
+		return err
+	}
+	valueSize, err := parseSize(maxValue)
+	if err != nil {
+		return err
+	}
+	if valueSize == 0 || valueSize > math.MaxInt32 {
+		return fmt.Errorf("Wrong max value size %q", maxValue)
+	}
+	config.MaxValueSize = int(valueSize)
+	if config.AOFRewriteSize, err = parseSize(aofRewriteSize); err != nil {
+		return err
+	}
+	if config.ReplBacklogSize, err = parseSize(replBacklogSize); err != nil {
+		return err
+	}
+	if config.PubSubLimit, err = parseSize(pubsubLimit); err != nil {
+		return err
+	}
+	if maxkeys < 0 || maxkeys > math.MaxUint32 {
+		return fmt.Errorf("Wrong keys limit %d", maxkeys)
+	}
+	if shards < 1 {
+		return fmt.Errorf("Wrong number of shards %d", shards)
+	}
+	// limits are split between shards, so every shard must get something
+	if mem != 0 && mem < uint64(shards) {
+		return fmt.Errorf("Memory limit %d is less than number of shards %d", mem, shards)
+	}
+	if maxkeys != 0 && maxkeys < shards {
+		return fmt.Errorf("Keys limit %d is less than number of shards %d", maxkeys, shards)
+	}
+	storage := dict.NewSharded(shards)
+	storage.SetEvictionPolicy(policy)
+	storage.SetMaxMemory(mem)
+	storage.SetMaxEntries(uint32(maxkeys))
+	if config.NotifyEvents, err = dict.ParseEvents(notifyEvents); err != nil {
+		return err
+	}
+	if mem != 0 || maxkeys != 0 {
+		log.Info("Storage limits: %d bytes, %d keys, eviction policy %v", mem, maxkeys, policy)
+	}
+	if expireConfig.Interval > 0 {
+		if expireConfig.SampleSize <= 0 {
+			return fmt.Errorf("Wrong expire sample size %d", expireConfig.SampleSize)
+		}
+		storage.StartExpiring(expireConfig)
+	}
+	config.Storage = storage
+	config.Addr = net.JoinHostPort(host, strconv.Itoa(port))
+	if respPort != 0 {
+		config.RESPAddr = net.JoinHostPort(host, strconv.Itoa(respPort))
+	}
+	if mcPort != 0 {
+		config.MemcacheAddr = net.JoinHostPort(host, strconv.Itoa(mcPort))
+	}
+	return nil
 }
@@ -0,0 +1,509 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	dict "godict"
+	"io"
+	log "logging"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fsyncPolicy defines how often append only file is flushed to disk
+type fsyncPolicy int
+
+const (
+	fsyncAlways fsyncPolicy = iota
+	fsyncEverySec
+	fsyncNo
+)
+
+func parseFsyncPolicy(s string) (fsyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "always":
+		return fsyncAlways, nil
+	case "everysec":
+		return fsyncEverySec, nil
+	case "no":
+		return fsyncNo, nil
+	}
+	return 0, fmt.Errorf("Unknown fsync policy %q", s)
+}
+
+var (
+	errRewriteInProgress = errors.New("Background append only file rewriting already in progress")
+	errLogClosed         = errors.New("Append only file is closed")
+)
+
+// appendLog writes every successful write command to file in redis protocol
+type appendLog struct {
+	sync.Mutex
+	path   string
+	policy fsyncPolicy
+	f      *os.File
+	size   int64
+	dirty  bool          // written, but not synced yet
+	stop   chan struct{} // closed under lock by stopRewrite or close
+
+	// storage of srv is snapshotted by rewrite
+	srv *Server
+
+	// rewrite is started when size doubles since last rewrite and is at least
+	// minRewrite, 0 disables automatic rewrite
+	minRewrite int64
+	baseSize   int64
+	rewriting  bool
+	scheduled  bool   // rewrite waits for other snapshot of storage
+	rewriteBuf []byte // commands logged while rewrite is in progress
+	rewrites   sync.WaitGroup
+	// partial is set while file lacks keys, which only rewrite adds, so
+	// such rewrite isn't canceled by stopRewrite
+	partial bool
+}
+
+// openAppendLog opens file for appending, syncing goroutine is started for
+// everysec policy
+func openAppendLog(path string, policy fsyncPolicy, minRewrite int64, srv *Server) (*appendLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a := &appendLog{
+		path:       path,
+		policy:     policy,
+		f:          f,
+		size:       info.Size(),
+		baseSize:   info.Size(),
+		minRewrite: minRewrite,
+		stop:       make(chan struct{}),
+		srv:        srv,
+	}
+	if policy == fsyncEverySec {
+		go a.syncEverySecond()
+	}
+	return a, nil
+}
+
+// append writes command to file, must be called with writeMu held
+func (a *appendLog) append(b []byte) {
+	a.Lock()
+	defer a.Unlock()
+	n, err := a.f.Write(b)
+	a.size += int64(n)
+	if err != nil {
+		log.Err("Writing to append only file failed: %v", err)
+		return
+	}
+	if a.rewriting {
+		a.rewriteBuf = append(a.rewriteBuf, b...)
+	}
+	if a.policy == fsyncAlways {
+		if err := a.f.Sync(); err != nil {
+			log.Err("Syncing append only file failed: %v", err)
+		}
+	} else {
+		a.dirty = true
+	}
+	if a.minRewrite > 0 && a.size >= a.minRewrite && a.size >= 2*a.baseSize && !a.rewriting {
+		log.Info("Append only file grew to %d bytes, rewriting it", a.size)
+		if err := a.startRewrite(); err != nil {
+			log.Err("Automatic rewrite of append only file failed: %v", err)
+		}
+	}
+}
+
+func (a *appendLog) syncEverySecond() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+		}
+		a.Lock()
+		f, dirty := a.f, a.dirty
+		a.dirty = false
+		a.Unlock()
+		if !dirty {
+			continue
+		}
+		// file may be replaced by rewrite meanwhile, then it is synced already
+		if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			log.Err("Syncing append only file failed: %v", err)
+		}
+	}
+}
+
+// startRewrite starts rewrite of file in background, it is scheduled if
+// other snapshot of storage is in progress. Must be called with writeMu and
+// lock held.
+func (a *appendLog) startRewrite() error {
+	if a.rewriting || a.scheduled {
+		return errRewriteInProgress
+	}
+	select {
+	case <-a.stop:
+		return errLogClosed
+	default:
+	}
+	if !a.srv.trySnapshotTurn() {
+		log.Info("Rewrite of append only file waits for other snapshot to finish")
+		a.scheduled = true
+		a.rewrites.Add(1)
+		go a.scheduledRewrite(a.rewriteCancel())
+		return nil
+	}
+	return a.beginRewrite()
+}
+
+// beginRewrite takes snapshot and starts rewrite, must be called with
+// writeMu, lock and turn of snapshot held
+func (a *appendLog) beginRewrite() error {
+	// commands logged after this point are buffered and writeMu guarantees
+	// that they are not in snapshot
+	snap, err := a.srv.storage.Snapshot()
+	if err != nil {
+		a.srv.releaseSnapshotTurn()
+		return err
+	}
+	a.rewriting = true
+	a.rewriteBuf = nil
+	a.rewrites.Add(1)
+	go a.rewrite(snap, a.rewriteCancel())
+	return nil
+}
+
+// rewriteCancel returns channel, which is closed when rewrite must be
+// canceled, must be called with lock held
+func (a *appendLog) rewriteCancel() <-chan struct{} {
+	if a.partial {
+		return nil
+	}
+	return a.stop
+}
+
+// scheduledRewrite starts rewrite when turn of snapshot comes, it gives up
+// if cancel is closed first
+func (a *appendLog) scheduledRewrite(cancel <-chan struct{}) {
+	defer a.rewrites.Done()
+	if !a.srv.waitSnapshotTurn(cancel) {
+		return
+	}
+	a.srv.writeMu.Lock()
+	defer a.srv.writeMu.Unlock()
+	a.Lock()
+	defer a.Unlock()
+	a.scheduled = false
+	select {
+	case <-cancel:
+		a.srv.releaseSnapshotTurn()
+		return
+	default:
+	}
+	if err := a.beginRewrite(); err != nil {
+		log.Err("Rewrite of append only file failed: %v", err)
+	}
+}
+
+// rewrite writes minimal set of commands which recreates storage from
+// snapshot to temporary file, then commands logged meanwhile are appended
+// and file replaces current one
+func (a *appendLog) rewrite(snap *dict.ShardedSnapshot, cancel <-chan struct{}) {
+	defer a.rewrites.Done()
+	start := time.Now()
+	f, err := a.writeSnapshot(snap, cancel)
+	a.srv.releaseSnapshotTurn()
+	a.Lock()
+	defer a.Unlock()
+	a.rewriting = false
+	if err == nil {
+		_, err = f.Write(a.rewriteBuf)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), a.path)
+	}
+	a.rewriteBuf = nil
+	if err == errLogClosed {
+		log.Info("Rewrite of append only file is canceled")
+		return
+	}
+	if err != nil {
+		log.Err("Rewrite of append only file failed: %v", err)
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		return
+	}
+	a.f.Close()
+	a.f = f
+	info, err := f.Stat()
+	if err == nil {
+		a.size, a.baseSize = info.Size(), info.Size()
+	}
+	a.dirty = false
+	a.partial = false
+	log.Info("Append only file rewritten to %d bytes in %v", a.size, time.Since(start))
+}
+
+// writeSnapshot writes snapshot as commands to new file opened for appending,
+// it fails with errLogClosed when cancel is closed
+func (a *appendLog) writeSnapshot(snap *dict.ShardedSnapshot, cancel <-chan struct{}) (*os.File, error) {
+	f, err := os.CreateTemp(filepath.Dir(a.path), "temp-rewrite-*.aof")
+	if err != nil {
+		snap.Close()
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	var buf []byte
+	err = snap.Each(func(rec *dict.Record) error {
+		select {
+		case <-cancel:
+			return errLogClosed
+		default:
+		}
+		buf = recordCommands(buf[:0], rec)
+		_, err := w.Write(buf)
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// aofRewriteItems is maximal number of elements of value of composite kind
+// written by one command, it is even, so fields and values of hashes stay
+// together
+const aofRewriteItems = 128
+
+// restoreCommands add elements of values of composite kinds
+var restoreCommands = map[dict.Kind]string{
+	dict.KindHash: "hset",
+	dict.KindList: "rpush",
+	dict.KindSet:  "sadd",
+	dict.KindZSet: "zadd",
+}
+
+// recordCommands appends commands, which restore key of snapshot record
+func recordCommands(buf []byte, rec *dict.Record) []byte {
+	if rec.Kind == dict.KindString {
+		args := []string{rec.Key, rec.Value}
+		switch {
+		case rec.Deadline.IsZero():
+		case rec.Idle != 0:
+			// idle timeout starts again on load
+			idle := strconv.FormatInt(rec.Idle.Milliseconds(), 10)
+			args = append(args, "px", idle, "sliding")
+		default:
+			args = append(args, "pxat", strconv.FormatInt(rec.Deadline.UnixMilli(), 10))
+		}
+		if rec.Flags != 0 {
+			args = append(args, "flags", strconv.FormatUint(uint64(rec.Flags), 10))
+		}
+		return encodeCommand(buf, "set", args...)
+	}
+	for i := 0; i < len(rec.Elements); i += aofRewriteItems {
+		j := min(i+aofRewriteItems, len(rec.Elements))
+		buf = encodeCommand(buf, restoreCommands[rec.Kind], append([]string{rec.Key}, rec.Elements[i:j]...)...)
+	}
+	switch {
+	case rec.Deadline.IsZero():
+	case rec.Idle != 0:
+		idle := strconv.FormatInt(rec.Idle.Milliseconds(), 10)
+		buf = encodeCommand(buf, "pexpire", rec.Key, idle, "sliding")
+	default:
+		deadline := strconv.FormatInt(rec.Deadline.UnixMilli(), 10)
+		buf = encodeCommand(buf, "pexpireat", rec.Key, deadline)
+	}
+	return buf
+}
+
+// closeStop stops background work, must be called with lock held
+func (a *appendLog) closeStop() {
+	select {
+	case <-a.stop:
+	default:
+		close(a.stop)
+	}
+}
+
+// stopRewrite cancels rewrite in progress or scheduled one and waits for it
+// to finish, so its snapshot is released. Rewrite, which adds missing keys to
+// file, is waited for without canceling. Rewrites aren't started after it.
+// It must not be called with writeMu held.
+func (a *appendLog) stopRewrite() {
+	a.Lock()
+	a.closeStop()
+	a.Unlock()
+	a.rewrites.Wait()
+}
+
+// close syncs and closes file, log can't be used after it. Rewrite must be
+// stopped before.
+func (a *appendLog) close() error {
+	a.Lock()
+	defer a.Unlock()
+	a.closeStop()
+	err := a.f.Sync()
+	if err != nil {
+		log.Err("Syncing append only file failed: %v", err)
+	}
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// countingReader counts bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// loadAppendLog replays commands from file. Incomplete command or
+// transaction at the end of file is left by crash while writing, it is cut
+// off.
+//
+// returns false if there is no such file
+func (s *Server) loadAppendLog(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	start := time.Now()
+	cr := &countingReader{r: f}
+	r := bufio.NewReaderSize(cr, respMaxInline)
+	n := 0
+	// commands of transaction are run at its EXEC
+	var tx [][]string
+	var txOffset int64
+	for {
+		offset := cr.n - int64(r.Buffered())
+		args, err := s.readRESPCommand(r)
+		if err == io.EOF && cr.n-int64(r.Buffered()) == offset && tx == nil {
+			break
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if tx != nil {
+				offset = txOffset
+			}
+			log.Warn("Append only file %s is truncated at %d, cutting incomplete command off", path, offset)
+			if err := os.Truncate(path, offset); err != nil {
+				return true, err
+			}
+			break
+		}
+		if err != nil {
+			return true, fmt.Errorf("Bad append only file %s at %d: %v", path, offset, err)
+		}
+		switch {
+		case len(args) == 0:
+		case strings.EqualFold(args[0], "multi"):
+			tx, txOffset = [][]string{}, offset
+		case tx == nil:
+			s.replayLogged(args)
+			n++
+		case strings.EqualFold(args[0], "exec"):
+			for _, args := range tx {
+				s.replayLogged(args)
+			}
+			n += len(tx)
+			tx = nil
+		default:
+			tx = append(tx, args)
+		}
+	}
+	log.Info("Replayed %d commands from %s in %v", n, path, time.Since(start))
+	return true, nil
+}
+
+func (s *Server) replayLogged(args []string) {
+	if res := s.processCommand(args[0], args[1:]); failed(res) {
+		log.Warn("Command %q from append only file failed", args)
+	}
+}
+
+// configureAppendLog loads storage from append only file, or from snapshot if
+// there is no file yet, and starts logging
+func (s *Server) configureAppendLog() error {
+	policy, err := parseFsyncPolicy(s.cfg.AOFFsync)
+	if err != nil {
+		return err
+	}
+	exists, err := s.loadAppendLog(s.cfg.AOFFile)
+	if err != nil {
+		return err
+	}
+	if !exists && s.cfg.DBFile != "" {
+		if err := s.loadSnapshot(); err != nil {
+			return err
+		}
+	}
+	a, err := openAppendLog(s.cfg.AOFFile, policy, int64(s.cfg.AOFRewriteSize), s)
+	if err != nil {
+		return err
+	}
+	s.aof = a
+	s.removed.enable()
+	if !exists && s.storage.Active() != 0 {
+		// keys from snapshot must get to new file
+		s.writeMu.Lock()
+		defer s.writeMu.Unlock()
+		a.Lock()
+		defer a.Unlock()
+		a.partial = true
+		return a.startRewrite()
+	}
+	return nil
+}
+
+func (s *Server) bgrewriteaof(args ...string) reply {
+	if s.aof == nil {
+		return errReply("Append only file is not configured, use -aof")
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.aof.Lock()
+	defer s.aof.Unlock()
+	if err := s.aof.startRewrite(); err != nil {
+		return errorReply(err)
+	}
+	if s.aof.scheduled {
+		return statusReply("Background append only file rewriting scheduled")
+	}
+	return statusReply("Background append only file rewriting started")
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAppendLogTruncated(t *testing.T) {
+	cfg := testConfig()
+	cfg.AOFFile = filepath.Join(t.TempDir(), "gocache.aof")
+	complete := string(encodeCommand(nil, "set", "a", "1"))
+	partial := string(encodeCommand(nil, "set", "b", "2"))
+	partial = partial[:len(partial)-3]
+	if err := os.WriteFile(cfg.AOFFile, []byte(complete+partial), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, addr := startServer(t, cfg)
+	c := dial(t, addr)
+	if res := c.do("get", "a"); res != "1" {
+		t.Errorf("Wrong value %q of complete command", res)
+	}
+	if res := c.do("get", "b"); res != "(nil)" {
+		t.Errorf("Wrong value %q of incomplete command", res)
+	}
+	data, err := os.ReadFile(cfg.AOFFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != complete {
+		t.Fatalf("Incomplete command is not cut off: %q", data)
+	}
+
+	// new commands are appended after cut
+	c.do("set", "c", "3")
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if n := reloaded(t, cfg); n != 2 {
+		t.Errorf("Append only file has %d keys, must be 2", n)
+	}
+}
+
+func TestAppendLogTransaction(t *testing.T) {
+	cfg := testConfig()
+	cfg.AOFFile = filepath.Join(t.TempDir(), "gocache.aof")
+	complete := string(encodeCommand(nil, "multi")) +
+		string(encodeCommand(nil, "set", "a", "1")) +
+		string(encodeCommand(nil, "set", "b", "2")) +
+		string(encodeCommand(nil, "exec"))
+	partial := string(encodeCommand(nil, "multi")) +
+		string(encodeCommand(nil, "set", "c", "3"))
+	if err := os.WriteFile(cfg.AOFFile, []byte(complete+partial), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, addr := startServer(t, cfg)
+	c := dial(t, addr)
+	if res := c.do("mget", "a", "b", "c"); res != "1 2 (nil)" {
+		t.Errorf("Wrong values %q after replay of transactions", res)
+	}
+	data, err := os.ReadFile(cfg.AOFFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != complete {
+		t.Fatalf("Incomplete transaction is not cut off: %q", data)
+	}
+}
+
+func TestRewriteAppendLog(t *testing.T) {
+	cfg := testConfig()
+	cfg.AOFFile = filepath.Join(t.TempDir(), "gocache.aof")
+	s, addr := startServer(t, cfg)
+	c := dial(t, addr)
+	for _, v := range []string{"1", "2", "3"} {
+		c.do("set", "k", v)
+	}
+	c.do("set", "gone", "v")
+	c.do("del", "gone")
+	c.do("rpush", "list", "a", "b")
+	c.do("hset", "hash", "f", "v")
+	c.do("set", "temp", "v")
+	c.do("expire", "temp", "1000")
+	if res := c.do("bgrewriteaof"); res != "+Background append only file rewriting started" {
+		t.Fatalf("Wrong reply %q to bgrewriteaof", res)
+	}
+	eventually(t, "rewrite of append only file", func() bool {
+		data, err := os.ReadFile(cfg.AOFFile)
+		return err == nil && !strings.Contains(string(data), "gone")
+	})
+
+	// commands during and after rewrite are kept
+	c.do("set", "after", "v")
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	_, addr = startServer(t, cfg)
+	c = dial(t, addr)
+	for _, check := range [][]string{
+		{"get", "k", "3"},
+		{"get", "gone", "(nil)"},
+		{"lrange", "list", "0", "-1", "a b"},
+		{"hget", "hash", "f", "v"},
+		{"get", "after", "v"},
+	} {
+		n := len(check) - 1
+		if res := c.do(check[:n]...); res != check[n] {
+			t.Errorf("Wrong reply %q to %q after rewrite", res, check[:n])
+		}
+	}
+	if res := c.do("ttl", "temp"); res == ":-1" || res == ":-2" {
+		t.Errorf("Expire is lost by rewrite, ttl is %s", res)
+	}
+}
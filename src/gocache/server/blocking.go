@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bufio"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxBlockTimeout is the longest timeout of blocking command
+const maxBlockTimeout = 100 * 365 * 24 * time.Hour
+
+func init() {
+	// blocking commands run pops from commandsMap, so they can't be in its
+	// initializer. Pops are propagated as lpop and rpop.
+	commandsMap["blpop"] = commandOpt{-2, (*Server).blpop, false}
+	commandsMap["brpop"] = commandOpt{-2, (*Server).brpop, false}
+}
+
+// keyWaiters wakes connections blocked on keys, when values are pushed
+type keyWaiters struct {
+	sync.Mutex
+	waiters map[string][]chan struct{}
+}
+
+// add registers waiter for keys, returned channel gets value after push to
+// any of them
+func (kw *keyWaiters) add(keys []string) chan struct{} {
+	ch := make(chan struct{}, 1)
+	kw.Lock()
+	defer kw.Unlock()
+	if kw.waiters == nil {
+		kw.waiters = make(map[string][]chan struct{})
+	}
+	for _, key := range keys {
+		kw.waiters[key] = append(kw.waiters[key], ch)
+	}
+	return ch
+}
+
+func (kw *keyWaiters) remove(keys []string, ch chan struct{}) {
+	kw.Lock()
+	defer kw.Unlock()
+	for _, key := range keys {
+		var left []chan struct{}
+		for _, w := range kw.waiters[key] {
+			if w != ch {
+				left = append(left, w)
+			}
+		}
+		if len(left) == 0 {
+			delete(kw.waiters, key)
+		} else {
+			kw.waiters[key] = left
+		}
+	}
+}
+
+// wake notifies all waiters of key, they compete for pushed values
+func (kw *keyWaiters) wake(key string) {
+	kw.Lock()
+	defer kw.Unlock()
+	for _, ch := range kw.waiters[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// blockReply is returned by blocking command, which has nothing to return
+// yet. Connection waits for it with serveBlocked.
+type blockReply struct {
+	keys    []string
+	timeout time.Duration // 0 means forever
+	pop     string        // command, which is tried for every key
+}
+
+// blockReply is never sent itself, it is nil if command can't block
+func (blockReply) writeText(w *bufio.Writer) {
+	nilReply{}.writeText(w)
+}
+
+func (blockReply) writeRESP(w *bufio.Writer, proto int) {
+	nilReply{}.writeRESP(w, proto)
+}
+
+// tryPop runs pop of b for every key, returns nil if all keys are empty
+func (s *Server) tryPop(b blockReply) reply {
+	for _, key := range b.keys {
+		// empty pops are not propagated on every wake up
+		if n, err := s.storage.LLen(key); err == nil && n == 0 {
+			continue
+		}
+		switch res := s.execute(b.pop, commandsMap[b.pop], []string{key}).(type) {
+		case nilReply:
+		case bulkReply:
+			return arrayReply{bulkReply(key), res}
+		default:
+			return res
+		}
+	}
+	return nil
+}
+
+// serveBlocked waits until pop of blocking command succeeds or its timeout
+// is over, shutdown of server ends it like timeout. Client may go away
+// meanwhile, then nothing is popped and nil is returned. Reader of
+// connection must not be used by caller until it returns.
+func (s *Server) serveBlocked(conn net.Conn, r *bufio.Reader, b blockReply) reply {
+	ch := s.blocked.add(b.keys)
+	defer s.blocked.remove(b.keys, ch)
+
+	// peek detects closed connection, deadline stops it when we are done
+	gone := make(chan struct{})
+	peeked := make(chan struct{})
+	go func() {
+		defer close(peeked)
+		if _, err := r.Peek(1); err != nil {
+			if err, ok := err.(net.Error); !ok || !err.Timeout() {
+				close(gone)
+			}
+		}
+	}()
+	defer func() {
+		conn.SetReadDeadline(time.Now())
+		<-peeked
+		conn.SetReadDeadline(time.Time{})
+	}()
+
+	var timeout <-chan time.Time
+	if b.timeout > 0 {
+		timer := time.NewTimer(b.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		// value may be pushed before waiter is added
+		s.execMu.RLock()
+		res := s.tryPop(b)
+		s.execMu.RUnlock()
+		if res != nil {
+			return res
+		}
+		select {
+		case <-ch:
+		case <-timeout:
+			return nilReply{}
+		case <-s.done:
+			return nilReply{}
+		case <-gone:
+			return nil
+		}
+	}
+}
+
+// blockingPop tries pop once, client is blocked if all keys are empty. Last
+// argument is timeout in seconds.
+func (s *Server) blockingPop(pop string, args []string) reply {
+	sec, err := strconv.ParseFloat(args[len(args)-1], 64)
+	switch {
+	case err != nil || math.IsNaN(sec) || sec > float64(maxBlockTimeout/time.Second):
+		return errReply("timeout is not a float or out of range")
+	case sec < 0:
+		return errReply("timeout is negative")
+	}
+	b := blockReply{
+		keys:    args[:len(args)-1],
+		timeout: time.Duration(sec * float64(time.Second)),
+		pop:     pop,
+	}
+	if res := s.tryPop(b); res != nil {
+		return res
+	}
+	return b
+}
+
+func (s *Server) blpop(args ...string) reply {
+	return s.blockingPop("lpop", args)
+}
+
+func (s *Server) brpop(args ...string) reply {
+	return s.blockingPop("rpop", args)
+}
@@ -0,0 +1,33 @@
+package server
+
+import "testing"
+
+func TestBlockingPop(t *testing.T) {
+	_, addr := startServer(t, testConfig())
+	c := dial(t, addr)
+	other := dial(t, addr)
+
+	// push wakes up blocked client
+	c.send(string(encodeCommand(nil, "blpop", "empty", "list", "0")))
+	if res := other.do("rpush", "list", "a", "b"); res != ":2" {
+		t.Fatalf("Wrong reply %q to rpush", res)
+	}
+	if res := c.reply(); res != "list a" {
+		t.Errorf("Wrong reply %q to blpop", res)
+	}
+	if res := c.do("lrange", "list", "0", "-1"); res != "b" {
+		t.Errorf("Wrong rest %q of list", res)
+	}
+
+	if res := c.do("brpop", "empty", "0.05"); res != "(nil)" {
+		t.Errorf("Wrong reply %q to brpop after timeout", res)
+	}
+	if res := c.do("blpop", "empty", "-1"); res != "-ERR timeout is negative" {
+		t.Errorf("Wrong reply %q to negative timeout", res)
+	}
+	for _, timeout := range []string{"nan", "+inf", "x"} {
+		if res := c.do("blpop", "empty", timeout); res != "-ERR timeout is not a float or out of range" {
+			t.Errorf("Wrong reply %q to timeout %s", res, timeout)
+		}
+	}
+}
@@ -0,0 +1,930 @@
+package server
+
+import (
+	"clparse"
+	"errors"
+	"fmt"
+	dict "godict"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const okFormat = "OK %v"
+const errFormat = "ERR %v"
+
+type commandFunc func(s *Server, args ...string) reply
+
+type commandOpt struct {
+	argNumber int // negative for at least -argNumber arguments
+	f         commandFunc
+	write     bool // changes storage, so it is logged to append only file
+}
+
+var commandsMap = map[string]commandOpt{
+	"set":    {-2, (*Server).set, true},
+	"get":    {1, (*Server).get, false},
+	"setnx":  {2, (*Server).setnx, true},
+	"setex":  {3, (*Server).setex, true},
+	"getset": {2, (*Server).getset, true},
+	"gets":   {1, (*Server).gets, false},
+	"cas":    {3, (*Server).cas, true},
+	"delete": {1, (*Server).delete, true},
+	"del":    {-1, (*Server).del, true},
+	"exists": {1, (*Server).exists, false},
+	"expire": {-2, (*Server).expire, true},
+	"ttl":    {1, (*Server).ttl, false},
+
+	"pexpire":   {-2, (*Server).pexpire, true},
+	"expireat":  {2, (*Server).expireat, true},
+	"pexpireat": {2, (*Server).pexpireat, true},
+	"persist":   {1, (*Server).persist, true},
+	"pttl":      {1, (*Server).pttl, false},
+
+	"mget": {-1, (*Server).mget, false},
+	"mset": {-2, (*Server).mset, true},
+	"mdel": {-1, (*Server).del, true},
+
+	"incr":        {1, (*Server).incr, true},
+	"decr":        {1, (*Server).decr, true},
+	"incrby":      {2, (*Server).incrby, true},
+	"decrby":      {2, (*Server).decrby, true},
+	"incrbyfloat": {2, (*Server).incrbyfloat, true},
+
+	"hset":    {-3, (*Server).hset, true},
+	"hget":    {2, (*Server).hget, false},
+	"hmget":   {-2, (*Server).hmget, false},
+	"hdel":    {-2, (*Server).hdel, true},
+	"hexists": {2, (*Server).hexists, false},
+	"hlen":    {1, (*Server).hlen, false},
+	"hgetall": {1, (*Server).hgetall, false},
+	"hincrby": {3, (*Server).hincrby, true},
+	"type":    {1, (*Server).typeOf, false},
+
+	"lpush":  {-2, (*Server).lpush, true},
+	"rpush":  {-2, (*Server).rpush, true},
+	"lpop":   {1, (*Server).lpop, true},
+	"rpop":   {1, (*Server).rpop, true},
+	"llen":   {1, (*Server).llen, false},
+	"lrange": {3, (*Server).lrange, false},
+	"ltrim":  {3, (*Server).ltrim, true},
+
+	"sadd":      {-2, (*Server).sadd, true},
+	"srem":      {-2, (*Server).srem, true},
+	"smembers":  {1, (*Server).smembers, false},
+	"sismember": {2, (*Server).sismember, false},
+	"sinter":    {-1, (*Server).sinter, false},
+	"sunion":    {-1, (*Server).sunion, false},
+
+	"zadd":          {-3, (*Server).zadd, true},
+	"zrem":          {-2, (*Server).zrem, true},
+	"zscore":        {2, (*Server).zscore, false},
+	"zrank":         {2, (*Server).zrank, false},
+	"zincrby":       {3, (*Server).zincrby, true},
+	"zrange":        {-3, (*Server).zrange, false},
+	"zrangebyscore": {-3, (*Server).zrangebyscore, false},
+
+	"keys": {1, (*Server).keys, false},
+	"scan": {-1, (*Server).scan, false},
+
+	"dbsize": {0, (*Server).dbsize, false},
+	"ping":   {0, (*Server).ping, false},
+	"echo":   {1, (*Server).echo, false},
+	"stats":  {0, (*Server).stats, false},
+
+	"flushall": {0, (*Server).flushall, true},
+
+	"save":         {0, (*Server).save, false},
+	"bgsave":       {0, (*Server).bgsave, false},
+	"lastsave":     {0, (*Server).lastsave, false},
+	"bgrewriteaof": {0, (*Server).bgrewriteaof, false},
+
+	"role":        {0, (*Server).role, false},
+	"replication": {0, (*Server).replication, false},
+}
+
+// missingReply returns text protocol error for missing key, but resp reply
+// for redis clients
+func missingReply(err error, resp reply) reply {
+	if _, ok := err.(dict.KeyError); ok {
+		return compatReply{errorReply(err), resp}
+	}
+	return errorReply(err)
+}
+
+var errSyntax = errors.New("Syntax error")
+
+// setOptions parses options of set: NX, XX, EX seconds, PX milliseconds,
+// EXAT and PXAT unix time, KEEPTTL, GET, SLIDING, which makes EX or PX idle
+// timeout, and FLAGS n, which stores flags of memcached item
+func setOptions(args []string) (opts dict.SetOptions, get bool, err error) {
+	expires := 0
+	sliding := false
+	for i := 0; i < len(args); i++ {
+		switch option := strings.ToLower(args[i]); option {
+		case "nx":
+			opts.OnlyNew = true
+		case "xx":
+			opts.OnlyExisting = true
+		case "keepttl":
+			opts.KeepTTL = true
+		case "get":
+			get = true
+		case "sliding":
+			sliding = true
+		case "ex", "px", "exat", "pxat":
+			if i+1 == len(args) {
+				return opts, false, errSyntax
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return opts, false, fmt.Errorf("Invalid expire time %q", args[i+1])
+			}
+			unit := time.Second
+			if option[0] == 'p' {
+				unit = time.Millisecond
+			}
+			switch {
+			case option == "exat":
+				opts.Deadline = time.Unix(n, 0)
+			case option == "pxat":
+				opts.Deadline = time.UnixMilli(n)
+			case n > int64(math.MaxInt64/unit):
+				return opts, false, fmt.Errorf("Invalid expire time %q", args[i+1])
+			default:
+				opts.TTL = time.Duration(n) * unit
+			}
+			expires++
+			i++
+		case "flags":
+			if i+1 == len(args) {
+				return opts, false, errSyntax
+			}
+			flags, err := strconv.ParseUint(args[i+1], 10, 32)
+			if err != nil {
+				return opts, false, fmt.Errorf("Invalid flags %q", args[i+1])
+			}
+			opts.Flags = uint32(flags)
+			i++
+		default:
+			return opts, false, errSyntax
+		}
+	}
+	if (opts.OnlyNew && opts.OnlyExisting) || expires > 1 || (opts.KeepTTL && expires != 0) {
+		return opts, false, errSyntax
+	}
+	if sliding {
+		if opts.TTL == 0 {
+			return opts, false, errSyntax
+		}
+		opts.Idle, opts.TTL = opts.TTL, 0
+	}
+	return opts, get, nil
+}
+
+// notSet reports if set failed because its condition was not met
+func notSet(err error) bool {
+	_, missing := err.(dict.KeyError)
+	return missing || err == dict.ErrKeyExists
+}
+
+// set stores value, options may make it conditional and return old value
+func (s *Server) set(args ...string) reply {
+	opts, get, err := setOptions(args[2:])
+	if err != nil {
+		return errorReply(err)
+	}
+	if get {
+		old, err := s.storage.SetAndGet(args[0], args[1], opts)
+		if err != nil && !notSet(err) {
+			return errorReply(err)
+		}
+		if old == nil {
+			return nilReply{}
+		}
+		return bulkReply(old.Value())
+	}
+	if _, err := s.storage.SetWithOptions(args[0], args[1], opts); err != nil {
+		if notSet(err) {
+			return compatReply{errorReply(err), nilReply{}}
+		}
+		return errorReply(err)
+	}
+	return okReply{}
+}
+
+// setnx sets value only if key is missing, returns 1 if it was set
+func (s *Server) setnx(args ...string) reply {
+	switch res := s.set(args[0], args[1], "nx").(type) {
+	case compatReply:
+		// key exists
+		return compatReply{res.text, intReply(0)}
+	case errReply:
+		return res
+	}
+	return compatReply{okReply{}, intReply(1)}
+}
+
+func (s *Server) setex(args ...string) reply {
+	return s.set(args[0], args[2], "ex", args[1])
+}
+
+func (s *Server) getset(args ...string) reply {
+	return s.set(args[0], args[1], "get")
+}
+
+func (s *Server) get(args ...string) reply {
+	slot, err := s.storage.Get(args[0])
+	if err != nil {
+		return missingReply(err, nilReply{})
+	}
+	return bulkReply(slot.Value())
+}
+
+// gets returns value with its version, which is passed to cas
+func (s *Server) gets(args ...string) reply {
+	slot, err := s.storage.Get(args[0])
+	if err != nil {
+		return missingReply(err, nilReply{})
+	}
+	return arrayReply{bulkReply(slot.Value()), intReply(slot.Version())}
+}
+
+// cas sets value only if key was not changed since gets
+func (s *Server) cas(args ...string) reply {
+	version, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return errorReply(err)
+	}
+	if _, err := s.storage.CompareAndSwap(args[0], args[1], version); err != nil {
+		return errorReply(err)
+	}
+	return okReply{}
+}
+
+func (s *Server) delete(args ...string) reply {
+	if err := s.storage.Delete(args[0]); err != nil {
+		return errorReply(err)
+	}
+	return okReply{}
+}
+
+// del returns number of deleted keys like redis does
+func (s *Server) del(args ...string) reply {
+	var n int64
+	for _, key := range args {
+		if err := s.storage.Delete(key); err == nil {
+			n++
+		}
+	}
+	return intReply(n)
+}
+
+// mget returns values of keys, nil for missing ones
+func (s *Server) mget(args ...string) reply {
+	res := make(arrayReply, len(args))
+	for i, key := range args {
+		slot, err := s.storage.Get(key)
+		if err != nil {
+			res[i] = nilReply{}
+			continue
+		}
+		res[i] = bulkReply(slot.Value())
+	}
+	return res
+}
+
+// mset sets all keys at once, takes keys and values one after another
+func (s *Server) mset(args ...string) reply {
+	if len(args)%2 != 0 {
+		return errReply("Wrong number of arguments, must be key and value pairs")
+	}
+	keys := make([]string, 0, len(args)/2)
+	values := make([]string, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		keys = append(keys, args[i])
+		values = append(values, args[i+1])
+	}
+	if err := s.storage.SetMulti(keys, values); err != nil {
+		return errorReply(err)
+	}
+	return okReply{}
+}
+
+func (s *Server) exists(args ...string) reply {
+	if _, err := s.storage.Type(args[0]); err != nil {
+		return intReply(0)
+	}
+	return intReply(1)
+}
+
+// expire sets expire in seconds. With SLIDING option it is idle timeout,
+// which is restarted by every access.
+func (s *Server) expire(args ...string) reply {
+	ttl, errRep := parseDuration(args[1], time.Second)
+	if errRep != nil {
+		return errRep
+	}
+	return s.expireIn(args[0], ttl, args[2:])
+}
+
+// expireIn sets expire in ttl from now, options may make it idle timeout.
+// Key is deleted if ttl is not positive.
+func (s *Server) expireIn(key string, ttl time.Duration, options []string) reply {
+	switch {
+	case len(options) == 0:
+		return s.expireAt(key, time.Now().Add(ttl))
+	case len(options) > 1 || strings.ToLower(options[0]) != "sliding":
+		return errorReply(errSyntax)
+	}
+	if err := s.storage.ExpireIdle(key, ttl); err != nil {
+		return missingReply(err, intReply(0))
+	}
+	return compatReply{okReply{}, intReply(1)}
+}
+
+func (s *Server) incrBy(key string, delta int64) reply {
+	n, err := s.storage.IncrBy(key, delta)
+	if err != nil {
+		return errorReply(err)
+	}
+	return intReply(n)
+}
+
+func (s *Server) incr(args ...string) reply {
+	return s.incrBy(args[0], 1)
+}
+
+func (s *Server) decr(args ...string) reply {
+	return s.incrBy(args[0], -1)
+}
+
+func (s *Server) incrby(args ...string) reply {
+	delta, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errorReply(dict.ErrNotInteger)
+	}
+	return s.incrBy(args[0], delta)
+}
+
+func (s *Server) decrby(args ...string) reply {
+	delta, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errorReply(dict.ErrNotInteger)
+	}
+	if delta == math.MinInt64 {
+		return errorReply(dict.ErrOverflow)
+	}
+	return s.incrBy(args[0], -delta)
+}
+
+func (s *Server) incrbyfloat(args ...string) reply {
+	delta, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return errorReply(dict.ErrNotFloat)
+	}
+	f, err := s.storage.IncrByFloat(args[0], delta)
+	if err != nil {
+		return errorReply(err)
+	}
+	return bulkReply(dict.FormatFloat(f))
+}
+
+// hset sets fields of hash, takes fields and values one after another
+//
+// returns number of added fields
+func (s *Server) hset(args ...string) reply {
+	if len(args)%2 != 1 {
+		return errReply("Wrong number of arguments, must be key and field and value pairs")
+	}
+	fields := make([]string, 0, len(args)/2)
+	values := make([]string, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		fields = append(fields, args[i])
+		values = append(values, args[i+1])
+	}
+	n, err := s.storage.HSet(args[0], fields, values)
+	if err != nil {
+		return errorReply(err)
+	}
+	return intReply(n)
+}
+
+func (s *Server) hget(args ...string) reply {
+	return valueReply(s.storage.HGet(args[0], args[1]))
+}
+
+// hmget returns values of fields, nil for missing ones
+func (s *Server) hmget(args ...string) reply {
+	values, found, err := s.storage.HMGet(args[0], args[1:])
+	if err != nil {
+		return errorReply(err)
+	}
+	res := make(arrayReply, len(values))
+	for i, value := range values {
+		if !found[i] {
+			res[i] = nilReply{}
+			continue
+		}
+		res[i] = bulkReply(value)
+	}
+	return res
+}
+
+// hdel returns number of removed fields
+func (s *Server) hdel(args ...string) reply {
+	return countReply(s.storage.HDel(args[0], args[1:]...))
+}
+
+func (s *Server) hexists(args ...string) reply {
+	found, err := s.storage.HExists(args[0], args[1])
+	if err != nil {
+		return errorReply(err)
+	}
+	if !found {
+		return intReply(0)
+	}
+	return intReply(1)
+}
+
+func (s *Server) hlen(args ...string) reply {
+	return countReply(s.storage.HLen(args[0]))
+}
+
+// hgetall returns fields and values of hash sorted by field
+func (s *Server) hgetall(args ...string) reply {
+	fields, err := s.storage.HGetAll(args[0])
+	if err != nil {
+		return errorReply(err)
+	}
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	res := make(mapReply, 0, 2*len(names))
+	for _, field := range names {
+		res = append(res, bulkReply(field), bulkReply(fields[field]))
+	}
+	return res
+}
+
+func (s *Server) hincrby(args ...string) reply {
+	delta, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errorReply(dict.ErrNotInteger)
+	}
+	n, err := s.storage.HIncrBy(args[0], args[1], delta)
+	if err != nil {
+		return errorReply(err)
+	}
+	return intReply(n)
+}
+
+// pushReply returns length of list after push and wakes clients blocked on
+// key
+func (s *Server) pushReply(key string, n int, err error) reply {
+	if err != nil {
+		return errorReply(err)
+	}
+	s.blocked.wake(key)
+	return intReply(n)
+}
+
+func (s *Server) lpush(args ...string) reply {
+	n, err := s.storage.LPush(args[0], args[1:]...)
+	return s.pushReply(args[0], n, err)
+}
+
+func (s *Server) rpush(args ...string) reply {
+	n, err := s.storage.RPush(args[0], args[1:]...)
+	return s.pushReply(args[0], n, err)
+}
+
+// valueReply returns value or nil if it is not found
+func valueReply(value string, found bool, err error) reply {
+	if err != nil {
+		return errorReply(err)
+	}
+	if !found {
+		return nilReply{}
+	}
+	return bulkReply(value)
+}
+
+func (s *Server) lpop(args ...string) reply {
+	return valueReply(s.storage.LPop(args[0]))
+}
+
+func (s *Server) rpop(args ...string) reply {
+	return valueReply(s.storage.RPop(args[0]))
+}
+
+func (s *Server) llen(args ...string) reply {
+	return countReply(s.storage.LLen(args[0]))
+}
+
+// parseRange parses start and stop indexes of list commands
+func parseRange(args []string) (int64, int64, reply) {
+	start, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return 0, 0, errorReply(dict.ErrNotInteger)
+	}
+	stop, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return 0, 0, errorReply(dict.ErrNotInteger)
+	}
+	return start, stop, nil
+}
+
+func (s *Server) lrange(args ...string) reply {
+	start, stop, errRep := parseRange(args[1:])
+	if errRep != nil {
+		return errRep
+	}
+	values, err := s.storage.LRange(args[0], start, stop)
+	if err != nil {
+		return errorReply(err)
+	}
+	res := make(arrayReply, len(values))
+	for i, value := range values {
+		res[i] = bulkReply(value)
+	}
+	return res
+}
+
+func (s *Server) ltrim(args ...string) reply {
+	start, stop, errRep := parseRange(args[1:])
+	if errRep != nil {
+		return errRep
+	}
+	if err := s.storage.LTrim(args[0], start, stop); err != nil {
+		return errorReply(err)
+	}
+	return okReply{}
+}
+
+// countReply returns number of changed elements
+func countReply(n int, err error) reply {
+	if err != nil {
+		return errorReply(err)
+	}
+	return intReply(n)
+}
+
+// membersReply returns members as array
+func membersReply(members []string, err error) reply {
+	if err != nil {
+		return errorReply(err)
+	}
+	res := make(arrayReply, len(members))
+	for i, member := range members {
+		res[i] = bulkReply(member)
+	}
+	return res
+}
+
+func (s *Server) sadd(args ...string) reply {
+	return countReply(s.storage.SAdd(args[0], args[1:]...))
+}
+
+func (s *Server) srem(args ...string) reply {
+	return countReply(s.storage.SRem(args[0], args[1:]...))
+}
+
+// smembers returns sorted members of set
+func (s *Server) smembers(args ...string) reply {
+	return membersReply(s.storage.SMembers(args[0]))
+}
+
+func (s *Server) sismember(args ...string) reply {
+	found, err := s.storage.SIsMember(args[0], args[1])
+	if err != nil {
+		return errorReply(err)
+	}
+	if !found {
+		return intReply(0)
+	}
+	return intReply(1)
+}
+
+func (s *Server) sinter(args ...string) reply {
+	return membersReply(s.storage.SInter(args...))
+}
+
+func (s *Server) sunion(args ...string) reply {
+	return membersReply(s.storage.SUnion(args...))
+}
+
+// parseScore parses score of sorted set, infinity is allowed
+func parseScore(arg string) (float64, error) {
+	score, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, dict.ErrNotFloat
+	}
+	return score, nil
+}
+
+// parseScoreBound parses bound of score range, which is excluded if it
+// starts with (
+func parseScoreBound(arg string) (float64, bool, error) {
+	if strings.HasPrefix(arg, "(") {
+		score, err := parseScore(arg[1:])
+		return score, true, err
+	}
+	score, err := parseScore(arg)
+	return score, false, err
+}
+
+// scoredReply returns members of sorted set, followed by their scores if
+// withScores is set
+func scoredReply(members []dict.ScoredMember, withScores bool, err error) reply {
+	if err != nil {
+		return errorReply(err)
+	}
+	res := make(arrayReply, 0, 2*len(members))
+	for _, m := range members {
+		res = append(res, bulkReply(m.Member))
+		if withScores {
+			res = append(res, bulkReply(dict.FormatFloat(m.Score)))
+		}
+	}
+	return res
+}
+
+// zadd sets scores of members, takes scores and members one after another
+//
+// returns number of added members
+func (s *Server) zadd(args ...string) reply {
+	if len(args)%2 != 1 {
+		return errReply("Wrong number of arguments, must be key and score and member pairs")
+	}
+	members := make([]dict.ScoredMember, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		score, err := parseScore(args[i])
+		if err != nil {
+			return errorReply(err)
+		}
+		members = append(members, dict.ScoredMember{Member: args[i+1], Score: score})
+	}
+	return countReply(s.storage.ZAdd(args[0], members...))
+}
+
+func (s *Server) zrem(args ...string) reply {
+	return countReply(s.storage.ZRem(args[0], args[1:]...))
+}
+
+func (s *Server) zscore(args ...string) reply {
+	score, found, err := s.storage.ZScore(args[0], args[1])
+	return valueReply(dict.FormatFloat(score), found, err)
+}
+
+// zrank returns 0-based position of member, nil if it is missing
+func (s *Server) zrank(args ...string) reply {
+	rank, found, err := s.storage.ZRank(args[0], args[1])
+	if err != nil {
+		return errorReply(err)
+	}
+	if !found {
+		return nilReply{}
+	}
+	return intReply(rank)
+}
+
+func (s *Server) zincrby(args ...string) reply {
+	delta, err := parseScore(args[1])
+	if err != nil {
+		return errorReply(err)
+	}
+	score, err := s.storage.ZIncrBy(args[0], args[2], delta)
+	if err != nil {
+		return errorReply(err)
+	}
+	return bulkReply(dict.FormatFloat(score))
+}
+
+// zrange returns members from start to stop position, takes WITHSCORES
+// option
+func (s *Server) zrange(args ...string) reply {
+	withScores := false
+	switch {
+	case len(args) == 4 && strings.EqualFold(args[3], "withscores"):
+		withScores = true
+	case len(args) != 3:
+		return errorReply(errSyntax)
+	}
+	start, stop, errRep := parseRange(args[1:3])
+	if errRep != nil {
+		return errRep
+	}
+	members, err := s.storage.ZRange(args[0], start, stop)
+	return scoredReply(members, withScores, err)
+}
+
+// zrangebyscore returns members with scores from min to max, takes
+// WITHSCORES and LIMIT offset count options
+func (s *Server) zrangebyscore(args ...string) reply {
+	var r dict.ScoreRange
+	var err error
+	if r.Min, r.MinEx, err = parseScoreBound(args[1]); err != nil {
+		return errReply("Min or max is not a float")
+	}
+	if r.Max, r.MaxEx, err = parseScoreBound(args[2]); err != nil {
+		return errReply("Min or max is not a float")
+	}
+	withScores := false
+	offset, count := 0, -1
+	for i := 3; i < len(args); i++ {
+		switch option := strings.ToLower(args[i]); {
+		case option == "withscores":
+			withScores = true
+		case option == "limit" && i+2 < len(args):
+			off, err1 := strconv.Atoi(args[i+1])
+			n, err2 := strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil {
+				return errorReply(dict.ErrNotInteger)
+			}
+			// negative offset returns nothing like in redis
+			if off < 0 {
+				return arrayReply{}
+			}
+			offset, count = off, n
+			i += 2
+		default:
+			return errorReply(errSyntax)
+		}
+	}
+	members, err := s.storage.ZRangeByScore(args[0], r, offset, count)
+	return scoredReply(members, withScores, err)
+}
+
+// typeOf returns kind of value of key, none for missing key
+func (s *Server) typeOf(args ...string) reply {
+	kind, err := s.storage.Type(args[0])
+	if err != nil {
+		return statusReply("none")
+	}
+	return statusReply(kind.String())
+}
+
+// keys returns sorted keys matching glob pattern
+func (s *Server) keys(args ...string) reply {
+	res := s.storage.Keys(func(key string) bool {
+		return clparse.Match(args[0], key)
+	})
+	sort.Strings(res)
+	return membersReply(res, nil)
+}
+
+// scanCount is number of keys returned by one scan call by default
+const scanCount = 10
+
+// scan returns next cursor and part of keys, optionally matching glob
+// pattern, iteration is started and finished by cursor 0
+func (s *Server) scan(args ...string) reply {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return errReply("Invalid cursor")
+	}
+	pattern, count := "", scanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errorReply(errSyntax)
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil {
+				return errorReply(dict.ErrNotInteger)
+			}
+			if count < 1 {
+				return errorReply(errSyntax)
+			}
+		default:
+			return errorReply(errSyntax)
+		}
+	}
+	found, next := s.storage.Scan(cursor, count)
+	res := arrayReply{}
+	for _, key := range found {
+		if pattern == "" || clparse.Match(pattern, key) {
+			res = append(res, bulkReply(key))
+		}
+	}
+	return arrayReply{bulkReply(strconv.FormatUint(next, 10)), res}
+}
+
+// expireAt sets deadline of key, it is removed if deadline has passed
+func (s *Server) expireAt(key string, t time.Time) reply {
+	if err := s.storage.ExpireAt(key, t); err != nil {
+		return missingReply(err, intReply(0))
+	}
+	return compatReply{okReply{}, intReply(1)}
+}
+
+// parseDuration parses integer argument of expire commands in units
+func parseDuration(arg string, unit time.Duration) (time.Duration, reply) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, errorReply(dict.ErrNotInteger)
+	}
+	if n > int64(math.MaxInt64/unit) || n < int64(math.MinInt64/unit) {
+		return 0, errReply(fmt.Sprintf("Invalid expire time %q", arg))
+	}
+	return time.Duration(n) * unit, nil
+}
+
+func (s *Server) pexpire(args ...string) reply {
+	ttl, errRep := parseDuration(args[1], time.Millisecond)
+	if errRep != nil {
+		return errRep
+	}
+	return s.expireIn(args[0], ttl, args[2:])
+}
+
+func (s *Server) expireat(args ...string) reply {
+	sec, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errorReply(dict.ErrNotInteger)
+	}
+	return s.expireAt(args[0], time.Unix(sec, 0))
+}
+
+func (s *Server) pexpireat(args ...string) reply {
+	ms, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errorReply(dict.ErrNotInteger)
+	}
+	return s.expireAt(args[0], time.UnixMilli(ms))
+}
+
+// persist removes expire, returns 1 if key had one
+func (s *Server) persist(args ...string) reply {
+	removed, err := s.storage.Persist(args[0])
+	if err != nil {
+		return missingReply(err, intReply(0))
+	}
+	if !removed {
+		return intReply(0)
+	}
+	return intReply(1)
+}
+
+// ttlReply returns time left before key expires in units, -1 for keys
+// without expire
+func (s *Server) ttlReply(key string, unit time.Duration) reply {
+	left, err := s.storage.TTL(key)
+	if err != nil {
+		return missingReply(err, intReply(-2))
+	}
+	if left == dict.NoTTL {
+		return intReply(-1)
+	}
+	if left < 0 {
+		left = 0
+	}
+	// rounded without overflow for deadlines far away
+	n := left / unit
+	if left%unit >= unit/2 {
+		n++
+	}
+	return intReply(n)
+}
+
+// ttl returns seconds left before key expires, -1 for keys without expire
+func (s *Server) ttl(args ...string) reply {
+	return s.ttlReply(args[0], time.Second)
+}
+
+func (s *Server) pttl(args ...string) reply {
+	return s.ttlReply(args[0], time.Millisecond)
+}
+
+func (s *Server) dbsize(args ...string) reply {
+	return intReply(s.storage.Active())
+}
+
+// flushall removes all keys
+func (s *Server) flushall(args ...string) reply {
+	s.storage.Flush()
+	return okReply{}
+}
+
+func (s *Server) ping(args ...string) reply {
+	return statusReply("PONG")
+}
+
+func (s *Server) echo(args ...string) reply {
+	return bulkReply(args[0])
+}
+
+func (s *Server) stats(args ...string) reply {
+	st := s.storage.Stats()
+	return bulkReply(fmt.Sprintf(
+		"keys:%d expires:%d used_memory:%d evicted_keys:%d expired_lazy:%d expired_active:%d",
+		st.Active, st.Volatile, st.Used, st.Evicted, st.ExpiredLazy, st.ExpiredActive))
+}
@@ -0,0 +1,32 @@
+package server
+
+import "testing"
+
+func TestExpireNotPositive(t *testing.T) {
+	leader, follower := startPair(t)
+	for _, check := range [][]string{
+		{"expire", "0"},
+		{"expire", "-5"},
+		{"pexpire", "0"},
+		{"pexpire", "-5"},
+		{"expire", "0", "sliding"},
+	} {
+		leader.do("set", "k", "v")
+		eventually(t, "key on follower", func() bool {
+			return follower.do("get", "k") == "v"
+		})
+		args := append([]string{check[0], "k"}, check[1:]...)
+		if res := leader.do(args...); res != ":1" {
+			t.Errorf("Wrong reply %q to %q", res, args)
+		}
+		if res := leader.do("get", "k"); res != "(nil)" {
+			t.Errorf("Key is kept by %q", args)
+		}
+		eventually(t, "delete on follower", func() bool {
+			return follower.do("get", "k") == "(nil)"
+		})
+		if res := leader.do(args...); res != ":0" {
+			t.Errorf("Wrong reply %q to %q of missing key", res, args)
+		}
+	}
+}
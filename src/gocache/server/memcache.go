@@ -0,0 +1,624 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	dict "godict"
+	"io"
+	log "logging"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	memcacheMaxKey  = 250
+	memcacheMaxItem = 1024 * 1024
+	memcacheMaxLine = 2048
+
+	// exptime bigger than this is unix timestamp
+	memcacheRelativeExpire = 60 * 60 * 24 * 30
+)
+
+// memcacheStats are counters reported by stats command
+type memcacheStats struct {
+	started     time.Time
+	connections int64
+	cmdGet      uint64
+	cmdSet      uint64
+	cmdTouch    uint64
+	getHits     uint64
+	getMisses   uint64
+}
+
+type memcacheError string
+
+var errNonNumeric = memcacheError("cannot increment or decrement non-numeric value")
+
+func (e memcacheError) Error() string {
+	return fmt.Sprintf("CLIENT_ERROR %s", string(e))
+}
+
+// memcacheConn is state of memcached protocol connection
+type memcacheConn struct {
+	srv *Server
+	r   *bufio.Reader
+	w   *bufio.Writer
+}
+
+func (s *Server) handleMemcacheConnection(conn net.Conn) {
+	defer conn.Close()
+	defer log.Debug("Memcache connection closed: %v", conn.RemoteAddr())
+	log.Debug("Incomming memcache connection: %v", conn.RemoteAddr())
+	atomic.AddInt64(&s.memcacheStats.connections, 1)
+	defer atomic.AddInt64(&s.memcacheStats.connections, -1)
+
+	c := &memcacheConn{
+		srv: s,
+		r:   bufio.NewReaderSize(conn, memcacheMaxLine),
+		w:   bufio.NewWriter(conn),
+	}
+	// protocol is chosen by first byte, binary requests start with magic
+	if first, err := c.r.Peek(1); err == nil && first[0] == mcbRequestMagic {
+		s.handleMemcacheBinary(c.r, c.w)
+		return
+	}
+	for {
+		line, err := c.readLine()
+		if err == bufio.ErrBufferFull {
+			c.w.WriteString("CLIENT_ERROR line is too long\r\n")
+			c.w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 {
+			c.w.WriteString("ERROR\r\n")
+		} else {
+			log.Debug("Incomming memcache command: %q", fields)
+			if quit := c.process(fields[0], fields[1:]); quit {
+				c.w.Flush()
+				return
+			}
+		}
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLine reads command line. Lines are limited to memcacheMaxLine, except
+// get and gets, which take any number of keys.
+func (c *memcacheConn) readLine() ([]byte, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != bufio.ErrBufferFull ||
+		!bytes.HasPrefix(line, []byte("get ")) && !bytes.HasPrefix(line, []byte("gets ")) {
+		return line, err
+	}
+	line = append([]byte(nil), line...)
+	rest, err := c.r.ReadBytes('\n')
+	return append(line, rest...), err
+}
+
+// process runs command, returns true if connection must be closed
+func (c *memcacheConn) process(command string, args []string) bool {
+	var err error
+	switch command {
+	case "get", "gets":
+		err = c.get(args, command == "gets")
+	case "set", "add", "replace", "append", "prepend", "cas":
+		err = c.store(command, args)
+	case "delete":
+		err = c.delete(args)
+	case "incr", "decr":
+		err = c.incr(args, command == "decr")
+	case "touch":
+		err = c.touch(args)
+	case "flush_all":
+		err = c.flush(args)
+	case "stats":
+		c.stats()
+	case "version":
+		fmt.Fprintf(c.w, "VERSION %s\r\n", Version)
+	case "verbosity":
+		c.reply(noreply(args), "OK")
+	case "quit":
+		return true
+	default:
+		c.w.WriteString("ERROR\r\n")
+	}
+	if err != nil {
+		if _, ok := err.(memcacheError); ok {
+			fmt.Fprintf(c.w, "%v\r\n", err)
+		} else {
+			fmt.Fprintf(c.w, "SERVER_ERROR %v\r\n", err)
+		}
+	}
+	return false
+}
+
+// reply writes response unless client asked for noreply
+func (c *memcacheConn) reply(quiet bool, res string) {
+	if quiet {
+		return
+	}
+	c.w.WriteString(res)
+	c.w.WriteString("\r\n")
+}
+
+func noreply(args []string) bool {
+	return len(args) > 0 && args[len(args)-1] == "noreply"
+}
+
+func checkMemcacheKey(key string) error {
+	if len(key) > memcacheMaxKey {
+		return memcacheError("key is too long")
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return memcacheError("bad key")
+		}
+	}
+	return nil
+}
+
+// memcacheTTL converts exptime to duration, second result is false if item
+// is already expired
+func memcacheTTL(arg string) (time.Duration, bool, error) {
+	exptime, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, false, memcacheError("bad exptime")
+	}
+	switch {
+	case exptime == 0:
+		return 0, true, nil
+	case exptime < 0:
+		return 0, false, nil
+	case exptime > memcacheRelativeExpire:
+		ttl := time.Until(time.Unix(exptime, 0))
+		return ttl, ttl > 0, nil
+	}
+	return time.Duration(exptime) * time.Second, true, nil
+}
+
+func (c *memcacheConn) get(keys []string, withCAS bool) error {
+	if len(keys) == 0 {
+		return memcacheError("no keys")
+	}
+	// items are copied under execMu, so they don't show part of transaction
+	// and slow client doesn't hold it while they are written
+	type item struct {
+		key, value string
+		flags      uint32
+		version    uint64
+	}
+	var items []item
+	c.srv.execMu.RLock()
+	for _, key := range keys {
+		atomic.AddUint64(&c.srv.memcacheStats.cmdGet, 1)
+		slot, err := c.srv.storage.Get(key)
+		if err != nil {
+			atomic.AddUint64(&c.srv.memcacheStats.getMisses, 1)
+			continue
+		}
+		atomic.AddUint64(&c.srv.memcacheStats.getHits, 1)
+		items = append(items, item{key, slot.Value(), slot.Flags(), slot.Version()})
+	}
+	c.srv.execMu.RUnlock()
+
+	for _, it := range items {
+		if withCAS {
+			fmt.Fprintf(c.w, "VALUE %s %d %d %d\r\n", it.key, it.flags, len(it.value), it.version)
+		} else {
+			fmt.Fprintf(c.w, "VALUE %s %d %d\r\n", it.key, it.flags, len(it.value))
+		}
+		c.w.WriteString(it.value)
+		c.w.WriteString("\r\n")
+	}
+	c.w.WriteString("END\r\n")
+	return nil
+}
+
+// readData reads data block of n bytes terminated by \r\n
+func (c *memcacheConn) readData(n int) (string, error) {
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return "", err
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return "", memcacheError("bad data chunk")
+	}
+	return string(buf[:n]), nil
+}
+
+// store runs set, add, replace, append, prepend and cas commands:
+// <command> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+func (c *memcacheConn) store(command string, args []string) error {
+	atomic.AddUint64(&c.srv.memcacheStats.cmdSet, 1)
+	quiet := noreply(args)
+	if quiet {
+		args = args[:len(args)-1]
+	}
+	argNum := 4
+	if command == "cas" {
+		argNum = 5
+	}
+	if len(args) != argNum {
+		return memcacheError("bad command line format")
+	}
+	size, err := strconv.Atoi(args[3])
+	if err != nil || size < 0 {
+		return memcacheError("bad data chunk")
+	}
+	if size > memcacheMaxItem {
+		// swallow data, so connection stays usable
+		io.CopyN(io.Discard, c.r, int64(size)+2)
+		return fmt.Errorf("object too large for cache")
+	}
+	value, err := c.readData(size)
+	if err != nil {
+		return err
+	}
+
+	key := args[0]
+	if err := checkMemcacheKey(key); err != nil {
+		return err
+	}
+	if c.srv.following() {
+		return errReadOnly
+	}
+	flags, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return memcacheError("bad command line format")
+	}
+	ttl, alive, err := memcacheTTL(args[2])
+	if err != nil {
+		return err
+	}
+	opts := dict.SetOptions{Flags: uint32(flags), TTL: ttl}
+
+	switch command {
+	case "add":
+		opts.OnlyNew = true
+	case "replace":
+		opts.OnlyExisting = true
+	case "cas":
+		opts.Version, err = strconv.ParseUint(args[4], 10, 64)
+		if err != nil || opts.Version == 0 {
+			return memcacheError("bad command line format")
+		}
+	case "append", "prepend":
+		// flags and exptime are ignored, like memcached does
+		_, _, err = c.srv.memcacheUpdate(key, func(old string) (string, error) {
+			if len(old)+len(value) > memcacheMaxItem {
+				return "", fmt.Errorf("object too large for cache")
+			}
+			if command == "append" {
+				return old + value, nil
+			}
+			return value + old, nil
+		})
+		return c.storeResult(command, quiet, err)
+	}
+
+	_, err = c.srv.memcacheSet(key, value, opts, alive)
+	return c.storeResult(command, quiet, err)
+}
+
+func (c *memcacheConn) storeResult(command string, quiet bool, err error) error {
+	switch err.(type) {
+	case nil:
+		c.reply(quiet, "STORED")
+	case dict.KeyError:
+		// cas on missing item differs from replace or append to it
+		if command == "cas" {
+			c.reply(quiet, "NOT_FOUND")
+		} else {
+			c.reply(quiet, "NOT_STORED")
+		}
+	default:
+		switch err {
+		case dict.ErrKeyExists:
+			c.reply(quiet, "NOT_STORED")
+		case dict.ErrVersionMismatch:
+			c.reply(quiet, "EXISTS")
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *memcacheConn) delete(args []string) error {
+	if c.srv.following() {
+		return errReadOnly
+	}
+	quiet := noreply(args)
+	if quiet {
+		args = args[:len(args)-1]
+	}
+	// legacy zero time argument is accepted
+	if len(args) == 2 && args[1] == "0" {
+		args = args[:1]
+	}
+	if len(args) != 1 {
+		return memcacheError("bad command line format")
+	}
+	if err := c.srv.memcacheDelete(args[0]); err != nil {
+		c.reply(quiet, "NOT_FOUND")
+		return nil
+	}
+	c.reply(quiet, "DELETED")
+	return nil
+}
+
+// incr changes decimal 64 bit unsigned value, incr wraps around on
+// overflow and decr stops at 0
+func (c *memcacheConn) incr(args []string, decr bool) error {
+	if c.srv.following() {
+		return errReadOnly
+	}
+	quiet := noreply(args)
+	if quiet {
+		args = args[:len(args)-1]
+	}
+	if len(args) != 2 {
+		return memcacheError("bad command line format")
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return memcacheError("invalid numeric delta argument")
+	}
+	res, _, err := c.srv.memcacheIncr(args[0], delta, decr)
+	if _, ok := err.(dict.KeyError); ok {
+		c.reply(quiet, "NOT_FOUND")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.reply(quiet, res)
+	return nil
+}
+
+// memcacheIncr returns new value and its cas unique
+func (s *Server) memcacheIncr(key string, delta uint64, decr bool) (string, uint64, error) {
+	return s.memcacheUpdate(key, func(old string) (string, error) {
+		n, err := strconv.ParseUint(strings.TrimSpace(old), 10, 64)
+		if err != nil {
+			return "", errNonNumeric
+		}
+		switch {
+		case !decr:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		return strconv.FormatUint(n, 10), nil
+	})
+}
+
+// memcacheWrite runs change of storage made by memcached command like
+// runWrite does for other protocols, under execMu, so it never runs in the
+// middle of transaction. apply returns encoded redis commands with the same
+// effect, which are propagated unless they are nil.
+func (s *Server) memcacheWrite(apply func() ([]byte, error)) error {
+	s.execMu.RLock()
+	defer s.execMu.RUnlock()
+	s.writeMu.RLock()
+	if !s.propagating() {
+		defer s.writeMu.RUnlock()
+		if s.closing {
+			return ErrServerClosed
+		}
+		_, err := apply()
+		return err
+	}
+	s.writeMu.RUnlock()
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.closing {
+		return ErrServerClosed
+	}
+	commands, err := apply()
+	if err == nil && commands != nil {
+		s.propagate(commands)
+	}
+	return err
+}
+
+// memcacheSetCommand returns set command, which stores value with options
+func memcacheSetCommand(key, value string, opts dict.SetOptions) []byte {
+	args := []string{key, value}
+	switch {
+	case opts.KeepTTL:
+		args = append(args, "keepttl")
+	case !opts.Deadline.IsZero():
+		args = append(args, "pxat", strconv.FormatInt(opts.Deadline.UnixMilli(), 10))
+	}
+	if opts.Flags != 0 {
+		args = append(args, "flags", strconv.FormatUint(uint64(opts.Flags), 10))
+	}
+	return encodeCommand(nil, "set", args...)
+}
+
+// memcacheSet stores value and returns its cas unique. TTL is turned into
+// deadline, so it is the same on followers and after restart. Item which is
+// not alive is stored and removed right away, so conditions of add, replace
+// and cas are still checked.
+func (s *Server) memcacheSet(key, value string, opts dict.SetOptions, alive bool) (uint64, error) {
+	if opts.TTL > 0 {
+		opts.Deadline = time.UnixMilli(time.Now().Add(opts.TTL).UnixMilli())
+		opts.TTL = 0
+	}
+	var version uint64
+	err := s.memcacheWrite(func() ([]byte, error) {
+		stored, err := s.storage.SetWithOptions(key, value, opts)
+		if err != nil {
+			return nil, err
+		}
+		version = stored.Version()
+		if !alive {
+			s.storage.Delete(key)
+			return encodeCommand(nil, "del", key), nil
+		}
+		return memcacheSetCommand(key, value, opts), nil
+	})
+	return version, err
+}
+
+// memcacheUpdate changes value of existing key keeping its flags and
+// expire, returns new value and its cas unique
+func (s *Server) memcacheUpdate(key string, f func(old string) (string, error)) (string, uint64, error) {
+	var value string
+	var version uint64
+	err := s.memcacheWrite(func() ([]byte, error) {
+		res, err := s.storage.Update(key, f)
+		if err != nil {
+			return nil, err
+		}
+		value, version = res.Value(), res.Version()
+		return memcacheSetCommand(key, value, dict.SetOptions{KeepTTL: true, Flags: res.Flags()}), nil
+	})
+	return value, version, err
+}
+
+func (s *Server) memcacheDelete(key string) error {
+	return s.memcacheWrite(func() ([]byte, error) {
+		if err := s.storage.Delete(key); err != nil {
+			return nil, err
+		}
+		return encodeCommand(nil, "del", key), nil
+	})
+}
+
+// memcacheExpire sets new expire of key, ttl 0 removes expire and key is
+// removed if it is not alive
+func (s *Server) memcacheExpire(key string, ttl time.Duration, alive bool) error {
+	if !alive {
+		return s.memcacheDelete(key)
+	}
+	return s.memcacheWrite(func() ([]byte, error) {
+		if ttl == 0 {
+			if _, err := s.storage.Persist(key); err != nil {
+				return nil, err
+			}
+			return encodeCommand(nil, "persist", key), nil
+		}
+		deadline := time.Now().Add(ttl).UnixMilli()
+		if err := s.storage.ExpireAt(key, time.UnixMilli(deadline)); err != nil {
+			return nil, err
+		}
+		return encodeCommand(nil, "pexpireat", key, strconv.FormatInt(deadline, 10)), nil
+	})
+}
+
+// memcacheFlush removes all keys after delay, delayed flush is skipped if
+// server is shut down before
+func (s *Server) memcacheFlush(delay time.Duration) error {
+	flush := func() ([]byte, error) {
+		select {
+		case <-s.done:
+			return nil, ErrServerClosed
+		default:
+		}
+		s.storage.Flush()
+		return encodeCommand(nil, "flushall"), nil
+	}
+	if delay == 0 {
+		return s.memcacheWrite(flush)
+	}
+	time.AfterFunc(delay, func() {
+		if err := s.memcacheWrite(flush); err != nil && err != ErrServerClosed {
+			log.Err("Delayed flush failed: %v", err)
+		}
+	})
+	return nil
+}
+
+func (c *memcacheConn) touch(args []string) error {
+	if c.srv.following() {
+		return errReadOnly
+	}
+	atomic.AddUint64(&c.srv.memcacheStats.cmdTouch, 1)
+	quiet := noreply(args)
+	if quiet {
+		args = args[:len(args)-1]
+	}
+	if len(args) != 2 {
+		return memcacheError("bad command line format")
+	}
+	ttl, alive, err := memcacheTTL(args[1])
+	if err != nil {
+		return err
+	}
+	if err := c.srv.memcacheExpire(args[0], ttl, alive); err != nil {
+		c.reply(quiet, "NOT_FOUND")
+		return nil
+	}
+	c.reply(quiet, "TOUCHED")
+	return nil
+}
+
+func (c *memcacheConn) flush(args []string) error {
+	if c.srv.following() {
+		return errReadOnly
+	}
+	quiet := noreply(args)
+	if quiet {
+		args = args[:len(args)-1]
+	}
+	if len(args) > 1 {
+		return memcacheError("bad command line format")
+	}
+	var delay uint64
+	if len(args) == 1 {
+		var err error
+		delay, err = strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			return memcacheError("bad command line format")
+		}
+	}
+	if err := c.srv.memcacheFlush(time.Duration(delay) * time.Second); err != nil {
+		return err
+	}
+	c.reply(quiet, "OK")
+	return nil
+}
+
+func (c *memcacheConn) stats() {
+	c.srv.memcacheStatList(func(name string, value interface{}) {
+		fmt.Fprintf(c.w, "STAT %s %v\r\n", name, value)
+	})
+	c.w.WriteString("END\r\n")
+}
+
+// memcacheStatList passes every stat to function stat
+func (s *Server) memcacheStatList(stat func(name string, value interface{})) {
+	st := s.storage.Stats()
+	now := time.Now()
+	stat("pid", os.Getpid())
+	stat("uptime", int64(now.Sub(s.memcacheStats.started)/time.Second))
+	stat("time", now.Unix())
+	stat("version", Version)
+	stat("curr_connections", atomic.LoadInt64(&s.memcacheStats.connections))
+	stat("cmd_get", atomic.LoadUint64(&s.memcacheStats.cmdGet))
+	stat("cmd_set", atomic.LoadUint64(&s.memcacheStats.cmdSet))
+	stat("cmd_touch", atomic.LoadUint64(&s.memcacheStats.cmdTouch))
+	stat("get_hits", atomic.LoadUint64(&s.memcacheStats.getHits))
+	stat("get_misses", atomic.LoadUint64(&s.memcacheStats.getMisses))
+	stat("curr_items", st.Active)
+	stat("bytes", st.Used)
+	stat("evictions", st.Evicted)
+}
@@ -0,0 +1,473 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	dict "godict"
+	"io"
+	log "logging"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// memcached binary protocol constants
+const (
+	mcbRequestMagic  byte = 0x80
+	mcbResponseMagic byte = 0x81
+	mcbHeaderLen          = 24
+
+	// expiration of incr and decr meaning that missing key must not be
+	// created
+	mcbNoInitial uint32 = 0xffffffff
+)
+
+const (
+	mcbGet        byte = 0x00
+	mcbSet        byte = 0x01
+	mcbAdd        byte = 0x02
+	mcbReplace    byte = 0x03
+	mcbDelete     byte = 0x04
+	mcbIncrement  byte = 0x05
+	mcbDecrement  byte = 0x06
+	mcbQuit       byte = 0x07
+	mcbFlush      byte = 0x08
+	mcbGetQ       byte = 0x09
+	mcbNoop       byte = 0x0a
+	mcbVersion    byte = 0x0b
+	mcbGetK       byte = 0x0c
+	mcbGetKQ      byte = 0x0d
+	mcbAppend     byte = 0x0e
+	mcbPrepend    byte = 0x0f
+	mcbStat       byte = 0x10
+	mcbSetQ       byte = 0x11
+	mcbAddQ       byte = 0x12
+	mcbReplaceQ   byte = 0x13
+	mcbDeleteQ    byte = 0x14
+	mcbIncrementQ byte = 0x15
+	mcbDecrementQ byte = 0x16
+	mcbQuitQ      byte = 0x17
+	mcbFlushQ     byte = 0x18
+	mcbAppendQ    byte = 0x19
+	mcbPrependQ   byte = 0x1a
+	mcbTouch      byte = 0x1c
+	mcbGAT        byte = 0x1d
+	mcbGATQ       byte = 0x1e
+)
+
+// quietOps maps quiet opcodes to their loud versions
+var quietOps = map[byte]byte{
+	mcbGetQ:       mcbGet,
+	mcbGetKQ:      mcbGetK,
+	mcbSetQ:       mcbSet,
+	mcbAddQ:       mcbAdd,
+	mcbReplaceQ:   mcbReplace,
+	mcbDeleteQ:    mcbDelete,
+	mcbIncrementQ: mcbIncrement,
+	mcbDecrementQ: mcbDecrement,
+	mcbQuitQ:      mcbQuit,
+	mcbFlushQ:     mcbFlush,
+	mcbAppendQ:    mcbAppend,
+	mcbPrependQ:   mcbPrepend,
+	mcbGATQ:       mcbGAT,
+}
+
+type mcbStatus uint16
+
+const (
+	mcbOK             mcbStatus = 0x00
+	mcbKeyNotFound    mcbStatus = 0x01
+	mcbKeyExists      mcbStatus = 0x02
+	mcbTooLarge       mcbStatus = 0x03
+	mcbInvalidArgs    mcbStatus = 0x04
+	mcbNotStored      mcbStatus = 0x05
+	mcbNonNumeric     mcbStatus = 0x06
+	mcbUnknownCommand mcbStatus = 0x81
+	mcbOutOfMemory    mcbStatus = 0x82
+)
+
+var mcbStatusText = map[mcbStatus]string{
+	mcbKeyNotFound:    "Not found",
+	mcbKeyExists:      "Data exists for key",
+	mcbTooLarge:       "Too large",
+	mcbInvalidArgs:    "Invalid arguments",
+	mcbNotStored:      "Not stored",
+	mcbNonNumeric:     "Non-numeric server-side value for incr or decr",
+	mcbUnknownCommand: "Unknown command",
+	mcbOutOfMemory:    "Out of memory",
+}
+
+// mcbPacket is request or response of binary protocol
+type mcbPacket struct {
+	opcode byte
+	status mcbStatus // vbucket id in requests
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    string
+	value  string
+}
+
+type mcbConn struct {
+	srv *Server
+	r   *bufio.Reader
+	w   *bufio.Writer
+}
+
+func readMcbPacket(r *bufio.Reader) (*mcbPacket, error) {
+	var header [mcbHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != mcbRequestMagic {
+		return nil, fmt.Errorf("Wrong magic byte %#x", header[0])
+	}
+	keyLen := int(binary.BigEndian.Uint16(header[2:4]))
+	extLen := int(header[4])
+	bodyLen := int(binary.BigEndian.Uint32(header[8:12]))
+	if keyLen+extLen > bodyLen || bodyLen > memcacheMaxItem+memcacheMaxLine {
+		return nil, fmt.Errorf("Wrong body length %d", bodyLen)
+	}
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &mcbPacket{
+		opcode: header[1],
+		status: mcbStatus(binary.BigEndian.Uint16(header[6:8])),
+		opaque: binary.BigEndian.Uint32(header[12:16]),
+		cas:    binary.BigEndian.Uint64(header[16:24]),
+		extras: body[:extLen],
+		key:    string(body[extLen : extLen+keyLen]),
+		value:  string(body[extLen+keyLen:]),
+	}, nil
+}
+
+func (c *mcbConn) write(p *mcbPacket) {
+	var header [mcbHeaderLen]byte
+	header[0] = mcbResponseMagic
+	header[1] = p.opcode
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(p.key)))
+	header[4] = byte(len(p.extras))
+	binary.BigEndian.PutUint16(header[6:8], uint16(p.status))
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(p.extras)+len(p.key)+len(p.value)))
+	binary.BigEndian.PutUint32(header[12:16], p.opaque)
+	binary.BigEndian.PutUint64(header[16:24], p.cas)
+	c.w.Write(header[:])
+	c.w.Write(p.extras)
+	c.w.WriteString(p.key)
+	c.w.WriteString(p.value)
+}
+
+// handleMemcacheBinary serves connection which started with binary request
+func (s *Server) handleMemcacheBinary(r *bufio.Reader, w *bufio.Writer) {
+	c := &mcbConn{s, r, w}
+	for {
+		req, err := readMcbPacket(c.r)
+		if err != nil {
+			if err != io.EOF {
+				log.Debug("Memcache binary protocol error: %v", err)
+			}
+			c.w.Flush()
+			return
+		}
+		log.Debug("Incomming memcache binary command %#x, key %q", req.opcode, req.key)
+
+		opcode, quiet := req.opcode, false
+		if loud, ok := quietOps[opcode]; ok {
+			opcode, quiet = loud, true
+		}
+		res := &mcbPacket{opcode: req.opcode, opaque: req.opaque}
+		quit := c.process(opcode, req, res)
+
+		// quiet gets are suppressed on miss, other quiet commands on success
+		switch {
+		case !quiet:
+			c.write(res)
+		case opcode == mcbGet || opcode == mcbGetK || opcode == mcbGAT:
+			if res.status != mcbKeyNotFound {
+				c.write(res)
+			}
+		case res.status != mcbOK:
+			c.write(res)
+		}
+		if quit {
+			c.w.Flush()
+			return
+		}
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// process fills response for request, returns true if connection must be
+// closed
+func (c *mcbConn) process(opcode byte, req, res *mcbPacket) bool {
+	switch opcode {
+	case mcbSet, mcbAdd, mcbReplace, mcbAppend, mcbPrepend, mcbDelete,
+		mcbIncrement, mcbDecrement, mcbTouch, mcbGAT, mcbFlush:
+		if c.srv.following() {
+			res.status = mcbNotStored
+			res.value = errReadOnly.Error()
+			return false
+		}
+	}
+	switch opcode {
+	case mcbGet, mcbGetK, mcbGAT:
+		c.get(opcode, req, res)
+	case mcbSet, mcbAdd, mcbReplace:
+		c.store(opcode, req, res)
+	case mcbAppend, mcbPrepend:
+		c.appendValue(opcode, req, res)
+	case mcbDelete:
+		if len(req.extras) != 0 || req.key == "" || req.value != "" {
+			res.status = mcbInvalidArgs
+		} else if err := c.srv.memcacheDelete(req.key); err != nil {
+			res.status = mcbKeyNotFound
+		}
+	case mcbIncrement, mcbDecrement:
+		c.incr(opcode, req, res)
+	case mcbTouch:
+		c.touch(req, res)
+	case mcbFlush:
+		c.flush(req, res)
+	case mcbNoop:
+	case mcbVersion:
+		res.value = Version
+	case mcbStat:
+		c.stats(res)
+	case mcbQuit:
+		return true
+	default:
+		res.status = mcbUnknownCommand
+	}
+	if res.status != mcbOK && res.value == "" {
+		res.extras, res.key, res.cas = nil, "", 0
+		res.value = mcbStatusText[res.status]
+	}
+	return false
+}
+
+// mcbError sets status of response from storage error
+func mcbError(res *mcbPacket, err error) {
+	if _, ok := err.(dict.KeyError); ok {
+		res.status = mcbKeyNotFound
+		return
+	}
+	switch err {
+	case dict.ErrKeyExists, dict.ErrVersionMismatch:
+		res.status = mcbKeyExists
+	case dict.ErrOutOfMemory:
+		res.status = mcbOutOfMemory
+	case errNonNumeric:
+		res.status = mcbNonNumeric
+	default:
+		log.Err("Memcache binary command failed: %v", err)
+		res.status = mcbNotStored
+	}
+}
+
+// mcbTTL converts expiration extra to duration, second result is false if
+// item is already expired
+func mcbTTL(exptime uint32) (time.Duration, bool) {
+	ttl, alive, _ := memcacheTTL(strconv.FormatInt(int64(int32(exptime)), 10))
+	return ttl, alive
+}
+
+func (c *mcbConn) get(opcode byte, req, res *mcbPacket) {
+	if req.key == "" || req.value != "" {
+		res.status = mcbInvalidArgs
+		return
+	}
+	atomic.AddUint64(&c.srv.memcacheStats.cmdGet, 1)
+	if opcode == mcbGAT {
+		if len(req.extras) != 4 {
+			res.status = mcbInvalidArgs
+			return
+		}
+		atomic.AddUint64(&c.srv.memcacheStats.cmdTouch, 1)
+		if !c.expire(req.key, binary.BigEndian.Uint32(req.extras)) {
+			res.status = mcbKeyNotFound
+			atomic.AddUint64(&c.srv.memcacheStats.getMisses, 1)
+			return
+		}
+	} else if len(req.extras) != 0 {
+		res.status = mcbInvalidArgs
+		return
+	}
+	// like text get, item is read under execMu to not see part of
+	// transaction
+	c.srv.execMu.RLock()
+	defer c.srv.execMu.RUnlock()
+	slot, err := c.srv.storage.Get(req.key)
+	if err != nil {
+		atomic.AddUint64(&c.srv.memcacheStats.getMisses, 1)
+		res.status = mcbKeyNotFound
+		if opcode == mcbGetK {
+			res.key = req.key
+		}
+		return
+	}
+	atomic.AddUint64(&c.srv.memcacheStats.getHits, 1)
+	res.extras = make([]byte, 4)
+	binary.BigEndian.PutUint32(res.extras, slot.Flags())
+	res.value = slot.Value()
+	res.cas = slot.Version()
+	if opcode == mcbGetK {
+		res.key = req.key
+	}
+}
+
+// expire sets expiration of key, returns false if there is no such key or
+// it is expired
+func (c *mcbConn) expire(key string, exptime uint32) bool {
+	ttl, alive := mcbTTL(exptime)
+	return c.srv.memcacheExpire(key, ttl, alive) == nil && alive
+}
+
+func (c *mcbConn) store(opcode byte, req, res *mcbPacket) {
+	atomic.AddUint64(&c.srv.memcacheStats.cmdSet, 1)
+	if len(req.extras) != 8 || req.key == "" || len(req.key) > memcacheMaxKey {
+		res.status = mcbInvalidArgs
+		return
+	}
+	if len(req.value) > memcacheMaxItem {
+		res.status = mcbTooLarge
+		return
+	}
+	ttl, alive := mcbTTL(binary.BigEndian.Uint32(req.extras[4:8]))
+	opts := dict.SetOptions{
+		Flags:   binary.BigEndian.Uint32(req.extras[0:4]),
+		TTL:     ttl,
+		Version: req.cas,
+	}
+	switch opcode {
+	case mcbAdd:
+		if req.cas != 0 {
+			res.status = mcbInvalidArgs
+			return
+		}
+		opts.OnlyNew = true
+	case mcbReplace:
+		opts.OnlyExisting = true
+	}
+	version, err := c.srv.memcacheSet(req.key, req.value, opts, alive)
+	if err != nil {
+		if _, ok := err.(dict.KeyError); ok && req.cas == 0 {
+			res.status = mcbNotStored
+			return
+		}
+		mcbError(res, err)
+		return
+	}
+	res.cas = version
+}
+
+func (c *mcbConn) appendValue(opcode byte, req, res *mcbPacket) {
+	atomic.AddUint64(&c.srv.memcacheStats.cmdSet, 1)
+	if len(req.extras) != 0 || req.key == "" {
+		res.status = mcbInvalidArgs
+		return
+	}
+	_, version, err := c.srv.memcacheUpdate(req.key, func(old string) (string, error) {
+		if len(old)+len(req.value) > memcacheMaxItem {
+			return "", dict.ErrOutOfMemory
+		}
+		if opcode == mcbAppend {
+			return old + req.value, nil
+		}
+		return req.value + old, nil
+	})
+	if err != nil {
+		if _, ok := err.(dict.KeyError); ok {
+			res.status = mcbNotStored
+			return
+		}
+		mcbError(res, err)
+		return
+	}
+	res.cas = version
+}
+
+// incr creates missing key with initial value unless expiration is
+// mcbNoInitial, value is returned as 64 bit number
+func (c *mcbConn) incr(opcode byte, req, res *mcbPacket) {
+	if len(req.extras) != 20 || req.key == "" || req.value != "" {
+		res.status = mcbInvalidArgs
+		return
+	}
+	delta := binary.BigEndian.Uint64(req.extras[0:8])
+	initial := binary.BigEndian.Uint64(req.extras[8:16])
+	exptime := binary.BigEndian.Uint32(req.extras[16:20])
+
+	for {
+		value, cas, err := c.srv.memcacheIncr(req.key, delta, opcode == mcbDecrement)
+		if err == nil {
+			n, _ := strconv.ParseUint(value, 10, 64)
+			res.value = string(binary.BigEndian.AppendUint64(nil, n))
+			res.cas = cas
+			return
+		}
+		if _, ok := err.(dict.KeyError); !ok || exptime == mcbNoInitial {
+			mcbError(res, err)
+			return
+		}
+		ttl, alive := mcbTTL(exptime)
+		version, err := c.srv.memcacheSet(req.key, strconv.FormatUint(initial, 10),
+			dict.SetOptions{OnlyNew: true, TTL: ttl}, alive)
+		if err == dict.ErrKeyExists {
+			// key was created concurrently, increment it
+			continue
+		}
+		if err != nil {
+			mcbError(res, err)
+			return
+		}
+		res.value = string(binary.BigEndian.AppendUint64(nil, initial))
+		res.cas = version
+		return
+	}
+}
+
+func (c *mcbConn) touch(req, res *mcbPacket) {
+	atomic.AddUint64(&c.srv.memcacheStats.cmdTouch, 1)
+	if len(req.extras) != 4 || req.key == "" || req.value != "" {
+		res.status = mcbInvalidArgs
+		return
+	}
+	if !c.expire(req.key, binary.BigEndian.Uint32(req.extras)) {
+		res.status = mcbKeyNotFound
+	}
+}
+
+func (c *mcbConn) flush(req, res *mcbPacket) {
+	var delay uint32
+	switch len(req.extras) {
+	case 0:
+	case 4:
+		delay = binary.BigEndian.Uint32(req.extras)
+	default:
+		res.status = mcbInvalidArgs
+		return
+	}
+	if err := c.srv.memcacheFlush(time.Duration(delay) * time.Second); err != nil {
+		mcbError(res, err)
+	}
+}
+
+// stats writes every stat in its own packet, terminating empty packet is
+// left in res
+func (c *mcbConn) stats(res *mcbPacket) {
+	c.srv.memcacheStatList(func(name string, value interface{}) {
+		c.write(&mcbPacket{
+			opcode: mcbStat,
+			opaque: res.opaque,
+			key:    name,
+			value:  fmt.Sprint(value),
+		})
+	})
+}
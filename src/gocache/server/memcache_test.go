@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemcacheText(t *testing.T) {
+	s, _ := startServer(t, testConfig())
+	c := dial(t, listen(t, s.ServeMemcache))
+	c.send("set k 5 0 2\r\nab\r\n")
+	c.expect("STORED\r\n")
+	c.send("add k 0 0 1\r\nx\r\n")
+	c.expect("NOT_STORED\r\n")
+	c.send("append k 0 0 2\r\ncd\r\n")
+	c.expect("STORED\r\n")
+	c.send("get k missing\r\n")
+	c.expect("VALUE k 5 4\r\nabcd\r\nEND\r\n")
+	c.send("incr n 1\r\n")
+	c.expect("NOT_FOUND\r\n")
+	c.send("set n 0 0 1\r\n9\r\nincr n 3\r\ndecr n 20\r\n")
+	c.expect("STORED\r\n12\r\n0\r\n")
+
+	// multiget isn't limited by length of line
+	keys := make([]string, 300)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%04d", i)
+	}
+	c.send("set key0299 0 0 1\r\nz\r\nget " + strings.Join(keys, " ") + " k\r\n")
+	c.expect("STORED\r\nVALUE key0299 0 1\r\nz\r\nVALUE k 5 4\r\nabcd\r\nEND\r\n")
+
+	// noreply commands are silent
+	c.send("set q 0 0 1 noreply\r\nv\r\ndelete k noreply\r\nget q k\r\n")
+	c.expect("VALUE q 0 1\r\nv\r\nEND\r\n")
+	c.send("bogus\r\n")
+	c.expect("ERROR\r\n")
+}
+
+// mcbRequest encodes binary protocol request
+func mcbRequest(opcode byte, opaque uint32, extras []byte, key, value string) string {
+	var header [mcbHeaderLen]byte
+	header[0] = mcbRequestMagic
+	header[1] = opcode
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(key)))
+	header[4] = byte(len(extras))
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(header[12:16], opaque)
+	return string(header[:]) + string(extras) + key + value
+}
+
+// mcbResponse reads binary protocol response
+func (c *testClient) mcbResponse() *mcbPacket {
+	c.t.Helper()
+	var header [mcbHeaderLen]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		c.t.Fatalf("Reading response failed: %v", err)
+	}
+	if header[0] != mcbResponseMagic {
+		c.t.Fatalf("Wrong magic byte %#x", header[0])
+	}
+	keyLen := int(binary.BigEndian.Uint16(header[2:4]))
+	extLen := int(header[4])
+	body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		c.t.Fatalf("Reading response failed: %v", err)
+	}
+	return &mcbPacket{
+		opcode: header[1],
+		status: mcbStatus(binary.BigEndian.Uint16(header[6:8])),
+		opaque: binary.BigEndian.Uint32(header[12:16]),
+		cas:    binary.BigEndian.Uint64(header[16:24]),
+		extras: body[:extLen],
+		key:    string(body[extLen : extLen+keyLen]),
+		value:  string(body[extLen+keyLen:]),
+	}
+}
+
+func TestMemcacheBinaryQuiet(t *testing.T) {
+	s, _ := startServer(t, testConfig())
+	c := dial(t, listen(t, s.ServeMemcache))
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	setExtras := make([]byte, 8)
+
+	// quiet get of missing key and successful quiet set are suppressed
+	c.send(mcbRequest(mcbGetQ, 1, nil, "missing", "") +
+		mcbRequest(mcbSetQ, 2, setExtras, "q", "v") +
+		mcbRequest(mcbGetKQ, 3, nil, "q", "") +
+		mcbRequest(mcbAddQ, 4, setExtras, "q", "x") +
+		mcbRequest(mcbDeleteQ, 5, nil, "q", "") +
+		mcbRequest(mcbNoop, 6, nil, "", ""))
+	for _, want := range []mcbPacket{
+		{opcode: mcbGetKQ, opaque: 3, key: "q", value: "v"},
+		{opcode: mcbAddQ, opaque: 4, status: mcbKeyExists, value: mcbStatusText[mcbKeyExists]},
+		{opcode: mcbNoop, opaque: 6},
+	} {
+		res := c.mcbResponse()
+		if res.opcode != want.opcode || res.opaque != want.opaque || res.status != want.status ||
+			res.key != want.key || res.value != want.value {
+			t.Fatalf("Wrong response %+v, must be %+v", res, want)
+		}
+	}
+
+	// loud get reports miss
+	c.send(mcbRequest(mcbGet, 7, nil, "q", ""))
+	if res := c.mcbResponse(); res.status != mcbKeyNotFound || res.opaque != 7 {
+		t.Fatalf("Wrong response %+v to get of deleted key", res)
+	}
+}
+
+func TestMemcacheWaitsExec(t *testing.T) {
+	s, _ := startServer(t, testConfig())
+	addr := listen(t, s.ServeMemcache)
+	text, bin := dial(t, addr), dial(t, addr)
+
+	// lock held by EXEC keeps reads out of transaction
+	s.execMu.Lock()
+	text.send("get k\r\n")
+	bin.send(mcbRequest(mcbGet, 1, nil, "k", ""))
+	buf := make([]byte, 1)
+	for _, c := range []*testClient{text, bin} {
+		c.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := c.r.Read(buf); err == nil {
+			t.Fatal("Memcached get is served during transaction")
+		}
+		c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	}
+	s.execMu.Unlock()
+
+	text.expect("END\r\n")
+	if res := bin.mcbResponse(); res.status != mcbKeyNotFound {
+		t.Fatalf("Wrong response %+v to get after transaction", res)
+	}
+}
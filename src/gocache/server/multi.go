@@ -0,0 +1,180 @@
+package server
+
+import (
+	"clparse"
+	"errors"
+	"strings"
+)
+
+var (
+	errNestedMulti  = errors.New("MULTI calls can not be nested")
+	errWatchInMulti = errors.New("WATCH inside MULTI is not allowed")
+	errExecAbort    = errors.New("EXECABORT Transaction discarded because of previous errors")
+)
+
+// notInTransaction are commands, which wait for background work or take
+// writeMu themselves, so they can't run while EXEC holds it
+var notInTransaction = map[string]bool{
+	"save":         true,
+	"bgrewriteaof": true,
+	"replicaof":    true,
+	"role":         true,
+	"replication":  true,
+}
+
+// queuedCommand is command checked by MULTI and run by EXEC
+type queuedCommand struct {
+	name string
+	opts commandOpt
+	args []string
+}
+
+// transaction is state of MULTI and WATCH of connection
+type transaction struct {
+	srv     *Server
+	multi   bool
+	failed  bool // command with wrong name or arguments was queued
+	queued  []queuedCommand
+	watched map[string]uint64 // version of key when it was watched
+}
+
+// process runs command of connection, between MULTI and EXEC commands are
+// only queued
+func (t *transaction) process(command string, args []string) reply {
+	switch name := strings.ToLower(command); {
+	case name == "multi" || name == "exec" || name == "discard" || name == "watch" || name == "unwatch":
+		return t.control(name, args)
+	case t.multi:
+		return t.queue(command, args)
+	}
+	t.srv.execMu.RLock()
+	defer t.srv.execMu.RUnlock()
+	return t.srv.processCommand(command, args)
+}
+
+// control runs commands, which manage transaction
+func (t *transaction) control(name string, args []string) reply {
+	argNumber := 0
+	if name == "watch" {
+		argNumber = -1
+	}
+	if err := clparse.CheckArgs(len(args), argNumber); err != nil {
+		if t.multi {
+			t.failed = true
+		}
+		return errorReply(err)
+	}
+	switch name {
+	case "multi":
+		if t.multi {
+			return errorReply(errNestedMulti)
+		}
+		t.multi = true
+	case "exec":
+		if !t.multi {
+			return errReply("EXEC without MULTI")
+		}
+		return t.exec()
+	case "discard":
+		if !t.multi {
+			return errReply("DISCARD without MULTI")
+		}
+		t.reset()
+	case "watch":
+		if t.multi {
+			return errorReply(errWatchInMulti)
+		}
+		t.watch(args)
+	case "unwatch":
+		t.watched = nil
+	}
+	return okReply{}
+}
+
+// queue checks command and queues it, EXEC fails if check fails
+func (t *transaction) queue(command string, args []string) reply {
+	name := strings.ToLower(command)
+	if _, ok := subscribeCommands[name]; ok || notInTransaction[name] {
+		t.failed = true
+		return errReply("Command is not allowed in transaction")
+	}
+	opts, errRep := lookUpCommand(command)
+	if errRep != nil {
+		t.failed = true
+		return errRep
+	}
+	if err := clparse.CheckArgs(len(args), opts.argNumber); err != nil {
+		t.failed = true
+		return errorReply(err)
+	}
+	t.queued = append(t.queued, queuedCommand{command, opts, args})
+	return statusReply("QUEUED")
+}
+
+// watch remembers versions of keys, EXEC fails if any of them is changed
+// meanwhile. Key watched twice keeps its first version.
+func (t *transaction) watch(keys []string) {
+	if t.watched == nil {
+		t.watched = make(map[string]uint64, len(keys))
+	}
+	for _, key := range keys {
+		if _, ok := t.watched[key]; !ok {
+			t.watched[key] = t.srv.storage.Version(key)
+		}
+	}
+}
+
+// reset ends transaction and forgets watched keys
+func (t *transaction) reset() {
+	*t = transaction{srv: t.srv}
+}
+
+// exec runs queued commands one after another, it returns array of their
+// replies or nil if any watched key was changed. Blocking commands don't
+// block in transaction.
+func (t *transaction) exec() reply {
+	queued, failed, watched := t.queued, t.failed, t.watched
+	t.reset()
+	if failed {
+		return errorReply(errExecAbort)
+	}
+
+	var res reply
+	t.srv.runExclusive(func() {
+		for key, version := range watched {
+			if t.srv.storage.Version(key) != version {
+				res = nilReply{}
+				return
+			}
+		}
+		replies := make(arrayReply, len(queued))
+		for i, c := range queued {
+			replies[i] = t.srv.execute(c.name, c.opts, c.args)
+			if _, ok := replies[i].(blockReply); ok {
+				replies[i] = nilReply{}
+			}
+		}
+		res = replies
+	})
+	return res
+}
+
+// runExclusive runs f while no other command runs. Writes made by f are
+// propagated after it as one MULTI ... EXEC block, so append only file and
+// followers never get part of it, and snapshot of storage is never taken in
+// the middle of it.
+func (s *Server) runExclusive(f func()) {
+	s.execMu.Lock()
+	defer s.execMu.Unlock()
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.txLog = []byte{}
+	f()
+	commands := s.txLog
+	s.txLog = nil
+	if len(commands) != 0 {
+		b := encodeCommand(nil, "multi")
+		b = append(b, commands...)
+		s.propagate(encodeCommand(b, "exec"))
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWatchAbort(t *testing.T) {
+	_, addr := startServer(t, testConfig())
+	c := dial(t, addr)
+	other := dial(t, addr)
+	c.do("set", "k", "1")
+	c.do("watch", "k")
+	other.do("set", "k", "2")
+	c.do("multi")
+	if res := c.do("incr", "k"); res != "+QUEUED" {
+		t.Fatalf("Wrong reply %q to queued command", res)
+	}
+	if res := c.do("exec"); res != "(nil)" {
+		t.Fatalf("Transaction with changed watched key is run: %q", res)
+	}
+	if res := c.do("get", "k"); res != "2" {
+		t.Fatalf("Wrong value %q after aborted transaction", res)
+	}
+
+	// keys are unwatched by exec
+	c.do("multi")
+	c.do("incr", "k")
+	if res := c.do("exec"); res != ":3" {
+		t.Fatalf("Wrong reply %q to exec", res)
+	}
+}
+
+func TestWatchExpire(t *testing.T) {
+	_, addr := startServer(t, testConfig())
+	c := dial(t, addr)
+	other := dial(t, addr)
+	c.do("set", "k", "1")
+	for _, change := range [][]string{
+		{"expire", "k", "100"},
+		{"pexpire", "k", "100000", "sliding"},
+		{"persist", "k"},
+	} {
+		c.do("watch", "k")
+		other.do(change...)
+		c.do("multi")
+		c.do("incr", "k")
+		if res := c.do("exec"); res != "(nil)" {
+			t.Fatalf("Transaction is run after %v of watched key: %q", change, res)
+		}
+	}
+}
+
+func TestExecAbort(t *testing.T) {
+	_, addr := startServer(t, testConfig())
+	c := dial(t, addr)
+	c.do("multi")
+	c.do("set", "k", "v")
+	if res := c.do("get"); !strings.HasPrefix(res, "-ERR ") {
+		t.Fatalf("Wrong reply %q to command with wrong arguments", res)
+	}
+	if res := c.do("exec"); !strings.HasPrefix(res, "-EXECABORT ") {
+		t.Fatalf("Wrong reply %q to exec of failed transaction", res)
+	}
+	if res := c.do("get", "k"); res != "(nil)" {
+		t.Fatalf("Command of aborted transaction is run: %q", res)
+	}
+	if res := c.do("exec"); !strings.HasPrefix(res, "-ERR EXEC without MULTI") {
+		t.Fatalf("Transaction isn't ended by abort: %q", res)
+	}
+}
+
+func TestExecPropagation(t *testing.T) {
+	_, addr := startServer(t, testConfig())
+	c := dial(t, addr)
+	f := psync(t, addr, "?", "-1")
+	if res := f.syncReply(); !strings.HasPrefix(res, "+FULLRESYNC ") {
+		t.Fatalf("Wrong reply %q to psync", res)
+	}
+	f.loadSnapshot()
+
+	c.do("multi")
+	c.do("set", "a", "1")
+	c.do("get", "a")
+	c.do("incr", "n")
+	if res := c.do("exec"); res != "+OK 1 :1" {
+		t.Fatalf("Wrong reply %q to exec", res)
+	}
+	f.streamed("multi")
+	f.streamed("set", "a", "1")
+	f.streamed("incr", "n")
+	f.streamed("exec")
+
+	// commands, which wait for server, can't be queued
+	c.do("multi")
+	if res := c.do("save"); !strings.HasPrefix(res, "-ERR ") {
+		t.Errorf("Wrong reply %q to save in transaction", res)
+	}
+	if res := c.do("exec"); !strings.HasPrefix(res, "-EXECABORT ") {
+		t.Errorf("Wrong reply %q to exec with save", res)
+	}
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	dict "godict"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// removedFlushInterval is how often keys removed by storage itself are
+// propagated if there are no write commands
+const removedFlushInterval = 100 * time.Millisecond
+
+// propagating reports if write commands must be passed somewhere, it is
+// changed only from false to true with writeMu held
+func (s *Server) propagating() bool {
+	return s.aof != nil || s.leader.active()
+}
+
+// runWrite executes write command and propagates it if it succeeded
+func (s *Server) runWrite(name string, opts commandOpt, args []string) reply {
+	if s.txLog != nil {
+		// EXEC holds writeMu and propagates its commands at once
+		res, command := s.applyWrite(name, opts, args)
+		s.txLog = append(s.txLog, command...)
+		return res
+	}
+	s.writeMu.RLock()
+	if !s.propagating() {
+		defer s.writeMu.RUnlock()
+		res, _ := s.applyWrite(name, opts, args)
+		return res
+	}
+	s.writeMu.RUnlock()
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	res, command := s.applyWrite(name, opts, args)
+	if command != nil {
+		s.propagate(command)
+	}
+	return res
+}
+
+// applyWrite executes write command with writeMu held (for reading if
+// nothing is propagated), it returns reply and encoded command to propagate
+// or nil if nothing must be propagated
+func (s *Server) applyWrite(name string, opts commandOpt, args []string) (reply, []byte) {
+	if s.closing {
+		return errorReply(ErrServerClosed), nil
+	}
+	if !s.propagating() {
+		return opts.f(s, args...), nil
+	}
+	if absolute, ok := absolutes[name]; ok {
+		if absName, absArgs, ok := absolute(time.Now(), args); ok {
+			name, args = absName, absArgs
+			opts = commandsMap[name]
+		}
+	}
+	res := opts.f(s, args...)
+	if failed(res) {
+		return res, nil
+	}
+	if rewrite, ok := rewrites[name]; ok {
+		name, args = rewrite(args)
+	}
+	return res, encodeCommand(nil, name, args...)
+}
+
+// absolutes turn commands, which set expire relative to current time, into
+// commands with absolute deadline before they run, so deadline is the same
+// on every node and after restart
+var absolutes = map[string]func(now time.Time, args []string) (string, []string, bool){
+	"expire": func(now time.Time, args []string) (string, []string, bool) {
+		return pexpireAt(now, args, time.Second)
+	},
+	"pexpire": func(now time.Time, args []string) (string, []string, bool) {
+		return pexpireAt(now, args, time.Millisecond)
+	},
+	"setex": func(now time.Time, args []string) (string, []string, bool) {
+		if _, _, err := setOptions([]string{"ex", args[1]}); err != nil {
+			return "", nil, false
+		}
+		sec, _ := strconv.ParseInt(args[1], 10, 64)
+		return "set", []string{args[0], args[2], "pxat", deadlineArg(now, sec, time.Second)}, true
+	},
+	"set": func(now time.Time, args []string) (string, []string, bool) {
+		opts, _, err := setOptions(args[2:])
+		if err != nil || opts.Idle != 0 {
+			return "", nil, false
+		}
+		res := make([]string, 0, len(args))
+		converted := false
+		for i := 0; i < len(args); i++ {
+			option := strings.ToLower(args[i])
+			if i < 2 || (option != "ex" && option != "px") {
+				res = append(res, args[i])
+				continue
+			}
+			n, _ := strconv.ParseInt(args[i+1], 10, 64)
+			unit := time.Second
+			if option == "px" {
+				unit = time.Millisecond
+			}
+			res = append(res, "pxat", deadlineArg(now, n, unit))
+			converted = true
+			i++
+		}
+		return "set", res, converted
+	},
+}
+
+// pexpireAt converts expire with time in units to pexpireat
+func pexpireAt(now time.Time, args []string, unit time.Duration) (string, []string, bool) {
+	// idle timeout is relative by nature
+	if len(args) > 2 {
+		return "", nil, false
+	}
+	ttl, errRep := parseDuration(args[1], unit)
+	if errRep != nil {
+		return "", nil, false
+	}
+	return "pexpireat", []string{args[0], strconv.FormatInt(now.Add(ttl).UnixMilli(), 10)}, true
+}
+
+// deadlineArg returns unix time in milliseconds n units after now
+func deadlineArg(now time.Time, n int64, unit time.Duration) string {
+	return strconv.FormatInt(now.Add(time.Duration(n)*unit).UnixMilli(), 10)
+}
+
+// rewrites turn commands, which depend on state of this node, into commands
+// with the same effect everywhere
+var rewrites = map[string]func(args []string) (string, []string){
+	// versions differ on followers and after restart
+	"cas": func(args []string) (string, []string) {
+		return "set", args[:2]
+	},
+}
+
+// removedKeys collects keys, which storage removed on its own because their
+// expire is over or they were evicted. Followers don't expire keys, as reads
+// on leader move idle deadlines without telling them, so leader deletes keys
+// for them. Keys are deleted in append only file too, so idle keys don't
+// come back after restart.
+type removedKeys struct {
+	sync.Mutex
+	enabled bool
+	keys    []string
+}
+
+// enable starts collecting keys, it is called when propagation starts
+func (r *removedKeys) enable() {
+	r.Lock()
+	defer r.Unlock()
+	r.enabled = true
+}
+
+// add is called by storage with lock of key shard held, so key is collected
+// before next write to it is propagated
+func (r *removedKeys) add(key string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.enabled {
+		r.keys = append(r.keys, key)
+	}
+}
+
+func (r *removedKeys) take() []string {
+	r.Lock()
+	defer r.Unlock()
+	keys := r.keys
+	r.keys = nil
+	return keys
+}
+
+func (r *removedKeys) empty() bool {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.keys) == 0
+}
+
+// keyEvent gets events of storage keys
+func (s *Server) keyEvent(event dict.Event, key string) {
+	if event&(dict.EventExpired|dict.EventEvicted) != 0 {
+		s.removed.add(key)
+	}
+	if s.cfg.NotifyEvents&event != 0 {
+		s.notifyKeyspace(event, key)
+	}
+}
+
+// flushRemoved propagates removed keys until server is shut down, so they
+// don't wait for next write command
+func (s *Server) flushRemoved() {
+	ticker := time.NewTicker(removedFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if s.removed.empty() {
+			continue
+		}
+		s.writeMu.Lock()
+		s.propagate(nil)
+		s.writeMu.Unlock()
+	}
+}
+
+// propagate must be called with writeMu held, keys removed by storage since
+// previous call are deleted before command
+func (s *Server) propagate(b []byte) {
+	if keys := s.removed.take(); len(keys) != 0 {
+		b = append(encodeCommand(nil, "del", keys...), b...)
+	}
+	if len(b) == 0 {
+		return
+	}
+	if s.aof != nil {
+		s.aof.append(b)
+	}
+	s.leader.feed(b)
+}
+
+// encodeCommand encodes command as redis protocol array of bulk strings
+func encodeCommand(b []byte, name string, args ...string) []byte {
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(len(args)+1), 10)
+	b = append(b, "\r\n"...)
+	for i := -1; i < len(args); i++ {
+		arg := name
+		if i >= 0 {
+			arg = args[i]
+		}
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(len(arg)), 10)
+		b = append(b, "\r\n"...)
+		b = append(b, arg...)
+		b = append(b, "\r\n"...)
+	}
+	return b
+}
+
+// failed reports if reply is error
+func failed(r reply) bool {
+	switch r := r.(type) {
+	case errReply:
+		return true
+	case compatReply:
+		return failed(r.text)
+	}
+	return false
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"bufio"
+	"clparse"
+	"fmt"
+	dict "godict"
+	log "logging"
+	"net"
+	"strings"
+	"sync"
+)
+
+// events of key are published to keyspace channel of key with event as
+// message and to keyevent channel of event with key as message, names are
+// the same as in redis
+const (
+	keyspacePrefix = "__keyspace@0__:"
+	keyeventPrefix = "__keyevent@0__:"
+)
+
+func init() {
+	commandsMap["publish"] = commandOpt{2, (*Server).publish, false}
+}
+
+// subscribeCommands change subscriptions of connection. They take any
+// number of arguments starting from given one, so they are looked up before
+// commandsMap.
+var subscribeCommands = map[string]int{
+	"subscribe":    1,
+	"psubscribe":   1,
+	"unsubscribe":  0,
+	"punsubscribe": 0,
+}
+
+// allowedSubscribed are commands, which subscribed connection may run
+// besides subscribeCommands
+var allowedSubscribed = map[string]bool{"ping": true, "quit": true}
+
+// subscribeReply is returned by subscribe commands, connection switches to
+// push mode with serveSubscriber to run them
+type subscribeReply struct {
+	command string
+	names   []string // channels or patterns, all of them if empty
+}
+
+// subscribeReply is never sent itself, it is nil if protocol can't push
+func (subscribeReply) writeText(w *bufio.Writer) {
+	nilReply{}.writeText(w)
+}
+
+func (subscribeReply) writeRESP(w *bufio.Writer, proto int) {
+	nilReply{}.writeRESP(w, proto)
+}
+
+// subscribeCommand returns subscribeReply if command is one of
+// subscribeCommands
+func subscribeCommand(command string, args []string) (reply, bool) {
+	command = strings.ToLower(command)
+	minArgs, ok := subscribeCommands[command]
+	if !ok {
+		return nil, false
+	}
+	if err := clparse.CheckArgs(len(args), -minArgs); err != nil {
+		return errorReply(err), true
+	}
+	return subscribeReply{command, args}, true
+}
+
+// subscriptions maps channels or patterns to their subscribers
+type subscriptions struct {
+	sync.Mutex
+	// name to []*subscriber, sync.Map lets publishers read it without
+	// locking
+	subs sync.Map
+}
+
+func (ss *subscriptions) load(name string) []*subscriber {
+	v, _ := ss.subs.Load(name)
+	res, _ := v.([]*subscriber)
+	return res
+}
+
+// add and remove copy slices, so publishers read them without locking
+func (ss *subscriptions) add(name string, s *subscriber) {
+	ss.Lock()
+	defer ss.Unlock()
+	subs := ss.load(name)
+	res := make([]*subscriber, len(subs), len(subs)+1)
+	copy(res, subs)
+	ss.subs.Store(name, append(res, s))
+}
+
+func (ss *subscriptions) remove(name string, s *subscriber) {
+	ss.Lock()
+	defer ss.Unlock()
+	var left []*subscriber
+	for _, sub := range ss.load(name) {
+		if sub != s {
+			left = append(left, sub)
+		}
+	}
+	if len(left) == 0 {
+		ss.subs.Delete(name)
+	} else {
+		ss.subs.Store(name, left)
+	}
+}
+
+func (s *Server) publish(args ...string) reply {
+	return intReply(s.publishMessage(args[0], args[1]))
+}
+
+// notifyKeyspace publishes event of key, it is called by storage with lock
+// of shard held
+func (s *Server) notifyKeyspace(event dict.Event, key string) {
+	name := event.String()
+	s.publishMessage(keyspacePrefix+key, name)
+	s.publishMessage(keyeventPrefix+name, key)
+}
+
+// publishMessage sends message to subscribers of channel and of patterns
+// matching it, returns number of receivers
+func (s *Server) publishMessage(channel, message string) int {
+	n := 0
+	for _, sub := range s.channels.load(channel) {
+		sub.send(len(channel)+len(message), pubsubReply{
+			bulkReply("message"), bulkReply(channel), bulkReply(message),
+		})
+		n++
+	}
+	s.patterns.subs.Range(func(k, v interface{}) bool {
+		pattern := k.(string)
+		if !clparse.Match(pattern, channel) {
+			return true
+		}
+		for _, sub := range v.([]*subscriber) {
+			sub.send(len(pattern)+len(channel)+len(message), pubsubReply{
+				bulkReply("pmessage"), bulkReply(pattern), bulkReply(channel), bulkReply(message),
+			})
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// subscriber is connection in push mode. All its replies are queued and
+// written by writeLoop, so messages are never mixed with them.
+type subscriber struct {
+	srv      *Server
+	conn     net.Conn
+	mu       sync.Mutex
+	pending  []reply
+	size     uint64 // bytes of pending replies
+	closed   bool
+	done     bool // no more replies, writeLoop exits when pending are sent
+	wake     chan struct{}
+	channels []string
+	patterns []string
+}
+
+func newSubscriber(srv *Server, conn net.Conn) *subscriber {
+	return &subscriber{srv: srv, conn: conn, wake: make(chan struct{}, 1)}
+}
+
+// send queues reply of size bytes, subscriber is disconnected if it can't
+// keep up
+func (s *subscriber) send(size int, r reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sendLocked(size, r)
+}
+
+func (s *subscriber) sendLocked(size int, r reply) {
+	if s.closed {
+		return
+	}
+	if limit := s.srv.cfg.PubSubLimit; limit != 0 && s.size+uint64(size) > limit {
+		log.Warn("Subscriber %v can't keep up with messages, disconnecting it", s.conn.RemoteAddr())
+		s.closeLocked()
+		return
+	}
+	s.pending = append(s.pending, r)
+	s.size += uint64(size)
+	s.signal()
+}
+
+func (s *subscriber) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeLocked()
+}
+
+func (s *subscriber) closeLocked() {
+	if !s.closed {
+		s.closed = true
+		s.conn.Close()
+		s.signal()
+	}
+}
+
+// finish stops writeLoop after pending replies are written
+func (s *subscriber) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = true
+	s.signal()
+}
+
+// writeLoop writes queued replies until subscriber is finished or closed
+func (s *subscriber) writeLoop(w *bufio.Writer, write func(reply)) {
+	for range s.wake {
+		s.mu.Lock()
+		pending, closed, done := s.pending, s.closed, s.done
+		s.pending, s.size = nil, 0
+		s.mu.Unlock()
+		if closed {
+			return
+		}
+		for _, r := range pending {
+			write(r)
+		}
+		if err := w.Flush(); err != nil {
+			s.close()
+			return
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// count returns number of subscriptions, must be called with lock held
+func (s *subscriber) count() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+// subscribe runs subscribe command and queues its confirmations. Lock is
+// held while subscriptions are changed, so confirmation is queued before
+// any message of channel.
+func (s *subscriber) subscribe(cmd subscribeReply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names, subs := &s.channels, &s.srv.channels
+	if strings.HasPrefix(cmd.command, "p") {
+		names, subs = &s.patterns, &s.srv.patterns
+	}
+	if strings.HasSuffix(cmd.command, "unsubscribe") {
+		if len(cmd.names) == 0 {
+			if len(*names) == 0 {
+				s.sendLocked(len(cmd.command), pubsubReply{bulkReply(cmd.command), nilReply{}, intReply(s.count())})
+				return
+			}
+			cmd.names = append([]string(nil), *names...)
+		}
+		for _, name := range cmd.names {
+			if i := indexOf(*names, name); i >= 0 {
+				*names = append((*names)[:i], (*names)[i+1:]...)
+				subs.remove(name, s)
+			}
+			s.sendLocked(len(name), pubsubReply{bulkReply(cmd.command), bulkReply(name), intReply(s.count())})
+		}
+		return
+	}
+	for _, name := range cmd.names {
+		if indexOf(*names, name) < 0 {
+			*names = append(*names, name)
+			subs.add(name, s)
+		}
+		s.sendLocked(len(name), pubsubReply{bulkReply(cmd.command), bulkReply(name), intReply(s.count())})
+	}
+}
+
+// unsubscribeAll removes all subscriptions of closed connection
+func (s *subscriber) unsubscribeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range s.channels {
+		s.srv.channels.remove(name, s)
+	}
+	for _, name := range s.patterns {
+		s.srv.patterns.remove(name, s)
+	}
+	s.channels, s.patterns = nil, nil
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// process runs command of subscribed connection, returns true if
+// connection must be closed
+func (s *subscriber) process(args []string) bool {
+	command := strings.ToLower(args[0])
+	if res, ok := subscribeCommand(command, args[1:]); ok {
+		if cmd, ok := res.(subscribeReply); ok {
+			s.subscribe(cmd)
+		} else {
+			s.send(0, res)
+		}
+		return false
+	}
+	if !allowedSubscribed[command] {
+		s.send(0, errReply(fmt.Sprintf("Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", command)))
+		return false
+	}
+	if command == "quit" {
+		s.send(0, okReply{})
+		return true
+	}
+	s.send(0, s.srv.processCommand(args[0], args[1:]))
+	return false
+}
+
+// serveSubscriber runs first subscribe command and serves connection in
+// push mode until it has no subscriptions. read returns next command or
+// error reply for malformed one. Returns false if connection must be
+// closed.
+func (srv *Server) serveSubscriber(conn net.Conn, w *bufio.Writer, first subscribeReply, read func() ([]string, reply, error), write func(reply)) bool {
+	s := newSubscriber(srv, conn)
+	defer s.unsubscribeAll()
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		s.writeLoop(w, write)
+	}()
+	s.subscribe(first)
+	quit := false
+	for !quit {
+		s.mu.Lock()
+		n := s.count()
+		s.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		args, errRep, err := read()
+		switch {
+		case err != nil:
+			s.close()
+			<-written
+			return false
+		case errRep != nil:
+			s.send(0, errRep)
+		case len(args) > 0:
+			quit = s.process(args)
+		}
+	}
+	s.finish()
+	<-written
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.closed && !quit
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowSubscriber(t *testing.T) {
+	cfg := testConfig()
+	cfg.PubSubLimit = 256 << 10
+	_, addr := startServer(t, cfg)
+	sub := dial(t, addr)
+	if res := sub.do("subscribe", "news"); res != "subscribe news :1" {
+		t.Fatalf("Wrong reply %q to subscribe", res)
+	}
+	fast := dial(t, addr)
+	if res := fast.do("subscribe", "news"); res != "subscribe news :1" {
+		t.Fatalf("Wrong reply %q to subscribe", res)
+	}
+	go io.Copy(io.Discard, fast.r)
+
+	// subscriber, which doesn't read, is disconnected once socket buffers
+	// and queue are full
+	c := dial(t, addr)
+	message := strings.Repeat("x", 16<<10)
+	for i := 0; ; i++ {
+		res := c.do("publish", "news", message)
+		if res == ":1" {
+			break
+		}
+		if res != ":2" {
+			t.Fatalf("Wrong reply %q to publish", res)
+		}
+		if i == 10000 {
+			t.Fatal("Slow subscriber isn't disconnected")
+		}
+	}
+	sub.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, sub.r); os.IsTimeout(err) {
+		t.Fatal("Connection of slow subscriber isn't closed")
+	}
+}
@@ -0,0 +1,680 @@
+package server
+
+import (
+	"bufio"
+	"clparse"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	dict "godict"
+	log "logging"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Follower sends PSYNC <id> <offset> to redis protocol port of leader. Leader
+// answers +CONTINUE <id> if stream since offset is still in its backlog or
+// +FULLRESYNC <id> <offset> followed by snapshot of storage. Then leader
+// streams write commands in redis protocol and follower acknowledges
+// processed offset by REPLCONF ACK <offset> every second.
+const (
+	replHeartbeat = time.Second
+	replRetry     = time.Second
+	replTimeout   = 5 * time.Second
+	// bytes queued for slow follower before it is disconnected
+	replMaxPending = 64 << 20
+)
+
+var errReadOnly = errors.New("READONLY You can't write against a read only replica")
+
+func init() {
+	// replicaof runs commands from leader, so it can't be in commandsMap
+	// initializer
+	commandsMap["replicaof"] = commandOpt{2, (*Server).replicaof, false}
+}
+
+func newReplID() string {
+	buf := make([]byte, 20)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// replBacklog keeps last bytes of stream for partial resync
+type replBacklog struct {
+	buf []byte
+	end int64 // offset of stream after last written byte
+	n   int   // filled part of buf
+}
+
+func (b *replBacklog) write(p []byte) {
+	size := len(b.buf)
+	if len(p) > size {
+		p = p[len(p)-size:]
+	}
+	pos := int(b.end % int64(size))
+	n := copy(b.buf[pos:], p)
+	copy(b.buf, p[n:])
+	b.end += int64(len(p))
+	b.n = min(b.n+len(p), size)
+}
+
+// since returns stream from offset or false if it isn't in backlog anymore
+func (b *replBacklog) since(offset int64) ([]byte, bool) {
+	if offset < b.end-int64(b.n) || offset > b.end {
+		return nil, false
+	}
+	res := make([]byte, 0, b.end-offset)
+	size := int64(len(b.buf))
+	for i := offset; i < b.end; i++ {
+		res = append(res, b.buf[i%size])
+	}
+	return res, true
+}
+
+// replLeader is state of server as leader, id, offset and backlog are guarded
+// by writeMu, followers by lock
+type replLeader struct {
+	sync.Mutex
+	srv       *Server
+	id        string
+	offset    int64
+	backlog   *replBacklog
+	followers []*followerConn
+}
+
+// active reports if stream is written to backlog, it stays true since first
+// follower connected
+func (l *replLeader) active() bool {
+	return l.backlog != nil
+}
+
+// start creates backlog, must be called with writeMu held
+func (l *replLeader) start() error {
+	if l.backlog != nil {
+		return nil
+	}
+	size := l.srv.cfg.ReplBacklogSize
+	if size == 0 {
+		size = 1
+	}
+	l.backlog = &replBacklog{buf: make([]byte, size), end: l.offset}
+	l.srv.removed.enable()
+	go l.heartbeat()
+	return nil
+}
+
+// feed passes command to backlog and followers, must be called with writeMu
+// held
+func (l *replLeader) feed(b []byte) {
+	if l.backlog == nil {
+		return
+	}
+	l.offset += int64(len(b))
+	l.backlog.write(b)
+	l.Lock()
+	defer l.Unlock()
+	for _, f := range l.followers {
+		f.send(b)
+	}
+}
+
+// heartbeat pings followers, so they know that link is alive
+func (l *replLeader) heartbeat() {
+	ping := encodeCommand(nil, "ping")
+	ticker := time.NewTicker(replHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.srv.done:
+			return
+		case <-ticker.C:
+		}
+		l.srv.writeMu.Lock()
+		l.Lock()
+		n := len(l.followers)
+		l.Unlock()
+		if n > 0 {
+			l.feed(ping)
+		}
+		l.srv.writeMu.Unlock()
+	}
+}
+
+func (l *replLeader) add(f *followerConn) {
+	l.Lock()
+	defer l.Unlock()
+	l.followers = append(l.followers, f)
+}
+
+func (l *replLeader) remove(f *followerConn) {
+	l.Lock()
+	defer l.Unlock()
+	for i, other := range l.followers {
+		if other == f {
+			l.followers = append(l.followers[:i], l.followers[i+1:]...)
+			return
+		}
+	}
+}
+
+// disconnect closes connections of all followers
+func (l *replLeader) disconnect() {
+	l.Lock()
+	defer l.Unlock()
+	for _, f := range l.followers {
+		f.close()
+	}
+}
+
+// followerConn is connection of follower on leader side
+type followerConn struct {
+	conn    net.Conn
+	mu      sync.Mutex
+	pending []byte
+	closed  bool
+	wake    chan struct{}
+	acked   int64 // offset acknowledged by follower
+	ackTime int64 // unix nanoseconds of last acknowledge
+}
+
+func newFollowerConn(conn net.Conn) *followerConn {
+	return &followerConn{conn: conn, wake: make(chan struct{}, 1)}
+}
+
+// send queues data, follower is disconnected if it can't keep up
+func (f *followerConn) send(b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	if len(f.pending)+len(b) > replMaxPending {
+		log.Warn("Follower %v can't keep up with stream, disconnecting it", f.conn.RemoteAddr())
+		f.closeLocked()
+		return
+	}
+	f.pending = append(f.pending, b...)
+	f.signal()
+}
+
+func (f *followerConn) signal() {
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (f *followerConn) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closeLocked()
+}
+
+func (f *followerConn) closeLocked() {
+	if !f.closed {
+		f.closed = true
+		f.conn.Close()
+		f.signal()
+	}
+}
+
+// writeLoop writes queued stream to follower until connection is closed
+func (f *followerConn) writeLoop(w *bufio.Writer) {
+	for range f.wake {
+		f.mu.Lock()
+		data, closed := f.pending, f.closed
+		f.pending = nil
+		f.mu.Unlock()
+		if closed {
+			return
+		}
+		w.Write(data)
+		if err := w.Flush(); err != nil {
+			f.close()
+			return
+		}
+	}
+}
+
+// readAcks reads acknowledges of follower f until connection is closed
+func (s *Server) readAcks(f *followerConn, r *bufio.Reader) {
+	defer f.close()
+	for {
+		args, err := s.readRESPCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 3 && strings.EqualFold(args[0], "replconf") && strings.EqualFold(args[1], "ack") {
+			offset, err := strconv.ParseInt(args[2], 10, 64)
+			if err != nil {
+				return
+			}
+			atomic.StoreInt64(&f.acked, offset)
+			atomic.StoreInt64(&f.ackTime, time.Now().UnixNano())
+		}
+	}
+}
+
+// serveFollower answers PSYNC command and streams writes to follower
+func (s *Server) serveFollower(conn net.Conn, c *respConn, args []string) {
+	fail := func(msg string) {
+		errReply(msg).writeRESP(c.w, c.proto)
+		c.w.Flush()
+	}
+	if s.following() {
+		fail("Chained replication is not supported")
+		return
+	}
+	if len(args) != 2 {
+		fail("Wrong number of arguments for PSYNC")
+		return
+	}
+	offset, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		fail("Wrong PSYNC offset")
+		return
+	}
+
+	f := newFollowerConn(conn)
+	header, snap, err := s.startSync(f, args[0], offset)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	defer s.leader.remove(f)
+
+	log.Info("Follower %v connected, %s", conn.RemoteAddr(), header[1:])
+	c.w.WriteString(header)
+	c.w.WriteString("\r\n")
+	if snap != nil {
+		_, err := snap.WriteTo(c.w)
+		s.releaseSnapshotTurn()
+		if err != nil {
+			log.Err("Sending snapshot to follower %v failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+	f.signal()
+	go s.readAcks(f, c.r)
+	f.writeLoop(c.w)
+	log.Info("Follower %v disconnected", conn.RemoteAddr())
+}
+
+// startSync registers follower, which gets stream since offset if it is in
+// backlog. Otherwise snapshot for full sync is returned, it is taken when
+// other snapshot of storage is finished and caller releases turn of
+// snapshot after it is sent.
+func (s *Server) startSync(f *followerConn, id string, offset int64) (string, *dict.ShardedSnapshot, error) {
+	register := func(offset int64) {
+		f.acked = offset
+		f.ackTime = time.Now().UnixNano()
+		s.leader.add(f)
+	}
+	s.writeMu.Lock()
+	if err := s.leader.start(); err != nil {
+		s.writeMu.Unlock()
+		return "", nil, err
+	}
+	if id == s.leader.id {
+		if data, ok := s.leader.backlog.since(offset); ok {
+			f.pending = data
+			register(offset)
+			s.writeMu.Unlock()
+			return fmt.Sprintf("+CONTINUE %s", s.leader.id), nil, nil
+		}
+	}
+	s.writeMu.Unlock()
+
+	ticker := time.NewTicker(replHeartbeat)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		select {
+		case s.snapshotTurn <- struct{}{}:
+			waiting = false
+		case <-s.done:
+			return "", nil, ErrServerClosed
+		case <-ticker.C:
+			// follower waits for reply, empty lines keep it from timing out
+			if _, err := f.conn.Write([]byte("\n")); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	snap, err := s.storage.Snapshot()
+	if err != nil {
+		s.releaseSnapshotTurn()
+		return "", nil, err
+	}
+	register(s.leader.offset)
+	return fmt.Sprintf("+FULLRESYNC %s %d", s.leader.id, s.leader.offset), snap, nil
+}
+
+// replFollower is state of server as follower
+type replFollower struct {
+	sync.Mutex
+	srv    *Server
+	addr   string // leader address, empty if server is leader
+	stop   chan struct{}
+	conn   net.Conn
+	status string
+
+	// accessed atomically
+	following int32
+	offset    int64
+	lastIO    int64 // unix nanoseconds of last data from leader
+	id        atomic.Value
+}
+
+// following reports if server is read only follower
+func (s *Server) following() bool {
+	return atomic.LoadInt32(&s.replica.following) == 1
+}
+
+// follow starts replication from leader at addr, previous one is stopped
+func (r *replFollower) follow(addr string) {
+	r.unfollow()
+	r.Lock()
+	defer r.Unlock()
+	r.addr = addr
+	r.stop = make(chan struct{})
+	r.status = "connecting"
+	atomic.StoreInt32(&r.following, 1)
+	r.srv.storage.SetKeepExpired(true)
+	r.srv.leader.disconnect()
+	log.Info("Replicating from %s", addr)
+	go r.run(addr, r.stop)
+}
+
+// unfollow stops replication, server becomes leader with new id
+func (r *replFollower) unfollow() {
+	r.Lock()
+	defer r.Unlock()
+	if r.addr == "" {
+		return
+	}
+	log.Info("Stopping replication from %s", r.addr)
+	close(r.stop)
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.addr = ""
+	r.id.Store("")
+	atomic.StoreInt32(&r.following, 0)
+	r.srv.storage.SetKeepExpired(false)
+	r.srv.writeMu.Lock()
+	r.srv.leader.id = newReplID()
+	r.srv.writeMu.Unlock()
+}
+
+func (r *replFollower) setStatus(status string) {
+	r.Lock()
+	defer r.Unlock()
+	r.status = status
+}
+
+func (r *replFollower) run(addr string, stop chan struct{}) {
+	for {
+		err := r.sync(addr, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		r.setStatus("connecting")
+		log.Warn("Replication from %s failed: %v", addr, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(replRetry):
+		}
+	}
+}
+
+// sync connects to leader, loads snapshot if needed and applies stream
+// until connection is broken
+func (r *replFollower) sync(addr string, stop chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", addr, replTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r.Lock()
+	select {
+	case <-stop:
+		r.Unlock()
+		return nil
+	default:
+	}
+	r.conn = conn
+	r.Unlock()
+
+	id, _ := r.id.Load().(string)
+	offset := atomic.LoadInt64(&r.offset)
+	if id == "" {
+		id, offset = "?", -1
+	}
+	if _, err := conn.Write(encodeCommand(nil, "psync", id, strconv.FormatInt(offset, 10))); err != nil {
+		return err
+	}
+	cr := &countingReader{r: conn}
+	br := bufio.NewReaderSize(cr, respMaxInline)
+	position := func() int64 { return cr.n - int64(br.Buffered()) }
+
+	// leader sends empty lines while full sync waits for its turn
+	var line string
+	for line == "" {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		if line, err = readRESPLine(br); err != nil {
+			return err
+		}
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		offset, err = strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("Wrong reply %q", line)
+		}
+		if err := r.load(conn, br); err != nil {
+			return err
+		}
+		r.id.Store(fields[1])
+		atomic.StoreInt64(&r.offset, offset)
+	case len(fields) == 2 && fields[0] == "+CONTINUE":
+		log.Info("Continuing replication from %s at offset %d", addr, offset)
+	case strings.HasPrefix(line, "-"):
+		return fmt.Errorf("Leader refused replication: %s", line[1:])
+	default:
+		return fmt.Errorf("Wrong reply %q", line)
+	}
+	r.setStatus("connected")
+	atomic.StoreInt64(&r.lastIO, time.Now().UnixNano())
+
+	done := make(chan struct{})
+	defer close(done)
+	go r.ack(conn, done)
+	// commands of transaction are applied at its EXEC, offset stays at its
+	// MULTI till then, so broken transaction is sent again
+	var tx [][]string
+	var txLen int64
+	for {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		start := position()
+		args, err := r.srv.readRESPCommand(br)
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt64(&r.lastIO, time.Now().UnixNano())
+		txLen += position() - start
+		switch {
+		case len(args) == 0:
+		case strings.EqualFold(args[0], "multi"):
+			tx = [][]string{}
+		case tx != nil && strings.EqualFold(args[0], "exec"):
+			r.srv.runExclusive(func() {
+				for _, args := range tx {
+					r.srv.applyReplicated(args)
+				}
+			})
+			tx = nil
+		case tx != nil:
+			tx = append(tx, args)
+		default:
+			r.srv.execMu.RLock()
+			r.srv.applyReplicated(args)
+			r.srv.execMu.RUnlock()
+		}
+		if tx == nil {
+			atomic.AddInt64(&r.offset, txLen)
+			txLen = 0
+		}
+	}
+}
+
+// load replaces storage with snapshot sent by leader
+func (r *replFollower) load(conn net.Conn, br *bufio.Reader) error {
+	r.setStatus("sync")
+	start := time.Now()
+	// snapshot may take long to transfer
+	conn.SetReadDeadline(time.Time{})
+	n, err := r.srv.storage.Reload(br)
+	if err != nil {
+		return fmt.Errorf("Loading snapshot from leader failed: %v", err)
+	}
+	log.Info("Loaded %d keys from leader in %v", n, time.Since(start))
+	if a := r.srv.aof; a != nil {
+		// file must contain new data set
+		r.srv.writeMu.Lock()
+		a.Lock()
+		a.partial = true
+		err := a.startRewrite()
+		a.Unlock()
+		r.srv.writeMu.Unlock()
+		if err != nil {
+			log.Err("Rewrite of append only file failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// ack sends processed offset to leader every second until done is closed
+func (r *replFollower) ack(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(replHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			offset := strconv.FormatInt(atomic.LoadInt64(&r.offset), 10)
+			if _, err := conn.Write(encodeCommand(nil, "replconf", "ack", offset)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// applyReplicated runs command from leader, write commands are propagated
+// further to append only file. execMu must be held.
+func (s *Server) applyReplicated(args []string) {
+	opts, errRep := lookUpCommand(args[0])
+	if errRep != nil || clparse.CheckArgs(len(args)-1, opts.argNumber) != nil {
+		log.Err("Wrong command %q from leader", args)
+		return
+	}
+	var res reply
+	if opts.write {
+		res = s.runWrite(strings.ToLower(args[0]), opts, args[1:])
+	} else {
+		res = opts.f(s, args[1:]...)
+	}
+	if failed(res) {
+		log.Debug("Command %q from leader failed", args)
+	}
+}
+
+// lag returns time since last data from leader
+func (r *replFollower) lag() time.Duration {
+	last := atomic.LoadInt64(&r.lastIO)
+	if last == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, last))
+}
+
+// replicaof starts or stops replication: REPLICAOF host port or REPLICAOF NO ONE
+func (s *Server) replicaof(args ...string) reply {
+	if strings.EqualFold(args[0], "no") && strings.EqualFold(args[1], "one") {
+		s.replica.unfollow()
+		return okReply{}
+	}
+	port, err := strconv.Atoi(args[1])
+	if err != nil || port <= 0 || port > 65535 {
+		return errReply(fmt.Sprintf("Wrong port %q", args[1]))
+	}
+	addr := net.JoinHostPort(args[0], args[1])
+	s.replica.follow(addr)
+	return okReply{}
+}
+
+// role returns replication role in format of redis ROLE command
+func (s *Server) role(args ...string) reply {
+	if s.following() {
+		s.replica.Lock()
+		host, port, _ := net.SplitHostPort(s.replica.addr)
+		status := s.replica.status
+		s.replica.Unlock()
+		p, _ := strconv.Atoi(port)
+		return arrayReply{
+			bulkReply("slave"), bulkReply(host), intReply(p),
+			bulkReply(status), intReply(atomic.LoadInt64(&s.replica.offset)),
+		}
+	}
+	s.writeMu.RLock()
+	offset := s.leader.offset
+	s.writeMu.RUnlock()
+	followers := arrayReply{}
+	s.leader.Lock()
+	for _, f := range s.leader.followers {
+		host, port, _ := net.SplitHostPort(f.conn.RemoteAddr().String())
+		followers = append(followers, arrayReply{
+			bulkReply(host), bulkReply(port),
+			bulkReply(strconv.FormatInt(atomic.LoadInt64(&f.acked), 10)),
+		})
+	}
+	s.leader.Unlock()
+	return arrayReply{bulkReply("master"), intReply(offset), followers}
+}
+
+// replication returns replication state and lag in one line like stats
+func (s *Server) replication(args ...string) reply {
+	var b strings.Builder
+	if s.following() {
+		s.replica.Lock()
+		fmt.Fprintf(&b, "role:follower leader:%s link:%s", s.replica.addr, s.replica.status)
+		s.replica.Unlock()
+		fmt.Fprintf(&b, " offset:%d lag_ms:%d",
+			atomic.LoadInt64(&s.replica.offset), s.replica.lag()/time.Millisecond)
+		return bulkReply(b.String())
+	}
+	s.writeMu.RLock()
+	id, offset := s.leader.id, s.leader.offset
+	s.writeMu.RUnlock()
+	s.leader.Lock()
+	fmt.Fprintf(&b, "role:leader id:%s offset:%d followers:%d", id, offset, len(s.leader.followers))
+	for i, f := range s.leader.followers {
+		acked := atomic.LoadInt64(&f.acked)
+		ackAge := time.Since(time.Unix(0, atomic.LoadInt64(&f.ackTime)))
+		fmt.Fprintf(&b, " follower%d:%v,offset=%d,lag_bytes=%d,ack_ms=%d",
+			i, f.conn.RemoteAddr(), acked, offset-acked, ackAge/time.Millisecond)
+	}
+	s.leader.Unlock()
+	return bulkReply(b.String())
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	dict "godict"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// psync connects raw follower to leader at addr
+func psync(t *testing.T, addr, id, offset string) *testClient {
+	t.Helper()
+	f := dial(t, addr)
+	f.send(string(encodeCommand(nil, "psync", id, offset)))
+	return f
+}
+
+// syncReply reads reply to psync, empty lines sent while full sync waits
+// for its turn are skipped
+func (c *testClient) syncReply() string {
+	c.t.Helper()
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := readRESPLine(c.r)
+		if err != nil {
+			c.t.Fatalf("Reading reply to psync failed: %v", err)
+		}
+		if line != "" {
+			return line
+		}
+	}
+}
+
+// command reads next command of replication stream, pings are skipped
+func (c *testClient) command() string {
+	c.t.Helper()
+	for {
+		if res := c.reply(); res != "ping" {
+			return res
+		}
+	}
+}
+
+// streamed reads next command of replication stream and checks that it is
+// want
+func (c *testClient) streamed(want ...string) {
+	c.t.Helper()
+	if res := c.command(); res != strings.Join(want, " ") {
+		c.t.Fatalf("Wrong command %q in stream, must be %q", res, want)
+	}
+}
+
+// loadSnapshot reads snapshot of full sync
+func (c *testClient) loadSnapshot() *dict.ShardedDict {
+	c.t.Helper()
+	snap := dict.NewSharded(1)
+	if _, err := snap.Load(c.r); err != nil {
+		c.t.Fatalf("Loading snapshot failed: %v", err)
+	}
+	return snap
+}
+
+// startPair starts leader and follower connected to it
+func startPair(t *testing.T) (leader, follower *testClient) {
+	_, leaderAddr := startServer(t, testConfig())
+	cfg := testConfig()
+	cfg.ReplicaOf = leaderAddr
+	_, followerAddr := startServer(t, cfg)
+	return dial(t, leaderAddr), dial(t, followerAddr)
+}
+
+func TestFollowerRole(t *testing.T) {
+	leader, follower := startPair(t)
+	if res := leader.do("hello"); !strings.Contains(res, "role master") {
+		t.Errorf("Wrong role in reply %q to hello on leader", res)
+	}
+	if res := follower.do("hello"); !strings.Contains(res, "role replica") {
+		t.Errorf("Wrong role in reply %q to hello on follower", res)
+	}
+	if res := follower.do("role"); !strings.HasPrefix(res, "slave ") {
+		t.Errorf("Wrong reply %q to role on follower", res)
+	}
+}
+
+func TestReplicateIdleKey(t *testing.T) {
+	leader, follower := startPair(t)
+	if res := leader.do("set", "session", "data", "px", "300", "sliding"); res != "+OK" {
+		t.Fatalf("Wrong reply %q to set", res)
+	}
+	eventually(t, "key on follower", func() bool {
+		return follower.do("get", "session") == "data"
+	})
+
+	// reads on leader move deadline, follower must not expire key on its own
+	for i := 0; i < 6; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if res := leader.do("get", "session"); res != "data" {
+			t.Fatalf("Idle key expired on leader while it was read: %q", res)
+		}
+	}
+	if res := follower.do("get", "session"); res != "data" {
+		t.Fatalf("Follower expired key read on leader: %q", res)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if res := leader.do("get", "session"); res != "(nil)" {
+		t.Fatalf("Idle key didn't expire on leader: %q", res)
+	}
+	eventually(t, "delete of expired key on follower", func() bool {
+		return follower.do("get", "session") == "(nil)"
+	})
+}
+
+func TestPSync(t *testing.T) {
+	_, addr := startServer(t, testConfig())
+	c := dial(t, addr)
+	c.do("set", "old", "v")
+
+	f := psync(t, addr, "?", "-1")
+	fields := strings.Fields(f.syncReply())
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		t.Fatalf("Wrong reply %q to psync", fields)
+	}
+	id, offset := fields[1], fields[2]
+	if slot, err := f.loadSnapshot().Get("old"); err != nil || slot.Value() != "v" {
+		t.Fatalf("Snapshot doesn't have key written before sync")
+	}
+	c.do("set", "first", "1")
+	f.streamed("set", "first", "1")
+	f.conn.Close()
+
+	// writes while follower is away are sent from backlog
+	c.do("set", "second", "2")
+	f = psync(t, addr, id, offset)
+	if res := f.syncReply(); res != "+CONTINUE "+id {
+		t.Fatalf("Wrong reply %q to psync", res)
+	}
+	f.streamed("set", "first", "1")
+	f.streamed("set", "second", "2")
+
+	// unknown offset gets full sync
+	f = psync(t, addr, id, strconv.Itoa(1<<30))
+	if res := f.syncReply(); !strings.HasPrefix(res, "+FULLRESYNC "+id+" ") {
+		t.Fatalf("Wrong reply %q to psync", res)
+	}
+}
+
+func TestReplicateMemcache(t *testing.T) {
+	s, addr := startServer(t, testConfig())
+	mc := dial(t, listen(t, s.ServeMemcache))
+	f := psync(t, addr, "?", "-1")
+	if res := f.syncReply(); !strings.HasPrefix(res, "+FULLRESYNC ") {
+		t.Fatalf("Wrong reply %q to psync", res)
+	}
+	f.loadSnapshot()
+
+	mc.send("set k 5 100 1\r\nv\r\n")
+	mc.expect("STORED\r\n")
+	res := strings.Fields(f.command())
+	if len(res) != 7 || strings.Join(res[:4], " ") != "set k v pxat" || strings.Join(res[5:], " ") != "flags 5" {
+		t.Fatalf("Wrong command %q in stream", res)
+	}
+	deadline, _ := strconv.ParseInt(res[4], 10, 64)
+	if ttl := time.Until(time.UnixMilli(deadline)); ttl < 99*time.Second || ttl > 100*time.Second {
+		t.Errorf("Wrong deadline %s in stream, ttl is %v", res[4], ttl)
+	}
+	mc.send("append k 2 0 1\r\nw\r\n")
+	mc.expect("STORED\r\n")
+	f.streamed("set", "k", "vw", "keepttl", "flags", "5")
+	mc.send("touch k 0\r\n")
+	mc.expect("TOUCHED\r\n")
+	f.streamed("persist", "k")
+	mc.send("delete k\r\n")
+	mc.expect("DELETED\r\n")
+	f.streamed("del", "k")
+	mc.send("flush_all\r\n")
+	mc.expect("OK\r\n")
+	f.streamed("flushall")
+}
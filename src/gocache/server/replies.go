@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bufio"
+	"clparse"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// reply is result of command, which is encoded differently by every protocol
+type reply interface {
+	writeText(w *bufio.Writer)
+	writeRESP(w *bufio.Writer, proto int)
+}
+
+// okReply is plain success without value
+type okReply struct{}
+
+func (okReply) writeText(w *bufio.Writer) {
+	w.WriteString("OK")
+}
+
+func (okReply) writeRESP(w *bufio.Writer, proto int) {
+	w.WriteString("+OK\r\n")
+}
+
+// statusReply is short status message, never contains newlines
+type statusReply string
+
+func (r statusReply) writeText(w *bufio.Writer) {
+	fmt.Fprintf(w, okFormat, string(r))
+}
+
+func (r statusReply) writeRESP(w *bufio.Writer, proto int) {
+	w.WriteString("+")
+	w.WriteString(string(r))
+	w.WriteString("\r\n")
+}
+
+// bulkReply is value of key
+type bulkReply string
+
+// bulkReply is sent as literal "OK {N}" followed by N bytes of value if value
+// can't be told apart from end of line in text protocol
+func (r bulkReply) writeText(w *bufio.Writer) {
+	if _, _, ok := clparse.ParseLiteral(string(r)); ok || strings.ContainsAny(string(r), "\r\n") {
+		fmt.Fprintf(w, okFormat, clparse.Literal(len(r)))
+		w.WriteString("\n")
+		w.WriteString(string(r))
+		return
+	}
+	fmt.Fprintf(w, okFormat, string(r))
+}
+
+func (r bulkReply) writeRESP(w *bufio.Writer, proto int) {
+	w.WriteString("$")
+	w.WriteString(strconv.Itoa(len(r)))
+	w.WriteString("\r\n")
+	w.WriteString(string(r))
+	w.WriteString("\r\n")
+}
+
+type intReply int64
+
+func (r intReply) writeText(w *bufio.Writer) {
+	fmt.Fprintf(w, okFormat, int64(r))
+}
+
+func (r intReply) writeRESP(w *bufio.Writer, proto int) {
+	w.WriteString(":")
+	w.WriteString(strconv.FormatInt(int64(r), 10))
+	w.WriteString("\r\n")
+}
+
+type errReply string
+
+func errorReply(err error) reply {
+	return errReply(err.Error())
+}
+
+func (r errReply) writeText(w *bufio.Writer) {
+	fmt.Fprintf(w, errFormat, strings.NewReplacer("\r", " ", "\n", " ").Replace(string(r)))
+}
+
+// respErrorCodes are prefixes of errors, which are sent to redis clients as
+// is instead of generic ERR
+var respErrorCodes = []string{"WRONGTYPE ", "EXECABORT ", "READONLY ", "NOPROTO "}
+
+func (r errReply) writeRESP(w *bufio.Writer, proto int) {
+	w.WriteString("-")
+	if !hasErrorCode(string(r)) {
+		w.WriteString("ERR ")
+	}
+	w.WriteString(strings.NewReplacer("\r", " ", "\n", " ").Replace(string(r)))
+	w.WriteString("\r\n")
+}
+
+func hasErrorCode(msg string) bool {
+	for _, code := range respErrorCodes {
+		if strings.HasPrefix(msg, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// nilReply is absence of value
+type nilReply struct{}
+
+func (nilReply) writeText(w *bufio.Writer) {
+	fmt.Fprintf(w, errFormat, "nil")
+}
+
+func (nilReply) writeRESP(w *bufio.Writer, proto int) {
+	if proto >= 3 {
+		w.WriteString("_\r\n")
+		return
+	}
+	w.WriteString("$-1\r\n")
+}
+
+// arrayReply is encoded in text protocol as number of elements followed by
+// every element on its own line
+type arrayReply []reply
+
+func (r arrayReply) writeText(w *bufio.Writer) {
+	fmt.Fprintf(w, okFormat, len(r))
+	for _, e := range r {
+		w.WriteString("\n")
+		e.writeText(w)
+	}
+}
+
+func (r arrayReply) writeRESP(w *bufio.Writer, proto int) {
+	w.WriteString("*")
+	w.WriteString(strconv.Itoa(len(r)))
+	w.WriteString("\r\n")
+	for _, e := range r {
+		e.writeRESP(w, proto)
+	}
+}
+
+// mapReply contains keys and values one after another, it is array in text
+// protocol and RESP2
+type mapReply []reply
+
+func (r mapReply) writeText(w *bufio.Writer) {
+	arrayReply(r).writeText(w)
+}
+
+func (r mapReply) writeRESP(w *bufio.Writer, proto int) {
+	if proto < 3 {
+		arrayReply(r).writeRESP(w, proto)
+		return
+	}
+	w.WriteString("%")
+	w.WriteString(strconv.Itoa(len(r) / 2))
+	w.WriteString("\r\n")
+	for _, e := range r {
+		e.writeRESP(w, proto)
+	}
+}
+
+// pubsubReply is message or subscription change sent to subscriber, it is
+// push type in RESP3
+type pubsubReply []reply
+
+func (r pubsubReply) writeText(w *bufio.Writer) {
+	arrayReply(r).writeText(w)
+}
+
+func (r pubsubReply) writeRESP(w *bufio.Writer, proto int) {
+	if proto < 3 {
+		arrayReply(r).writeRESP(w, proto)
+		return
+	}
+	w.WriteString(">")
+	w.WriteString(strconv.Itoa(len(r)))
+	w.WriteString("\r\n")
+	for _, e := range r {
+		e.writeRESP(w, proto)
+	}
+}
+
+// compatReply keeps replies of text protocol when redis clients expect
+// something different, like nil instead of error for missing key
+type compatReply struct {
+	text reply
+	resp reply
+}
+
+func (r compatReply) writeText(w *bufio.Writer) {
+	r.text.writeText(w)
+}
+
+func (r compatReply) writeRESP(w *bufio.Writer, proto int) {
+	r.resp.writeRESP(w, proto)
+}
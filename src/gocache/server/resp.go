@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	log "logging"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// limits of redis protocol requests
+const (
+	respMaxArgs   = 1024 * 1024
+	respMaxInline = 64 * 1024
+
+	respDefaultProto = 2
+)
+
+type respProtocolError string
+
+func (e respProtocolError) Error() string {
+	return fmt.Sprintf("Protocol error: %s", string(e))
+}
+
+// respConn is state of redis protocol connection
+type respConn struct {
+	r     *bufio.Reader
+	w     *bufio.Writer
+	proto int
+	name  string
+	tx    transaction
+}
+
+func (s *Server) handleRESPConnection(conn net.Conn) {
+	defer conn.Close()
+	defer log.Debug("RESP connection closed: %v", conn.RemoteAddr())
+	log.Debug("Incomming RESP connection: %v", conn.RemoteAddr())
+	c := &respConn{
+		r:     bufio.NewReaderSize(conn, respMaxInline),
+		w:     bufio.NewWriter(conn),
+		proto: respDefaultProto,
+		tx:    transaction{srv: s},
+	}
+	for {
+		args, err := s.readRESPCommand(c.r)
+		if err != nil {
+			if perr, ok := err.(respProtocolError); ok {
+				errorReply(perr).writeRESP(c.w, c.proto)
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		log.Debug("Incomming RESP command: %q", args)
+		if strings.EqualFold(args[0], "psync") {
+			// connection belongs to follower from now on
+			s.serveFollower(conn, c, args[1:])
+			return
+		}
+		res, quit := c.process(args[0], args[1:])
+		if b, ok := res.(blockReply); ok {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+			if res = s.serveBlocked(conn, c.r, b); res == nil {
+				return
+			}
+		}
+		if sub, ok := res.(subscribeReply); ok {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+			read := func() ([]string, reply, error) {
+				args, err := s.readRESPCommand(c.r)
+				return args, nil, err
+			}
+			write := func(res reply) { res.writeRESP(c.w, c.proto) }
+			if !s.serveSubscriber(conn, c.w, sub, read, write) {
+				return
+			}
+			continue
+		}
+		res.writeRESP(c.w, c.proto)
+		// flush only when pipelined requests are processed
+		if c.r.Buffered() == 0 || quit {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// process runs connection commands or passes command to commandsMap,
+// returns true if connection must be closed
+func (c *respConn) process(command string, args []string) (reply, bool) {
+	switch strings.ToLower(command) {
+	case "quit":
+		return okReply{}, true
+	case "hello":
+		return c.hello(args), false
+	case "client":
+		if len(args) == 2 && strings.EqualFold(args[0], "setname") {
+			c.name = args[1]
+		}
+		return okReply{}, false
+	case "select":
+		if len(args) != 1 || args[0] != "0" {
+			return errReply("Only database 0 is supported"), false
+		}
+		return okReply{}, false
+	case "command":
+		return arrayReply{}, false
+	}
+	return c.tx.process(command, args), false
+}
+
+// hello switches protocol version and returns server properties
+func (c *respConn) hello(args []string) reply {
+	proto := c.proto
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil || v < 2 || v > 3 {
+			return errReply("NOPROTO unsupported protocol version")
+		}
+		proto = v
+		args = args[1:]
+	}
+	for len(args) > 0 {
+		switch {
+		case strings.EqualFold(args[0], "setname") && len(args) > 1:
+			c.name = args[1]
+			args = args[2:]
+		case strings.EqualFold(args[0], "auth") && len(args) > 2:
+			args = args[3:]
+		default:
+			return errReply(fmt.Sprintf("Syntax error in HELLO option %s", args[0]))
+		}
+	}
+	c.proto = proto
+	role := "master"
+	if c.tx.srv.following() {
+		role = "replica"
+	}
+	return mapReply{
+		bulkReply("server"), bulkReply("gocache"),
+		bulkReply("version"), bulkReply(Version),
+		bulkReply("proto"), intReply(proto),
+		bulkReply("mode"), bulkReply("standalone"),
+		bulkReply("role"), bulkReply(role),
+		bulkReply("modules"), arrayReply{},
+	}
+}
+
+// readRESPLine reads line terminated by \r\n, terminator is stripped
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", respProtocolError("too big request line")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func readRESPInt(r *bufio.Reader, prefix byte, max int) (int, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return 0, err
+	}
+	if len(line) == 0 || line[0] != prefix {
+		return 0, respProtocolError(fmt.Sprintf("expected '%c', got %q", prefix, line))
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > max {
+		return 0, respProtocolError(fmt.Sprintf("invalid length %q", line[1:]))
+	}
+	return n, nil
+}
+
+// readRESPCommand reads command as array of bulk strings or inline command
+// separated by spaces
+func (s *Server) readRESPCommand(r *bufio.Reader) ([]string, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != '*' {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(line), nil
+	}
+	n, err := readRESPInt(r, '*', respMaxArgs)
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	args := make([]string, 0, min(n, 1024))
+	for i := 0; i < n; i++ {
+		size, err := readRESPInt(r, '$', math.MaxInt)
+		if err != nil {
+			return nil, err
+		}
+		if size > s.cfg.MaxValueSize {
+			return nil, respProtocolError(fmt.Sprintf("bulk string of %d bytes is bigger than max value size %d", size, s.cfg.MaxValueSize))
+		}
+		if size < 0 {
+			return nil, respProtocolError("null bulk string in request")
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, respProtocolError("bulk string is not terminated by CRLF")
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRESP2Replies(t *testing.T) {
+	_, addr := startServer(t, testConfig())
+	c := dial(t, addr)
+	c.send("*3\r\n$3\r\nset\r\n$1\r\nk\r\n$4\r\na\r\nb\r\n")
+	c.expect("+OK\r\n")
+	c.send("*2\r\n$3\r\nget\r\n$1\r\nk\r\n")
+	c.expect("$4\r\na\r\nb\r\n")
+	c.send("*2\r\n$3\r\nget\r\n$7\r\nmissing\r\n")
+	c.expect("$-1\r\n")
+	c.send("*2\r\n$3\r\ndel\r\n$1\r\nk\r\n")
+	c.expect(":1\r\n")
+	c.send("*4\r\n$4\r\nhset\r\n$1\r\nh\r\n$1\r\nf\r\n$1\r\nv\r\n")
+	c.expect(":1\r\n")
+	c.send("*2\r\n$7\r\nhgetall\r\n$1\r\nh\r\n")
+	c.expect("*2\r\n$1\r\nf\r\n$1\r\nv\r\n")
+	c.send("*2\r\n$3\r\nget\r\n$1\r\nh\r\n")
+	c.expect("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+	if res := c.do("unknown"); !strings.HasPrefix(res, "-ERR ") {
+		t.Errorf("Wrong reply %q to unknown command", res)
+	}
+	// inline commands are accepted too
+	c.send("set k v\r\n")
+	c.expect("+OK\r\n")
+	c.send("exists k\r\n")
+	c.expect(":1\r\n")
+}
+
+func TestRESP3Replies(t *testing.T) {
+	_, addr := startServer(t, testConfig())
+	c := dial(t, addr)
+	c.send("*2\r\n$5\r\nhello\r\n$1\r\n4\r\n")
+	c.expect("-NOPROTO unsupported protocol version\r\n")
+	c.send("*2\r\n$5\r\nhello\r\n$1\r\n3\r\n")
+	c.expect("%6\r\n$6\r\nserver\r\n$7\r\ngocache\r\n$7\r\nversion\r\n$" +
+		strconv.Itoa(len(Version)) + "\r\n" + Version + "\r\n$5\r\nproto\r\n:3\r\n")
+	for i := 0; i < 6; i++ {
+		c.reply()
+	}
+	c.send("*2\r\n$3\r\nget\r\n$7\r\nmissing\r\n")
+	c.expect("_\r\n")
+	c.send("*4\r\n$4\r\nhset\r\n$1\r\nh\r\n$1\r\nf\r\n$1\r\nv\r\n")
+	c.expect(":1\r\n")
+	c.send("*2\r\n$7\r\nhgetall\r\n$1\r\nh\r\n")
+	c.expect("%1\r\n$1\r\nf\r\n$1\r\nv\r\n")
+
+	// switch back keeps connection
+	if res := c.do("hello", "2"); !strings.HasPrefix(res, "server gocache") {
+		t.Fatalf("Wrong reply %q to hello", res)
+	}
+	c.send("*2\r\n$3\r\nget\r\n$7\r\nmissing\r\n")
+	c.expect("$-1\r\n")
+}
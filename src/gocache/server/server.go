@@ -0,0 +1,395 @@
+/*
+Package server serves dictionary over gocache text protocol, redis protocol
+and memcached protocol. It can be embedded into other programs:
+
+	s, err := server.New(server.DefaultConfig)
+	if err != nil {
+		...
+	}
+	go s.ListenAndServe()
+	...
+	s.Shutdown(ctx)
+*/
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	dict "godict"
+	"io"
+	log "logging"
+	"net"
+	"sync"
+	"time"
+)
+
+// Version is reported by HELLO and memcached version commands
+const Version = "0.2.0"
+
+// Config contains settings of server
+type Config struct {
+	// Addr is address for text protocol connections, empty disables them
+	Addr string
+	// RESPAddr is address for redis protocol connections, empty disables them
+	RESPAddr string
+	// MemcacheAddr is address for memcached protocol connections, empty
+	// disables them
+	MemcacheAddr string
+
+	// Storage is served dictionary, new one with 16 shards is created if it
+	// is nil. Server sets its notify function.
+	Storage *dict.ShardedDict
+	// MaxValueSize limits size of argument in text and redis protocols
+	MaxValueSize int
+
+	// DBFile is snapshot file, loaded on start and written by SAVE, BGSAVE
+	// and Shutdown. Empty disables snapshots.
+	DBFile string
+	// SaveInterval is interval between background snapshots, 0 disables them
+	SaveInterval time.Duration
+
+	// AOFFile is append only file, every write command is logged to it and
+	// replayed on start. Empty disables it.
+	AOFFile string
+	// AOFFsync is when append only file is synced to disk: always, everysec
+	// or no
+	AOFFsync string
+	// AOFRewriteSize is size from which append only file is rewritten when it
+	// doubles, 0 disables rewrite
+	AOFRewriteSize uint64
+
+	// ReplicaOf is address of leader redis protocol port to replicate from,
+	// empty if server is leader
+	ReplicaOf string
+	// ReplBacklogSize is size of stream kept for partial resync of followers
+	ReplBacklogSize uint64
+
+	// PubSubLimit is bytes queued for slow subscriber before it is
+	// disconnected, 0 is unlimited
+	PubSubLimit uint64
+	// NotifyEvents are events of keys published to subscribers
+	NotifyEvents dict.Event
+}
+
+var DefaultConfig = Config{
+	Addr:            "127.0.0.1:6090",
+	MaxValueSize:    512 << 20,
+	AOFFsync:        "everysec",
+	AOFRewriteSize:  64 << 20,
+	ReplBacklogSize: 1 << 20,
+	PubSubLimit:     32 << 20,
+}
+
+// ErrServerClosed is returned by Serve methods after Shutdown
+var ErrServerClosed = errors.New("Server closed")
+
+// Server is state shared by connections of all protocols
+type Server struct {
+	cfg     Config
+	storage *dict.ShardedDict
+
+	// writeMu is held while write command is executed and propagated to
+	// append only file and followers, so they get commands in the order they
+	// were applied to storage. Without propagation write commands take it
+	// for reading, so they run in parallel.
+	writeMu sync.RWMutex
+	// execMu is held for reading while command of client runs and for
+	// writing while EXEC runs queued commands, so no command of other client
+	// is run in the middle of transaction. It is taken before writeMu.
+	execMu sync.RWMutex
+	// txLog collects commands run by EXEC to propagate them as one block,
+	// it is not nil only while EXEC holds execMu and writeMu
+	txLog []byte
+	// closing is set by Shutdown with writeMu held before final save, then
+	// writes of handlers, which didn't finish in time, fail
+	closing bool
+
+	aof      *appendLog // nil if append only file is disabled
+	leader   *replLeader
+	replica  *replFollower
+	blocked  keyWaiters
+	removed  removedKeys
+	channels subscriptions
+	patterns subscriptions
+
+	// saving is held while snapshot is written to DBFile
+	saving   sync.Mutex
+	lastSave int64 // unix time of last successful save
+	// snapshotTurn holds token while someone has snapshot of storage
+	snapshotTurn chan struct{}
+
+	memcacheStats memcacheStats
+
+	mu        sync.Mutex
+	closed    bool
+	done      chan struct{} // closed by Shutdown to stop background work
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	handlers  sync.WaitGroup
+}
+
+// New creates server and loads storage from append only file or snapshot.
+// Periodic saves and replication are started right away, connections are
+// accepted by Serve methods.
+func New(cfg Config) (*Server, error) {
+	if cfg.MaxValueSize <= 0 {
+		return nil, fmt.Errorf("Wrong max value size %d", cfg.MaxValueSize)
+	}
+	if cfg.Storage == nil {
+		cfg.Storage = dict.NewSharded(16)
+	}
+	s := &Server{
+		cfg:          cfg,
+		storage:      cfg.Storage,
+		leader:       &replLeader{id: newReplID()},
+		replica:      &replFollower{},
+		done:         make(chan struct{}),
+		snapshotTurn: make(chan struct{}, 1),
+		listeners:    make(map[net.Listener]struct{}),
+		conns:        make(map[net.Conn]struct{}),
+	}
+	s.leader.srv = s
+	s.replica.srv = s
+	s.memcacheStats.started = time.Now()
+	s.storage.SetNotify(cfg.NotifyEvents|dict.EventExpired|dict.EventEvicted, s.keyEvent)
+	if cfg.NotifyEvents != dict.NoEvents {
+		log.Info("Keyspace events: %v", cfg.NotifyEvents)
+	}
+	if err := s.loadStorage(); err != nil {
+		return nil, err
+	}
+	go s.flushRemoved()
+	if cfg.DBFile != "" && cfg.SaveInterval > 0 {
+		go s.runPeriodicSave()
+	}
+	if cfg.ReplicaOf != "" {
+		s.replica.follow(cfg.ReplicaOf)
+	}
+	return s, nil
+}
+
+// loadStorage loads keys from append only file if it is enabled, otherwise
+// from snapshot
+func (s *Server) loadStorage() error {
+	if s.cfg.AOFFile != "" {
+		return s.configureAppendLog()
+	}
+	if s.cfg.DBFile != "" {
+		return s.loadSnapshot()
+	}
+	return nil
+}
+
+// ListenAndServe listens on all configured addresses and serves them until
+// one of listeners fails or server is shut down
+func (s *Server) ListenAndServe() error {
+	services := []struct {
+		addr  string
+		serve func(net.Listener) error
+	}{
+		{s.cfg.Addr, s.Serve},
+		{s.cfg.RESPAddr, s.ServeRESP},
+		{s.cfg.MemcacheAddr, s.ServeMemcache},
+	}
+	var listeners []net.Listener
+	var serves []func(net.Listener) error
+	for _, service := range services {
+		if service.addr == "" {
+			continue
+		}
+		l, err := net.Listen("tcp", service.addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+		serves = append(serves, service.serve)
+	}
+	if len(listeners) == 0 {
+		return errors.New("No address to listen on")
+	}
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		go func(serve func(net.Listener) error, l net.Listener) {
+			errs <- serve(l)
+		}(serves[i], l)
+	}
+	return <-errs
+}
+
+// Serve accepts text protocol connections on l
+func (s *Server) Serve(l net.Listener) error {
+	return s.serve("Tcp", l, s.handleConnection)
+}
+
+// ServeRESP accepts redis protocol connections on l
+func (s *Server) ServeRESP(l net.Listener) error {
+	return s.serve("RESP", l, s.handleRESPConnection)
+}
+
+// ServeMemcache accepts memcached protocol connections on l
+func (s *Server) ServeMemcache(l net.Listener) error {
+	return s.serve("Memcache", l, s.handleMemcacheConnection)
+}
+
+// serve accepts connections on l and serves every one with handler in its
+// own goroutine until l fails or server is shut down
+func (s *Server) serve(name string, l net.Listener, handler func(net.Conn)) error {
+	if !s.track(l, nil) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(l, nil)
+	log.Info("%s listener running on %v", name, l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Err("%v", err)
+			continue
+		}
+		if !s.track(nil, conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.untrack(nil, conn)
+			handler(drainConn{conn, s.done})
+		}()
+	}
+}
+
+// drainConn ends stream of requests once server is shutting down, so handler
+// finishes command it already read, flushes replies and closes connection.
+// Handler waiting for next request is woken up by read deadline set by
+// Shutdown.
+type drainConn struct {
+	net.Conn
+	done chan struct{}
+}
+
+func (c drainConn) Read(p []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, io.EOF
+	default:
+	}
+	return c.Conn.Read(p)
+}
+
+// track registers listener or connection, so Shutdown closes it. It returns
+// false if server is already shut down.
+func (s *Server) track(l net.Listener, conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if l != nil {
+		s.listeners[l] = struct{}{}
+	}
+	if conn != nil {
+		s.conns[conn] = struct{}{}
+		s.handlers.Add(1)
+	}
+	return true
+}
+
+func (s *Server) untrack(l net.Listener, conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l != nil {
+		delete(s.listeners, l)
+	}
+	if conn != nil {
+		delete(s.conns, conn)
+		s.handlers.Done()
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Shutdown stops accepting connections and lets open ones finish command
+// in progress, blocked clients get nil reply. Connections left when ctx is
+// done are closed. Then writes are refused, replication and rewrite of
+// append only file are stopped, final snapshot is saved and append only
+// file is closed. Returned
+// error is ctx error if connections were not drained in time or error of
+// persistence. Storage isn't used by server after it.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.closed = true
+	close(s.done)
+	for l := range s.listeners {
+		l.Close()
+	}
+	now := time.Now()
+	for conn := range s.conns {
+		conn.SetReadDeadline(now)
+	}
+	if n := len(s.conns); n > 0 {
+		log.Info("Waiting for %d connections to finish", n)
+	}
+	s.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(finished)
+	}()
+	var err error
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.mu.Lock()
+		log.Warn("Closing %d connections, which didn't finish in time", len(s.conns))
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+	}
+	// closed connections may still run commands, which must not change
+	// storage after final save
+	s.writeMu.Lock()
+	s.closing = true
+	s.writeMu.Unlock()
+	s.replica.unfollow()
+	// snapshots of rewrite and of full syncs are released for final save
+	if s.aof != nil {
+		s.aof.stopRewrite()
+	}
+	s.leader.disconnect()
+	if s.cfg.DBFile != "" {
+		if serr := s.saveOnExit(); err == nil {
+			err = serr
+		}
+	}
+	if s.aof != nil {
+		// removed keys may still be flushed by background work
+		s.writeMu.Lock()
+		s.propagate(nil)
+		aerr := s.aof.close()
+		s.writeMu.Unlock()
+		if err == nil {
+			err = aerr
+		}
+	}
+	return err
+}
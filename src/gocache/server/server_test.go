@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	dict "godict"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer serves redis protocol on loopback, server is shut down when
+// test ends
+func startServer(t *testing.T, cfg Config) (*Server, string) {
+	t.Helper()
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	t.Cleanup(func() {
+		s.Shutdown(context.Background())
+	})
+	return s, listen(t, s.ServeRESP)
+}
+
+// listen runs serve with listener on loopback and returns its address
+func listen(t *testing.T, serve func(net.Listener) error) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go serve(l)
+	return l.Addr().String()
+}
+
+// testConfig returns config without listen addresses and persistence
+func testConfig() Config {
+	cfg := DefaultConfig
+	cfg.Addr = ""
+	return cfg
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return &testClient{t, conn, bufio.NewReader(conn)}
+}
+
+// send writes raw request
+func (c *testClient) send(request string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(request)); err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+}
+
+// expect reads raw reply and checks that it is want
+func (c *testClient) expect(want string) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len(want))
+	n, err := io.ReadFull(c.r, buf)
+	if string(buf[:n]) != want {
+		c.t.Fatalf("Wrong reply %q, must be %q, error %v", buf[:n], want, err)
+	}
+}
+
+// do sends redis command and returns its reply
+func (c *testClient) do(args ...string) string {
+	c.t.Helper()
+	c.send(string(encodeCommand(nil, args[0], args[1:]...)))
+	return c.reply()
+}
+
+// reply reads redis reply, bulk strings are returned as is, nil as (nil),
+// elements of aggregates are joined by spaces and other replies are
+// returned as line
+func (c *testClient) reply() string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := readRESPLine(c.r)
+	if err != nil {
+		c.t.Fatalf("Reading reply failed: %v", err)
+	}
+	if line == "" {
+		c.t.Fatal("Empty reply line")
+	}
+	switch line[0] {
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatalf("Reading bulk failed: %v", err)
+		}
+		return string(buf[:n])
+	case '*', '%', '~', '>':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		if line[0] == '%' {
+			n *= 2
+		}
+		elements := make([]string, n)
+		for i := range elements {
+			elements[i] = c.reply()
+		}
+		return strings.Join(elements, " ")
+	case '_':
+		return "(nil)"
+	}
+	return line
+}
+
+// eventually calls f until it returns true or second passes
+func eventually(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !f(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// serveText runs text protocol on loopback, returned channel gets result of
+// Serve
+func serveText(t *testing.T, s *Server) (string, chan error) {
+	t.Helper()
+	served := make(chan error, 1)
+	addr := listen(t, func(l net.Listener) error {
+		err := s.Serve(l)
+		served <- err
+		return err
+	})
+	return addr, served
+}
+
+// reloaded returns number of keys loaded by new server with cfg
+func reloaded(t *testing.T, cfg Config) uint32 {
+	t.Helper()
+	cfg.Storage = nil
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer s.Shutdown(context.Background())
+	return s.storage.Active()
+}
+
+func TestShutdownDrains(t *testing.T) {
+	cfg := testConfig()
+	cfg.DBFile = filepath.Join(t.TempDir(), "dump.db")
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	addr, served := serveText(t, s)
+	idle := dial(t, addr)
+	blocked := dial(t, addr)
+	blocked.send("set k v\nblpop list 0\n")
+	blocked.expect("OK\n")
+	eventually(t, "blocked client", func() bool {
+		s.blocked.Lock()
+		defer s.blocked.Unlock()
+		return len(s.blocked.waiters["list"]) == 1
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	blocked.expect("ERR nil\n")
+	for _, c := range []*testClient{idle, blocked} {
+		if _, err := c.r.ReadByte(); err != io.EOF {
+			t.Errorf("Connection isn't closed after shutdown: %v", err)
+		}
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, must be ErrServerClosed", err)
+	}
+	if err := s.Shutdown(ctx); err != ErrServerClosed {
+		t.Errorf("Second shutdown returned %v, must be ErrServerClosed", err)
+	}
+	if _, served := serveText(t, s); <-served != ErrServerClosed {
+		t.Error("Serve after shutdown didn't return ErrServerClosed")
+	}
+	if n := reloaded(t, cfg); n != 1 {
+		t.Errorf("Snapshot saved on shutdown has %d keys, must be 1", n)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s, err := New(testConfig())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	addr, served := serveText(t, s)
+	c := dial(t, addr)
+	c.send("set big {4194304}\n" + strings.Repeat("x", 4<<20) + "\n")
+	c.expect("OK\n")
+	// replies are not read, so writing them is stuck
+	c.send(strings.Repeat("get big\n", 32))
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown returned %v, must be deadline error", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, must be ErrServerClosed", err)
+	}
+}
+
+func TestShutdownRefusesWrites(t *testing.T) {
+	cfg := testConfig()
+	cfg.DBFile = filepath.Join(t.TempDir(), "dump.db")
+	cfg.AOFFile = filepath.Join(t.TempDir(), "gocache.aof")
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	// handler left after deadline can't change storage after final save
+	res := s.runWrite("set", commandsMap["set"], []string{"k", "v"})
+	if res != errorReply(ErrServerClosed) {
+		t.Errorf("Wrong reply %v to write after shutdown", res)
+	}
+	if _, err := s.memcacheSet("m", "v", dict.SetOptions{}, true); err != ErrServerClosed {
+		t.Errorf("Memcached write after shutdown returned %v", err)
+	}
+	for _, key := range []string{"k", "m"} {
+		if _, err := s.storage.Get(key); err == nil {
+			t.Errorf("Key %q is written after shutdown", key)
+		}
+	}
+}
+
+func TestShutdownSaveError(t *testing.T) {
+	cfg := testConfig()
+	cfg.DBFile = filepath.Join(t.TempDir(), "missing", "dump.db")
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := s.Shutdown(context.Background()); err == nil {
+		t.Fatal("Shutdown didn't report failed save")
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	dict "godict"
+	log "logging"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errSaveInProgress = errors.New("Background save already in progress")
+	errNoDBFile       = errors.New("Snapshot file is not configured, use -dbfile")
+)
+
+// Storage has one snapshot at a time, so saves, rewrites of append only file
+// and full syncs of followers take turns. Turn is taken before writeMu.
+
+// waitSnapshotTurn waits until no one else has snapshot of storage, it
+// returns false if cancel is closed first. Nil cancel waits forever.
+func (s *Server) waitSnapshotTurn(cancel <-chan struct{}) bool {
+	select {
+	case s.snapshotTurn <- struct{}{}:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// trySnapshotTurn takes turn if no one else has snapshot of storage
+func (s *Server) trySnapshotTurn() bool {
+	select {
+	case s.snapshotTurn <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseSnapshotTurn is called after snapshot is closed
+func (s *Server) releaseSnapshotTurn() {
+	<-s.snapshotTurn
+}
+
+// writeSnapshot writes snapshot of storage to DBFile and closes it. Data is
+// written to temporary file first, so DBFile is always complete.
+func (s *Server) writeSnapshot(snap *dict.ShardedSnapshot) error {
+	defer snap.Close()
+	start := time.Now()
+	f, err := os.CreateTemp(filepath.Dir(s.cfg.DBFile), "temp-gocache-*.db")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	n, err := snap.WriteTo(f)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), s.cfg.DBFile); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&s.lastSave, time.Now().Unix())
+	log.Info("Snapshot of %d bytes saved to %s in %v", n, s.cfg.DBFile, time.Since(start))
+	return nil
+}
+
+// saveToFile waits for turn, takes point-in-time snapshot of storage and
+// writes it to DBFile, saving must be held by caller
+func (s *Server) saveToFile(cancel <-chan struct{}) error {
+	if !s.waitSnapshotTurn(cancel) {
+		return ErrServerClosed
+	}
+	defer s.releaseSnapshotTurn()
+	snap, err := s.storage.Snapshot()
+	if err != nil {
+		return err
+	}
+	return s.writeSnapshot(snap)
+}
+
+// saveSnapshot writes snapshot unless other save is running, it waits for
+// rewrite of append only file or full sync of follower
+func (s *Server) saveSnapshot() error {
+	if s.cfg.DBFile == "" {
+		return errNoDBFile
+	}
+	if !s.saving.TryLock() {
+		return errSaveInProgress
+	}
+	defer s.saving.Unlock()
+	return s.saveToFile(s.done)
+}
+
+// startBackgroundSave writes snapshot in background, snapshot is taken as
+// soon as other snapshot of storage is finished
+func (s *Server) startBackgroundSave() error {
+	if s.cfg.DBFile == "" {
+		return errNoDBFile
+	}
+	if !s.saving.TryLock() {
+		return errSaveInProgress
+	}
+	go func() {
+		defer s.saving.Unlock()
+		if err := s.saveToFile(s.done); err != nil && err != ErrServerClosed {
+			log.Err("Background save failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// saveOnExit waits for background save in progress and writes final
+// snapshot, saving is never released
+func (s *Server) saveOnExit() error {
+	s.saving.Lock()
+	err := s.saveToFile(nil)
+	if err != nil {
+		log.Err("Saving snapshot on exit failed: %v", err)
+	}
+	return err
+}
+
+// loadSnapshot fills storage from DBFile, missing file is not an error
+func (s *Server) loadSnapshot() error {
+	f, err := os.Open(s.cfg.DBFile)
+	if os.IsNotExist(err) {
+		log.Info("Snapshot file %s does not exist, starting empty", s.cfg.DBFile)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	start := time.Now()
+	n, err := s.storage.Load(f)
+	if err != nil {
+		return fmt.Errorf("Loading snapshot %s failed: %v", s.cfg.DBFile, err)
+	}
+	atomic.StoreInt64(&s.lastSave, time.Now().Unix())
+	log.Info("Loaded %d keys from %s in %v", n, s.cfg.DBFile, time.Since(start))
+	return nil
+}
+
+// runPeriodicSave saves snapshot every SaveInterval until server is shut
+// down
+func (s *Server) runPeriodicSave() {
+	ticker := time.NewTicker(s.cfg.SaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if err := s.startBackgroundSave(); err != nil && err != errSaveInProgress {
+			log.Err("Periodic save failed: %v", err)
+		}
+	}
+}
+
+func (s *Server) save(args ...string) reply {
+	if err := s.saveSnapshot(); err != nil {
+		return errorReply(err)
+	}
+	return okReply{}
+}
+
+func (s *Server) bgsave(args ...string) reply {
+	if err := s.startBackgroundSave(); err != nil {
+		return errorReply(err)
+	}
+	return statusReply("Background saving started")
+}
+
+func (s *Server) lastsave(args ...string) reply {
+	return intReply(atomic.LoadInt64(&s.lastSave))
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	dict "godict"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotTurns(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig()
+	cfg.DBFile = filepath.Join(dir, "dump.db")
+	cfg.AOFFile = filepath.Join(dir, "gocache.aof")
+	s, addr := startServer(t, cfg)
+	c := dial(t, addr)
+	c.do("set", "k", "v")
+	c.do("set", "k", "v")
+
+	// other snapshot is in progress
+	s.snapshotTurn <- struct{}{}
+	if res := c.do("bgsave"); res != "+Background saving started" {
+		t.Errorf("Wrong reply %q to bgsave", res)
+	}
+	if res := c.do("bgrewriteaof"); res != "+Background append only file rewriting scheduled" {
+		t.Errorf("Wrong reply %q to bgrewriteaof", res)
+	}
+	fcfg := testConfig()
+	fcfg.ReplicaOf = addr
+	_, followerAddr := startServer(t, fcfg)
+	follower := dial(t, followerAddr)
+	if res := c.do("lastsave"); res != ":0" {
+		t.Errorf("Snapshot saved while other one is in progress: %q", res)
+	}
+	<-s.snapshotTurn
+
+	eventually(t, "background save", func() bool {
+		return c.do("lastsave") != ":0"
+	})
+	eventually(t, "rewrite of append only file", func() bool {
+		data, err := os.ReadFile(cfg.AOFFile)
+		return err == nil && strings.Count(string(data), "\r\nset\r\n") == 1
+	})
+	eventually(t, "full sync of follower", func() bool {
+		return follower.do("get", "k") == "v"
+	})
+}
+
+func TestConcurrentSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig()
+	cfg.DBFile = filepath.Join(dir, "dump.db")
+	cfg.AOFFile = filepath.Join(dir, "gocache.aof")
+	_, addr := startServer(t, cfg)
+	c := dial(t, addr)
+	args := []string{"mset"}
+	for i := 0; i < 1000; i++ {
+		args = append(args, "key"+strconv.Itoa(i), "value")
+	}
+	c.do(args...)
+
+	// all of them want snapshot at once
+	saver, rewriter := dial(t, addr), dial(t, addr)
+	saver.send(string(encodeCommand(nil, "save")))
+	rewriter.send(string(encodeCommand(nil, "bgrewriteaof")))
+	fcfg := testConfig()
+	fcfg.ReplicaOf = addr
+	_, followerAddr := startServer(t, fcfg)
+	follower := dial(t, followerAddr)
+
+	if res := saver.reply(); res != "+OK" {
+		t.Errorf("Wrong reply %q to save", res)
+	}
+	if res := rewriter.reply(); !strings.HasPrefix(res, "+Background append only file rewriting") {
+		t.Errorf("Wrong reply %q to bgrewriteaof", res)
+	}
+	eventually(t, "full sync of follower", func() bool {
+		return follower.do("dbsize") == ":1000"
+	})
+	eventually(t, "rewrite of append only file", func() bool {
+		data, err := os.ReadFile(cfg.AOFFile)
+		return err == nil && !strings.Contains(string(data), "mset")
+	})
+	aofCfg := cfg
+	aofCfg.DBFile = ""
+	if n := reloaded(t, aofCfg); n != 1000 {
+		t.Errorf("Append only file has %d keys, must be 1000", n)
+	}
+	dbCfg := cfg
+	dbCfg.AOFFile = ""
+	if n := reloaded(t, dbCfg); n != 1000 {
+		t.Errorf("Snapshot has %d keys, must be 1000", n)
+	}
+}
+
+// filledStorage returns storage with n keys
+func filledStorage(n int) *dict.ShardedDict {
+	storage := dict.NewSharded(16)
+	for i := 0; i < n; i++ {
+		storage.Set("key"+strconv.Itoa(i), "value")
+	}
+	return storage
+}
+
+func TestShutdownDuringRewrite(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig()
+	cfg.DBFile = filepath.Join(dir, "dump.db")
+	cfg.AOFFile = filepath.Join(dir, "gocache.aof")
+	cfg.Storage = filledStorage(20000)
+
+	// keys from storage get to new file only by rewrite, so it is finished
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown during first rewrite failed: %v", err)
+	}
+	aofCfg := cfg
+	aofCfg.DBFile = ""
+	if n := reloaded(t, aofCfg); n != 20000 {
+		t.Fatalf("Append only file has %d keys, must be 20000", n)
+	}
+
+	// rewrite of complete file is canceled, so it doesn't hold snapshot
+	cfg.Storage = filledStorage(20000)
+	os.Remove(cfg.DBFile)
+	s, err = New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if res := s.bgrewriteaof(); failed(res) {
+		t.Fatalf("Rewrite failed: %v", res)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown during rewrite failed: %v", err)
+	}
+	if n := reloaded(t, aofCfg); n != 20000 {
+		t.Errorf("Append only file has %d keys, must be 20000", n)
+	}
+	dbCfg := cfg
+	dbCfg.AOFFile = ""
+	if n := reloaded(t, dbCfg); n != 20000 {
+		t.Errorf("Snapshot has %d keys, must be 20000", n)
+	}
+}
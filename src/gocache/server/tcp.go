@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bufio"
+	"clparse"
+	"fmt"
+	"io"
+	log "logging"
+	"net"
+	"strings"
+)
+
+// max length of text protocol line, bigger values are sent as literals
+const textMaxLine = 64 * 1024
+
+func lookUpCommand(command string) (commandOpt, reply) {
+	opts, ok := commandsMap[strings.ToLower(command)]
+	if !ok {
+		return opts, errReply(fmt.Sprintf("Wrong command %s", command))
+	}
+	return opts, nil
+}
+
+// processCommand runs command with already parsed arguments
+func (s *Server) processCommand(command string, args []string) reply {
+	if res, ok := subscribeCommand(command, args); ok {
+		return res
+	}
+	opts, errRep := lookUpCommand(command)
+	if errRep != nil {
+		return errRep
+	}
+	if err := clparse.CheckArgs(len(args), opts.argNumber); err != nil {
+		return errorReply(err)
+	}
+	return s.execute(command, opts, args)
+}
+
+// execute runs command, write commands are propagated to append only file
+// and followers
+func (s *Server) execute(command string, opts commandOpt, args []string) reply {
+	if !opts.write {
+		return opts.f(s, args...)
+	}
+	if s.following() {
+		return errorReply(errReadOnly)
+	}
+	return s.runWrite(strings.ToLower(command), opts, args)
+}
+
+// textError is error of text protocol request, connection stays usable
+type textError string
+
+func (e textError) Error() string {
+	return string(e)
+}
+
+var errLineTooLong = textError(fmt.Sprintf("Line is longer than %d bytes, use literal {N} for big values", textMaxLine))
+
+// readTextLine reads line without terminator, too long line is skipped
+func readTextLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		for err == bufio.ErrBufferFull {
+			_, err = r.ReadSlice('\n')
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", errLineTooLong
+	}
+	// last line may be not terminated
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return "", err
+	}
+	s := strings.TrimSuffix(string(line), "\n")
+	return strings.TrimSuffix(s, "\r"), nil
+}
+
+// readTextCommand reads command line. If line ends with literal {N}, then N
+// bytes of data follow it as next argument and command goes on after them
+// up to the end of line, so all arguments are returned. Otherwise line is
+// returned as is.
+func (s *Server) readTextCommand(r *bufio.Reader) (string, []string, error) {
+	line, err := readTextLine(r)
+	if err != nil {
+		return "", nil, err
+	}
+	prefix, size, ok := clparse.ParseLiteral(line)
+	if !ok {
+		return line, nil, nil
+	}
+	var args []string
+	// data must be read even after error, so it is not taken for commands
+	var cmdErr error
+	for ok {
+		parts, err := clparse.SplitArgs(prefix)
+		if err != nil && cmdErr == nil {
+			cmdErr = textError(err.Error())
+		}
+		args = append(args, parts...)
+		if size > int64(s.cfg.MaxValueSize) {
+			if cmdErr == nil {
+				cmdErr = textError(fmt.Sprintf("Value of %d bytes is bigger than max value size %d", size, s.cfg.MaxValueSize))
+			}
+			if _, err := io.CopyN(io.Discard, r, size); err != nil {
+				return "", nil, err
+			}
+		} else {
+			buf := make([]byte, size)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return "", nil, err
+			}
+			args = append(args, string(buf))
+		}
+		if line, err = readTextLine(r); err != nil {
+			if _, ok := err.(textError); !ok {
+				return "", nil, err
+			}
+			cmdErr = err
+			break
+		}
+		prefix, size, ok = clparse.ParseLiteral(line)
+	}
+	if cmdErr != nil {
+		return "", nil, cmdErr
+	}
+	parts, err := clparse.SplitArgs(prefix)
+	if err != nil {
+		return "", nil, textError(err.Error())
+	}
+	return "", append(args, parts...), nil
+}
+
+// readTextArgs reads command and splits it to arguments, malformed command
+// is returned as error reply
+func (s *Server) readTextArgs(r *bufio.Reader) ([]string, reply, error) {
+	line, args, err := s.readTextCommand(r)
+	if _, ok := err.(textError); ok {
+		return nil, errorReply(err), nil
+	}
+	if err != nil || args != nil {
+		return args, nil, err
+	}
+	if args, err = clparse.SplitArgs(line); err != nil {
+		return nil, errorReply(err), nil
+	}
+	return args, nil, nil
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	defer log.Debug("Connection closed: %v", conn.RemoteAddr())
+	log.Debug("Incomming connection: %v", conn.RemoteAddr())
+	r := bufio.NewReaderSize(conn, textMaxLine)
+	w := bufio.NewWriter(conn)
+	tx := transaction{srv: s}
+	for {
+		args, res, err := s.readTextArgs(r)
+		if err != nil {
+			return
+		}
+		switch {
+		case res != nil:
+		case len(args) == 0:
+			res = errReply("Empty command")
+		default:
+			log.Debug("Incomming command: %q", args)
+			res = tx.process(args[0], args[1:])
+		}
+		if b, ok := res.(blockReply); ok {
+			if err := w.Flush(); err != nil {
+				return
+			}
+			if res = s.serveBlocked(conn, r, b); res == nil {
+				return
+			}
+		}
+		if sub, ok := res.(subscribeReply); ok {
+			if err := w.Flush(); err != nil {
+				return
+			}
+			read := func() ([]string, reply, error) { return s.readTextArgs(r) }
+			write := func(res reply) {
+				res.writeText(w)
+				w.WriteString("\n")
+			}
+			if !s.serveSubscriber(conn, w, sub, read, write) {
+				return
+			}
+			continue
+		}
+		res.writeText(w)
+		w.WriteString("\n")
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
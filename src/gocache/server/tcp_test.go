@@ -0,0 +1,34 @@
+package server
+
+import "testing"
+
+func TestTextLiterals(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxValueSize = 16
+	s, _ := startServer(t, cfg)
+	c := dial(t, listen(t, s.Serve))
+
+	// value with newlines is framed both ways
+	c.send("set k {5}\nab\ncd\n")
+	c.expect("OK\n")
+	c.send("get k\n")
+	c.expect("OK {5}\nab\ncd\n")
+
+	// value, which looks like literal, is framed too
+	c.send("set k {3}\n{3}\n")
+	c.expect("OK\n")
+	c.send("get k\n")
+	c.expect("OK {3}\n{3}\n")
+
+	// command goes on after data
+	c.send("set {1}\nk xy\n")
+	c.expect("OK\n")
+	c.send("get k\n")
+	c.expect("OK xy\n")
+
+	// big value is skipped, so its data is not taken for command
+	c.send("set k {20}\nget k\nget k\nget k\nab\n")
+	c.expect("ERR Value of 20 bytes is bigger than max value size 16\n")
+	c.send("get k\n")
+	c.expect("OK xy\n")
+}
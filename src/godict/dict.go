@@ -2,11 +2,13 @@
 package godict
 
 import (
+	"errors"
 	"fmt"
 	log "logging"
 	mmh "murmur3"
 	"runtime"
 	"sync"
+	"time"
 )
 
 const (
@@ -17,8 +19,37 @@ const (
 	hashSeed     uint32 = 6012
 	perturbShift uint32 = 5
 	rehashChunk  uint32 = 1000
+	// slots rehashed by every write while rehashing is in progress
+	rehashHelp uint32 = 16
 )
 
+// NoTTL is returned by TTL for keys without expire
+const NoTTL time.Duration = -1
+
+var (
+	ErrKeyExists       = errors.New("Key already exists")
+	ErrVersionMismatch = errors.New("Key was changed since version was read")
+)
+
+// SetOptions changes behaviour of SetWithOptions
+type SetOptions struct {
+	OnlyNew      bool          // fail with ErrKeyExists if key exists
+	OnlyExisting bool          // fail with KeyError if key is missing
+	Version      uint64        // if not 0, key must exist and be of this version
+	TTL          time.Duration // if not 0, set expire
+	Deadline     time.Time     // if not zero, set expire at this moment instead of TTL
+	Idle         time.Duration // if not 0, key expires after being idle for this time
+	KeepTTL      bool          // keep expire of existing key instead of removing it
+	Flags        uint32        // stored with value as is
+}
+
+// KeyError is returned when key is missing in the dictionary
+type KeyError string
+
+func (e KeyError) Error() string {
+	return fmt.Sprintf("Key %v missing in the dictionary", string(e))
+}
+
 func GenHash(key string) uint32 {
 	return mmh.MurMur3_32([]byte(key), hashSeed)
 }
@@ -27,6 +58,7 @@ func New() *Dict {
 	d := new(Dict)
 	d.dict = make([]entry, 8, 8)
 	d.mask = 7
+	d.volatile = make(map[string]uint32)
 	return d
 }
 
@@ -35,57 +67,314 @@ type hashTable []entry
 type Dict struct {
 	sync.RWMutex
 	active    uint32
+	fill      uint32 // active + deleted slots of dict
+	sparefill uint32 // active + deleted slots of sparedict
 	dict      hashTable
 	sparedict hashTable
 	mask      uint32 // mask = size - 1
 	sparemask uint32
 	rehashing bool
+	rehashidx uint32 // first not rehashed slot of dict
+	tables    uint32 // changed every time dict is replaced, see Scan
+
+	maxMemory  uint64
+	maxEntries uint32
+	policy     EvictionPolicy
+	used       uint64
+	evicted    uint64
+
+	versions uint64 // last version given to entry
+
+	snap   *Snapshot // snapshot in progress
+	epochs uint32    // last epoch given to snapshot
+
+	volatile      map[string]uint32 // hashes of keys with expire set
+	expiredLazy   uint64
+	expiredActive uint64
+	stopExpire    chan struct{}
+	keepExpired   bool // expired keys are removed only by Delete
+
+	notifyEvents Event
+	notifyFunc   NotifyFunc
 }
 
+// Active returns number of keys
 func (d *Dict) Active() uint32 {
+	d.RLock()
+	defer d.RUnlock()
 	return d.active
 }
 
 //Set sets string value to key, spawn rehashing if needed
 func (d *Dict) Set(key, value string) error {
+	_, err := d.SetWithOptions(key, value, SetOptions{})
+	return err
+}
+
+// SetWithOptions atomically checks conditions from opts and sets value
+//
+// returns copy of stored entry
+func (d *Dict) SetWithOptions(key, value string, opts SetOptions) (*entry, error) {
 
 	hash := GenHash(key)
 
+	d.Lock()
+	defer d.Unlock()
 	log.Debug("Rehashing status %v", d.rehashing)
+	slot, err := d.set(key, value, hash, opts)
+	if err != nil {
+		return nil, err
+	}
+	res := *slot
+	d.resizeIfNeeded()
+
+	return &res, nil
+}
+
+// SetAndGet works like SetWithOptions, but returns copy of entry which was
+// replaced or nil if key was missing. Entry is returned even if conditions of
+// opts are not met and value is not set. Key holding other kind of value is
+// not replaced.
+func (d *Dict) SetAndGet(key, value string, opts SetOptions) (*entry, error) {
+	hash := GenHash(key)
 
 	d.Lock()
-	slot, err := d.lookUpEntry(key, hash)
+	defer d.Unlock()
+	var old *entry
+	if slot := d.lookUp(key, hash); slot != nil {
+		if slot.obj != nil {
+			return nil, ErrWrongType
+		}
+		res := *slot
+		old = &res
+	}
+	if _, err := d.set(key, value, hash, opts); err != nil {
+		return old, err
+	}
+	d.resizeIfNeeded()
+	return old, nil
+}
 
+// set stores value of key and reports it, must be called with lock held
+func (d *Dict) set(key, value string, hash uint32, opts SetOptions) (*entry, error) {
+	slot, err := d.store(key, value, hash, opts)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	d.notify(EventSet, key)
+	return slot, nil
+}
+
+// store works like set, but doesn't report write
+func (d *Dict) store(key, value string, hash uint32, opts SetOptions) (*entry, error) {
+	size := entrySize(key, value)
+	slot := d.lookUp(key, hash)
+	isNew := slot == nil
+
+	switch {
+	case opts.OnlyNew && !isNew:
+		return nil, ErrKeyExists
+	case (opts.OnlyExisting || opts.Version != 0) && isNew:
+		return nil, KeyError(key)
+	case opts.Version != 0 && slot.version != opts.Version:
+		return nil, ErrVersionMismatch
+	}
+
+	var grow uint64
+	if isNew {
+		grow = size
+	} else if old := slot.size(); size > old {
+		grow = size - old
+	}
+	if err := d.checkBudget(grow, isNew); err != nil {
+		return nil, err
+	}
+
+	expire, idle := deadline(opts.Deadline), opts.Idle.Milliseconds()
+	if expire == 0 && idle > 0 {
+		expire = deadline(time.Now().Add(opts.Idle))
+	}
+	if expire == 0 && opts.TTL > 0 {
+		expire = deadline(time.Now().Add(opts.TTL))
+	}
+	if isNew {
+		slot = d.slotFor(key, hash)
+		d.hide(slot)
+		d.active++
+	} else {
+		if opts.KeepTTL {
+			expire, idle = slot.expire, slot.idle
+		}
+		d.preserve(slot)
+		if slot.expire != 0 {
+			delete(d.volatile, key)
+		}
+		d.used -= slot.size()
 	}
 
 	slot.init(key, value, hash)
+	slot.flags = opts.Flags
 	slot.access()
-	d.active++
-	d.Unlock()
+	slot.idle = idle
+	d.versions++
+	slot.version = d.versions
+	d.used += size
+	if expire != 0 {
+		slot.expire = expire
+		d.volatile[key] = hash
+	}
+
+	d.evictIfNeeded(slot)
+
+	return slot, nil
+}
 
-	go d.resizeIfNeeded()
+// Update atomically replaces value of existing key with result of f, flags
+// and expire are kept
+//
+// returns copy of updated entry
+func (d *Dict) Update(key string, f func(value string) (string, error)) (*entry, error) {
+	hash := GenHash(key)
 
+	d.Lock()
+	defer d.Unlock()
+	slot, err := d.lookUpKind(key, hash, KindString)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := f(slot.value)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.update(key, slot, value); err != nil {
+		return nil, err
+	}
+	res := *slot
+	return &res, nil
+}
+
+// CompareAndSwap sets value of key only if it was not changed since version
+// was read from it, flags and expire are reset like by Set. Versions are
+// kept by rehash, so they can be compared at any time.
+//
+// returns new version of key
+func (d *Dict) CompareAndSwap(key, value string, version uint64) (uint64, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, err := d.lookUpKind(key, hash, KindString)
+	if err != nil {
+		return 0, err
+	}
+	if slot.version != version {
+		return 0, ErrVersionMismatch
+	}
+	slot, err = d.set(key, value, hash, SetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return slot.version, nil
+}
+
+// update replaces value of filled slot, must be called with lock held
+func (d *Dict) update(key string, slot *entry, value string) error {
+	size, old := entrySize(key, value), slot.size()
+	if size > old {
+		if err := d.checkBudget(size-old, false); err != nil {
+			return err
+		}
+	}
+
+	d.preserve(slot)
+	// data is shared with copies returned by Get, so it is never changed
+	newdata := *slot.data
+	newdata.value = value
+	slot.data = &newdata
+	slot.access()
+	d.versions++
+	slot.version = d.versions
+	d.used = d.used - old + size
+	d.notify(EventSet, key)
+
+	d.evictIfNeeded(slot)
 	return nil
 }
 
+// Flush removes all keys
+func (d *Dict) Flush() {
+	d.Lock()
+	defer d.Unlock()
+	if d.snap != nil {
+		d.snap.materialize()
+	}
+	d.dict = make([]entry, 8, 8)
+	d.mask = 7
+	d.tables++
+	d.fill = 0
+	d.active = 0
+	d.used = 0
+	d.volatile = make(map[string]uint32)
+	// rehashing goroutine stops on next step
+	d.rehashing = false
+	d.rehashidx = 0
+	d.sparedict = nil
+	d.sparemask = 0
+	d.sparefill = 0
+}
+
+// replace takes all keys of src instead of own ones, src must not be used
+// after it. Limits, notifications and expiration of d are kept. Must be
+// called with lock held.
+func (d *Dict) replace(src *Dict) {
+	src.Lock()
+	defer src.Unlock()
+	for !src.rehashStep(src.mask + 1) {
+	}
+	if d.snap != nil {
+		d.snap.materialize()
+	}
+	// versions only grow, so old versions never match new entries
+	for i := range src.dict {
+		if src.dict[i].data != nil {
+			src.dict[i].version += d.versions
+		}
+	}
+	d.versions += src.versions
+	d.dict = src.dict
+	d.mask = src.mask
+	d.tables++
+	d.fill = src.fill
+	d.active = src.active
+	d.used = src.used
+	d.volatile = src.volatile
+	// rehashing goroutine stops on next step
+	d.rehashing = false
+	d.rehashidx = 0
+	d.sparedict = nil
+	d.sparemask = 0
+	d.sparefill = 0
+}
+
 //Get retrieve slot from dict, spawn error if no key in dict
 func (d *Dict) Get(key string) (*entry, error) {
 	hash := GenHash(key)
 
-	d.RLock()
-	defer d.RUnlock()
+	d.Lock()
+	defer d.Unlock()
 
-	slot, err := d.lookUpFilledEntry(key, hash)
+	slot, err := d.lookUpKind(key, hash, KindString)
 
 	if err != nil {
 		return slot, err
 	}
 
-	slot.access()
+	d.read(slot)
 
-	return slot, nil
+	// copy, so caller is not affected by further changes of slot
+	res := *slot
+	return &res, nil
 }
 
 //Delete mark slot as deleted and wipe it`s data, spawn error if no key in dict
@@ -100,13 +389,24 @@ func (d *Dict) Delete(key string) error {
 		return err
 	}
 
-	slot.delete()
-	d.active--
+	d.remove(slot)
+	d.notify(EventDel, key)
 
 	return nil
 }
 
+// Expire sets expire of key in sec seconds from now, 0 removes expire
 func (d *Dict) Expire(key string, sec uint32) error {
+	if sec == 0 {
+		_, err := d.Persist(key)
+		return err
+	}
+	return d.ExpireAt(key, time.Now().Add(time.Duration(sec)*time.Second))
+}
+
+// ExpireAt sets moment when key expires with millisecond precision, key is
+// removed right away if moment has passed
+func (d *Dict) ExpireAt(key string, t time.Time) error {
 	hash := GenHash(key)
 
 	d.Lock()
@@ -117,12 +417,116 @@ func (d *Dict) Expire(key string, sec uint32) error {
 		return err
 	}
 
-	slot.access()
-	slot.setExpire(sec)
+	if !t.After(time.Now()) {
+		d.remove(slot)
+		d.notify(EventDel, key)
+		return nil
+	}
+	d.preserve(slot)
+	slot.expire = deadline(t)
+	slot.idle = 0
+	d.volatile[key] = hash
+	d.versions++
+	slot.version = d.versions
+
+	return nil
+}
+
+// ExpireIdle makes key expire after being idle for timeout, every access
+// moves its deadline. Key is removed right away if timeout is not positive.
+func (d *Dict) ExpireIdle(key string, timeout time.Duration) error {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, err := d.lookUpFilledEntry(key, hash)
+
+	if err != nil {
+		return err
+	}
+
+	if timeout.Milliseconds() <= 0 {
+		d.remove(slot)
+		d.notify(EventDel, key)
+		return nil
+	}
+	d.preserve(slot)
+	slot.idle = timeout.Milliseconds()
+	slot.expire = time.Now().UnixMilli() + slot.idle
+	d.volatile[key] = hash
+	d.versions++
+	slot.version = d.versions
 
 	return nil
 }
 
+// Persist removes expire of key
+//
+// returns false if key had no expire
+func (d *Dict) Persist(key string) (bool, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, err := d.lookUpFilledEntry(key, hash)
+
+	if err != nil {
+		return false, err
+	}
+
+	if slot.expire == 0 {
+		return false, nil
+	}
+	d.preserve(slot)
+	slot.expire = 0
+	slot.idle = 0
+	delete(d.volatile, key)
+	d.versions++
+	slot.version = d.versions
+
+	return true, nil
+}
+
+// TTL returns time left before key expires or NoTTL if key has no expire
+func (d *Dict) TTL(key string) (time.Duration, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, err := d.lookUpFilledEntry(key, hash)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return slot.ttl(time.Now()), nil
+}
+
+// Version returns version of key of any kind, which is changed by every
+// write of its value or expire, or 0 if key is missing
+func (d *Dict) Version(key string) uint64 {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot := d.lookUp(key, hash)
+	if slot == nil {
+		return 0
+	}
+	return slot.version
+}
+
+// remove deletes filled slot and updates counters
+func (d *Dict) remove(slot *entry) {
+	d.preserve(slot)
+	if slot.expire != 0 {
+		delete(d.volatile, slot.key)
+	}
+	d.used -= slot.size()
+	d.active--
+	slot.delete()
+}
+
 // Look for entry by key and hash in hashtable, returns pointer to entry
 func (ht hashTable) findSlot(key string, hash, mask uint32) *entry {
 
@@ -131,7 +535,7 @@ func (ht hashTable) findSlot(key string, hash, mask uint32) *entry {
 	index := hash & mask
 	slot := &ht[index]
 
-	if slot.Deleted() {
+	if slot.deleted {
 		freeSlot = slot
 	} else {
 		if slot.data == nil || slot.key == key {
@@ -143,7 +547,7 @@ func (ht hashTable) findSlot(key string, hash, mask uint32) *entry {
 		index = ((index << 2) + index + perturb + 1) & mask
 		slot = &ht[index]
 
-		if slot.Deleted() {
+		if slot.deleted {
 			if freeSlot == nil {
 				freeSlot = slot
 			}
@@ -163,105 +567,179 @@ func (ht hashTable) findSlot(key string, hash, mask uint32) *entry {
 	}
 }
 
-func (d *Dict) lookUpEntry(key string, hash uint32) (*entry, error) {
-	slot := d.dict.findSlot(key, hash, d.mask)
-
+// lookUp returns filled slot for key or nil if there is no such key.
+// Expired entries are removed on the way.
+func (d *Dict) lookUp(key string, hash uint32) *entry {
+	slot := d.find(key, hash)
 	if slot == nil {
-		return nil, fmt.Errorf("Not slot found for key %v, hash %v", key, hash)
+		return nil
+	}
+	if d.isExpired(slot) {
+		d.remove(slot)
+		d.expiredLazy++
+		d.notify(EventExpired, key)
+		return nil
 	}
+	return slot
+}
 
-	if slot.rehashed {
-		log.Debug("Slot for %q found, but it`s rehashed", key)
+// find returns filled slot for key, even if it is expired, or nil if there
+// is no such key.
+//
+// While rehashing is in progress key may be in sparedict or in not yet
+// rehashed slot of dict, but never in both.
+func (d *Dict) find(key string, hash uint32) *entry {
+	var slot *entry
+	if d.sparedict != nil {
 		slot = d.sparedict.findSlot(key, hash, d.sparemask)
 	}
-
-	return slot, nil
+	if slot == nil || slot.data == nil {
+		slot = d.dict.findSlot(key, hash, d.mask)
+		if slot.rehashed {
+			return nil
+		}
+	}
+	if slot.data == nil {
+		return nil
+	}
+	return slot
 }
 
-func (d *Dict) lookUpFilledEntry(key string, hash uint32) (*entry, error) {
-	slot, err := d.lookUpEntry(key, hash)
-
-	if err != nil {
-		return slot, err
+// slotFor returns free slot for new key, caller must fill it
+func (d *Dict) slotFor(key string, hash uint32) *entry {
+	if d.sparedict != nil {
+		slot := d.sparedict.findSlot(key, hash, d.sparemask)
+		if !slot.deleted {
+			d.sparefill++
+		}
+		return slot
 	}
-
-	if slot.data == nil {
-		return slot, fmt.Errorf("Key %v missing in the dictionary", key)
+	slot := d.dict.findSlot(key, hash, d.mask)
+	if !slot.deleted {
+		d.fill++
 	}
+	return slot
+}
+
+func (d *Dict) lookUpFilledEntry(key string, hash uint32) (*entry, error) {
+	slot := d.lookUp(key, hash)
 
 	if slot == nil {
-		return nil, fmt.Errorf("Not slot found for key %v, hash %v", key, hash)
+		return nil, KeyError(key)
 	}
 
 	return slot, nil
 }
 
+// rehashChunk moves slots from l to r of dict to sparedict, must be called
+// with lock held
 func (d *Dict) rehashChunk(l, r uint32) {
-	d.Lock()
-	defer d.Unlock()
 	tmp := d.dict[l:r]
 	for i := range tmp {
 		e := &tmp[i]
 		if e.data != nil {
 			log.Debug("Rehashing key %q", e.key)
 			slot := d.sparedict.findSlot(e.key, e.hash, d.sparemask)
-			slot.data = e.data
+			if !slot.deleted {
+				d.sparefill++
+			}
+			// data is left in old slot, so probe sequences stay unbroken
+			*slot = *e
 		}
 		e.rehashed = true
 	}
 }
 
-// rehash make incremental rehashing to sparedict
-func (d *Dict) rehash(newsize uint32) {
-	log.Debug("Rehashing started")
-	defer log.Debug("Rehashing finished")
-
-	d.sparedict = make([]entry, newsize, newsize)
-	d.sparemask = newsize - 1
-
-	var lb, rb uint32 = 0, rehashChunk
-
+// rehashStep rehashes next n slots and replaces dict with sparedict when
+// all slots are moved, must be called with lock held
+//
+// returns true if rehashing is finished
+func (d *Dict) rehashStep(n uint32) bool {
+	if !d.rehashing {
+		return true
+	}
+	if d.rehashPaused() {
+		return false
+	}
 	dlen := d.mask + 1
-
-	for ; rb <= dlen; lb, rb = rb, rb+rehashChunk {
-		d.rehashChunk(lb, rb)
-		runtime.Gosched()
+	r := d.rehashidx + n
+	if r > dlen || r < d.rehashidx {
+		r = dlen
 	}
-	if lb != dlen {
-		d.rehashChunk(lb, dlen)
+	d.rehashChunk(d.rehashidx, r)
+	d.rehashidx = r
+	if r != dlen {
+		return false
 	}
 
-	d.Lock()
-	defer d.Unlock()
 	d.mask = d.sparemask
 	d.dict = d.sparedict
+	d.tables++
+	d.fill = d.sparefill
 	d.rehashing = false
+	d.rehashidx = 0
 	d.sparedict = nil
 	d.sparemask = 0
+	d.sparefill = 0
+	log.Debug("Rehashing finished")
+	return true
 }
 
-// isReadyForResize atomically check if we can resize and set rehashing true
-// in this case
-//
-// returns true if we must begin resize or false if we must not
-func (d *Dict) isReadyForResize() bool {
-	d.Lock()
-	defer d.Unlock()
-	if ((d.mask+1)*sizeMul >= d.active*activeMul) || d.rehashing {
-		return false
+// rehash make incremental rehashing to sparedict, it is stopped while
+// snapshot is in progress and started again by resumeRehash
+func (d *Dict) rehash() {
+	for {
+		d.Lock()
+		if d.rehashPaused() {
+			d.Unlock()
+			return
+		}
+		done := d.rehashStep(rehashChunk)
+		d.Unlock()
+		if done {
+			return
+		}
+		runtime.Gosched()
 	}
-	d.rehashing = true
-	return true
 }
 
-func (d *Dict) resizeIfNeeded() {
+// needResize reports if table is filled enough to be resized, must be called
+// with lock held
+func (d *Dict) needResize() bool {
+	return !d.rehashing && (d.mask+1)*sizeMul < d.fill*activeMul
+}
 
-	if !d.isReadyForResize() {
+// almostFull reports if table for new keys has too few free slots, must be
+// called with lock held
+func (d *Dict) almostFull() bool {
+	if d.sparedict != nil {
+		return d.sparefill*8 >= (d.sparemask+1)*7
+	}
+	return d.fill*8 >= (d.mask+1)*7
+}
+
+// resizeIfNeeded starts rehashing to new table if dict is filled enough or
+// helps rehashing in progress, must be called with lock held.
+//
+// Spare table is allocated right away, so all new keys go there and dict
+// can't be overfilled before rehashing is done.
+func (d *Dict) resizeIfNeeded() {
+	if d.rehashPaused() {
+		if !d.almostFull() {
+			return
+		}
+		// table can't wait for snapshot anymore
+		d.snap.materialize()
+	}
+	if d.rehashing {
+		d.rehashStep(rehashHelp)
+		return
+	}
+	if !d.needResize() {
 		return
 	}
 
 	newsize := d.mask + 1
-	active := d.active
 
 	var mul uint32
 
@@ -272,7 +750,14 @@ func (d *Dict) resizeIfNeeded() {
 		mul = 4
 	}
 
-	for ; newsize <= mul*active; newsize <<= 1 {
+	for ; newsize <= mul*d.active; newsize <<= 1 {
 	}
-	d.rehash(newsize)
+
+	log.Debug("Rehashing started")
+	d.rehashing = true
+	d.rehashidx = 0
+	d.sparedict = make([]entry, newsize, newsize)
+	d.sparemask = newsize - 1
+	d.sparefill = 0
+	go d.rehash()
 }
@@ -1,6 +1,7 @@
 package godict
 
 import (
+	"fmt"
 	"math/rand"
 	"runtime"
 	"testing"
@@ -327,3 +328,224 @@ func TestExpireUnexisting(t *testing.T) {
 		t.Errorf("Expire did not fail. dict: %v", d)
 	}
 }
+
+func TestTTL(t *testing.T) {
+	d := New()
+	d.Set("a", "1")
+	ttl, err := d.TTL("a")
+	if err != nil || ttl != NoTTL {
+		t.Errorf("Wrong TTL of key without expire: %v, err: %v", ttl, err)
+	}
+	d.Expire("a", 10)
+	ttl, err = d.TTL("a")
+	if err != nil || ttl <= 9*time.Second || ttl > 10*time.Second {
+		t.Errorf("Wrong TTL of key with expire: %v, err: %v", ttl, err)
+	}
+	if _, err := d.TTL("b"); err != KeyError("b") {
+		t.Errorf("Wrong error for missing key: %v", err)
+	}
+}
+
+func TestExpireAt(t *testing.T) {
+	d := New()
+	d.Set("a", "1")
+	d.ExpireAt("a", time.Now().Add(50*time.Millisecond))
+	ttl, err := d.TTL("a")
+	if err != nil || ttl <= 40*time.Millisecond || ttl > 50*time.Millisecond {
+		t.Errorf("Wrong TTL of key with expire: %v, err: %v", ttl, err)
+	}
+	// access doesn't move deadline
+	time.Sleep(30 * time.Millisecond)
+	d.Get("a")
+	time.Sleep(30 * time.Millisecond)
+	if _, err := d.Get("a"); err == nil {
+		t.Error("Key was not expired at deadline")
+	}
+
+	d.Set("b", "1")
+	if err := d.ExpireAt("b", time.Now().Add(-time.Second)); err != nil {
+		t.Errorf("Expire in the past failed: %v", err)
+	}
+	if _, err := d.Get("b"); err == nil {
+		t.Error("Key with deadline in the past was not removed")
+	}
+	if err := d.ExpireAt("c", time.Now()); err != KeyError("c") {
+		t.Errorf("Wrong error for missing key: %v", err)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	d := New()
+	d.Set("a", "1")
+	if ok, err := d.Persist("a"); ok || err != nil {
+		t.Errorf("Persist of key without expire returned %v, %v", ok, err)
+	}
+	d.Expire("a", 10)
+	if ok, err := d.Persist("a"); !ok || err != nil {
+		t.Errorf("Persist of key with expire returned %v, %v", ok, err)
+	}
+	if ttl, _ := d.TTL("a"); ttl != NoTTL {
+		t.Errorf("Wrong TTL %v after persist", ttl)
+	}
+	if d.Stats().Volatile != 0 {
+		t.Error("Key is still counted as volatile after persist")
+	}
+	if _, err := d.Persist("b"); err != KeyError("b") {
+		t.Errorf("Wrong error for missing key: %v", err)
+	}
+}
+
+func TestSetWithOptions(t *testing.T) {
+	d := New()
+
+	if _, err := d.SetWithOptions("a", "1", SetOptions{OnlyExisting: true}); err != KeyError("a") {
+		t.Errorf("Wrong error on replacing missing key: %v", err)
+	}
+	if _, err := d.SetWithOptions("a", "1", SetOptions{OnlyNew: true, Flags: 42}); err != nil {
+		t.Errorf("Error %v on adding new key", err)
+	}
+	if _, err := d.SetWithOptions("a", "2", SetOptions{OnlyNew: true}); err != ErrKeyExists {
+		t.Errorf("Wrong error on adding existing key: %v", err)
+	}
+
+	slot, _ := d.Get("a")
+	if slot.Value() != "1" || slot.Flags() != 42 {
+		t.Errorf("Wrong value %v or flags %v", slot.Value(), slot.Flags())
+	}
+
+	version := slot.Version()
+	if _, err := d.SetWithOptions("a", "3", SetOptions{Version: version + 1}); err != ErrVersionMismatch {
+		t.Errorf("Wrong error on set with wrong version: %v", err)
+	}
+	stored, err := d.SetWithOptions("a", "3", SetOptions{Version: version, TTL: time.Minute})
+	if err != nil {
+		t.Errorf("Error %v on set with right version", err)
+	}
+	slot, _ = d.Get("a")
+	if slot.Version() == version || slot.Version() != stored.Version() {
+		t.Errorf("Wrong version %v after set, returned %v", slot.Version(), stored.Version())
+	}
+	if ttl, _ := d.TTL("a"); ttl <= 0 {
+		t.Errorf("Wrong TTL %v after set with TTL", ttl)
+	}
+}
+
+func TestSetAndGet(t *testing.T) {
+	d := New()
+	old, err := d.SetAndGet("a", "1", SetOptions{TTL: time.Minute})
+	if err != nil || old != nil {
+		t.Fatalf("Set of new key returned %v, %v", old, err)
+	}
+	old, err = d.SetAndGet("a", "2", SetOptions{OnlyNew: true})
+	if err != ErrKeyExists || old == nil || old.Value() != "1" {
+		t.Errorf("Set of existing key with OnlyNew returned %v, %v", old, err)
+	}
+	old, err = d.SetAndGet("a", "3", SetOptions{KeepTTL: true})
+	if err != nil || old.Value() != "1" {
+		t.Errorf("Set returned %v, %v", old, err)
+	}
+	if ttl, _ := d.TTL("a"); ttl <= 59*time.Second || ttl > time.Minute {
+		t.Errorf("Wrong TTL %v after set with KeepTTL", ttl)
+	}
+	d.Set("a", "4")
+	if ttl, _ := d.TTL("a"); ttl != NoTTL {
+		t.Errorf("TTL %v was kept by plain set", ttl)
+	}
+	if old, err := d.SetAndGet("b", "1", SetOptions{OnlyExisting: true}); err != KeyError("b") || old != nil {
+		t.Errorf("Set of missing key with OnlyExisting returned %v, %v", old, err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	d := New()
+	if _, err := d.Update("a", nil); err != KeyError("a") {
+		t.Errorf("Wrong error on updating missing key: %v", err)
+	}
+
+	d.SetWithOptions("a", "1", SetOptions{Flags: 7})
+	before, _ := d.Get("a")
+	res, err := d.Update("a", func(v string) (string, error) {
+		return v + "23", nil
+	})
+	if err != nil || res.Value() != "123" {
+		t.Errorf("Wrong update result %v, err: %v", res, err)
+	}
+	after, _ := d.Get("a")
+	if after.Value() != "123" || after.Flags() != 7 {
+		t.Errorf("Wrong value %v or flags %v after update", after.Value(), after.Flags())
+	}
+	if before.Value() != "1" {
+		t.Errorf("Value returned before update was changed to %v", before.Value())
+	}
+	if after.Version() == before.Version() {
+		t.Error("Version was not changed by update")
+	}
+	if d.Used() != entrySize("a", "123") {
+		t.Errorf("Wrong used memory %v after update", d.Used())
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	d := New()
+	if _, err := d.CompareAndSwap("a", "1", 1); err != KeyError("a") {
+		t.Errorf("Wrong error on swapping missing key: %v", err)
+	}
+	d.Set("a", "1")
+	res, _ := d.Get("a")
+	version, err := d.CompareAndSwap("a", "2", res.Version())
+	if err != nil || version == res.Version() {
+		t.Fatalf("Swap returned version %v and error %v", version, err)
+	}
+	if _, err := d.CompareAndSwap("a", "3", res.Version()); err != ErrVersionMismatch {
+		t.Errorf("Swap with old version returned error %v", err)
+	}
+	if res, _ := d.Get("a"); res.Value() != "2" || res.Version() != version {
+		t.Errorf("Wrong value %v or version %v after swap", res.Value(), res.Version())
+	}
+
+	// versions must survive incremental rehashing
+	versions := make(map[string]uint64)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		d.Set(key, "old")
+		res, _ := d.Get(key)
+		versions[key] = res.Version()
+	}
+	for key, version := range versions {
+		if _, err := d.CompareAndSwap(key, "new", version); err != nil {
+			t.Fatalf("Swap of key %v failed: %v", key, err)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	d := New()
+	if v := d.Version("h"); v != 0 {
+		t.Errorf("Missing key has version %v", v)
+	}
+	d.HSet("h", []string{"f"}, []string{"1"})
+	before := d.Version("h")
+	d.HGet("h", "f")
+	if v := d.Version("h"); v != before {
+		t.Errorf("Version was changed by read: %v, was %v", v, before)
+	}
+	d.HIncrBy("h", "f", 1)
+	if v := d.Version("h"); v == before || v == 0 {
+		t.Errorf("Version %v was not changed by write", v)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	d := New()
+	for i := 0; i < 100; i++ {
+		d.Set(randomString(5), "1")
+	}
+	d.Flush()
+	if d.Active() != 0 || d.Used() != 0 {
+		t.Errorf("Dictionary is not empty after flush: %+v", d.Stats())
+	}
+	d.Set("a", "1")
+	if slot, err := d.Get("a"); err != nil || slot.Value() != "1" {
+		t.Errorf("Get after flush failed: %v", err)
+	}
+}
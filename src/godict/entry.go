@@ -9,20 +9,26 @@ type data struct {
 	key   string
 	value string
 	hash  uint32
+	flags uint32 // opaque for dictionary, stored for clients
+	obj   object // value of composite kind, nil for strings
 }
 
 // entry of dictionary
 type entry struct {
 	*data
 	time.Time
-	rehashed bool // if rehashed when rehashing in progress
-	deleted  bool // if was used and then deleted
-	expire   time.Duration
+	rehashed bool   // if rehashed when rehashing in progress
+	deleted  bool   // if was used and then deleted
+	expire   int64  // deadline in unix milliseconds, 0 if entry never expires
+	idle     int64  // idle timeout in milliseconds, access moves deadline by it
+	freq     uint8  // logarithmic access counter for LFU eviction
+	version  uint64 // changed on every write of value
+	epoch    uint32 // last snapshot which has read this entry
 }
 
 // newData creates empty Data structure
 func newData(key, value string, hash uint32) *data {
-	return &data{key, value, hash}
+	return &data{key: key, value: value, hash: hash}
 }
 
 // init rewrite entry with specified Data
@@ -30,33 +36,73 @@ func (e *entry) init(key, value string, hash uint32) {
 	e.data = newData(key, value, hash)
 	e.Time = time.Now()
 	e.deleted = false
+	e.expire = 0
+	e.idle = 0
+	e.freq = lfuInitFreq
 }
 
 func (e *entry) access() {
-	e.Time = time.Now()
+	now := time.Now()
+	e.freq = lfuIncr(e.decayedFreq(now))
+	e.Time = now
+	if e.idle != 0 {
+		e.expire = now.UnixMilli() + e.idle
+	}
+}
+
+// deadline converts time to value of expire field, zero time means no expire
+func deadline(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
 }
 
-func (e *entry) setExpire(sec uint32) {
-	e.expire = time.Duration(sec) * time.Second
+// ttl returns time left before entry expires or NoTTL if it never expires
+func (e *entry) ttl(now time.Time) time.Duration {
+	if e.expire == 0 {
+		return NoTTL
+	}
+	return time.UnixMilli(e.expire).Sub(now)
 }
 
 func (e *entry) Value() string {
 	return e.value
 }
 
+func (e *entry) Flags() uint32 {
+	return e.flags
+}
+
+// Version returns token, which is changed on every write to entry
+func (e *entry) Version() uint64 {
+	return e.version
+}
+
+// expired reports if entry lifetime is over, entry itself is not changed
+func (e *entry) expired() bool {
+	return e.expire != 0 && time.Now().UnixMilli() >= e.expire
+}
+
 func (e *entry) Deleted() bool {
-	if e.deleted {
-		return true
-	}
-	if e.expire != 0 && time.Since(e.Time) > e.expire {
-		e.delete()
-		return true
-	}
-	return false
+	return e.deleted || e.expired()
 }
 
 func (e *entry) delete() {
 	e.data = nil
 	e.deleted = true
 	e.expire = 0
+	e.idle = 0
+}
+
+// size returns approximate memory used by entry data
+func (e *entry) size() uint64 {
+	if e.obj != nil {
+		return entrySize(e.key, "") + e.obj.size()
+	}
+	return entrySize(e.key, e.value)
+}
+
+func entrySize(key, value string) uint64 {
+	return uint64(len(key)+len(value)) + entryOverhead
 }
@@ -0,0 +1,228 @@
+package godict
+
+import (
+	"errors"
+	"fmt"
+	log "logging"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	// approximate size of entry and data structures, added to every key
+	entryOverhead uint64 = 64
+
+	// number of entries compared when looking for eviction victim
+	evictionSamples = 5
+
+	lfuInitFreq  uint8 = 5
+	lfuLogFactor       = 10
+	lfuDecayTime       = time.Minute
+)
+
+var ErrOutOfMemory = errors.New("Not enough memory for key, eviction is not possible")
+
+// EvictionPolicy defines how victim is chosen when dictionary is over budget
+type EvictionPolicy int
+
+const (
+	NoEviction EvictionPolicy = iota
+	EvictLRU
+	EvictLFU
+	EvictRandom
+)
+
+var policyNames = []string{
+	NoEviction:  "noeviction",
+	EvictLRU:    "lru",
+	EvictLFU:    "lfu",
+	EvictRandom: "random",
+}
+
+func (p EvictionPolicy) String() string {
+	if p < 0 || int(p) >= len(policyNames) {
+		return fmt.Sprintf("EvictionPolicy(%d)", int(p))
+	}
+	return policyNames[p]
+}
+
+// ParseEvictionPolicy returns policy by its name
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	for p, n := range policyNames {
+		if strings.EqualFold(n, name) {
+			return EvictionPolicy(p), nil
+		}
+	}
+	return NoEviction, fmt.Errorf("Unknown eviction policy %q", name)
+}
+
+// better reports if entry a must be evicted before entry b
+func (p EvictionPolicy) better(a, b *entry, now time.Time) bool {
+	switch p {
+	case EvictLRU:
+		return a.Time.Before(b.Time)
+	case EvictLFU:
+		fa, fb := a.decayedFreq(now), b.decayedFreq(now)
+		if fa == fb {
+			return a.Time.Before(b.Time)
+		}
+		return fa < fb
+	}
+	return false
+}
+
+// decayedFreq returns LFU counter decremented by one for every lfuDecayTime
+// passed since last access
+func (e *entry) decayedFreq(now time.Time) uint8 {
+	periods := now.Sub(e.Time) / lfuDecayTime
+	if periods <= 0 {
+		return e.freq
+	}
+	if periods >= time.Duration(e.freq) {
+		return 0
+	}
+	return e.freq - uint8(periods)
+}
+
+// lfuIncr increments counter with probability decreasing as counter grows,
+// so 255 is reached only after about million accesses
+func lfuIncr(freq uint8) uint8 {
+	if freq == 255 {
+		return freq
+	}
+	base := 0.0
+	if freq > lfuInitFreq {
+		base = float64(freq - lfuInitFreq)
+	}
+	if rand.Float64() < 1/(base*lfuLogFactor+1) {
+		freq++
+	}
+	return freq
+}
+
+// SetMaxMemory sets budget in bytes for keys and values, 0 means no limit
+func (d *Dict) SetMaxMemory(bytes uint64) {
+	d.Lock()
+	defer d.Unlock()
+	d.maxMemory = bytes
+	d.evictIfNeeded(nil)
+}
+
+// SetMaxEntries sets limit for number of keys, 0 means no limit
+func (d *Dict) SetMaxEntries(n uint32) {
+	d.Lock()
+	defer d.Unlock()
+	d.maxEntries = n
+	d.evictIfNeeded(nil)
+}
+
+func (d *Dict) SetEvictionPolicy(p EvictionPolicy) {
+	d.Lock()
+	defer d.Unlock()
+	d.policy = p
+}
+
+// Used returns approximate memory used by keys and values
+func (d *Dict) Used() uint64 {
+	d.RLock()
+	defer d.RUnlock()
+	return d.used
+}
+
+// Evicted returns number of keys evicted since dictionary creation
+func (d *Dict) Evicted() uint64 {
+	d.RLock()
+	defer d.RUnlock()
+	return d.evicted
+}
+
+func (d *Dict) overBudget() bool {
+	return (d.maxMemory != 0 && d.used > d.maxMemory) ||
+		(d.maxEntries != 0 && d.active > d.maxEntries)
+}
+
+// checkBudget reports error if storing value of size grow isn't possible
+// without eviction or at all
+func (d *Dict) checkBudget(grow uint64, isNew bool) error {
+	if d.maxMemory != 0 && grow > d.maxMemory {
+		return ErrOutOfMemory
+	}
+	if d.policy != NoEviction {
+		return nil
+	}
+	if d.maxMemory != 0 && d.used+grow > d.maxMemory {
+		return ErrOutOfMemory
+	}
+	if isNew && d.maxEntries != 0 && d.active >= d.maxEntries {
+		return ErrOutOfMemory
+	}
+	return nil
+}
+
+// evictIfNeeded removes entries chosen by eviction policy until dictionary
+// fits to budget, keep entry is never evicted
+func (d *Dict) evictIfNeeded(keep *entry) {
+	if d.policy == NoEviction {
+		return
+	}
+	now := time.Now()
+	for d.overBudget() {
+		var victim *entry
+		for i := 0; i < evictionSamples; i++ {
+			e := d.randomEntry(keep)
+			if e == nil {
+				break
+			}
+			if victim == nil || d.policy.better(e, victim, now) {
+				victim = e
+			}
+			if d.policy == EvictRandom {
+				break
+			}
+		}
+		if victim == nil {
+			return
+		}
+		log.Debug("Evicting key %q", victim.key)
+		key := victim.key
+		d.remove(victim)
+		d.evicted++
+		d.notify(EventEvicted, key)
+	}
+}
+
+// randomEntry returns random filled entry other than skip or nil if there
+// is no such entry
+//
+// While rehashing is in progress sparedict is chosen with probability of
+// already rehashed part of dict.
+func (d *Dict) randomEntry(skip *entry) *entry {
+	if d.active == 0 {
+		return nil
+	}
+	if d.sparedict == nil {
+		return d.dict.randomEntry(d.mask, skip)
+	}
+	if rand.Uint32()&d.mask < d.rehashidx {
+		if e := d.sparedict.randomEntry(d.sparemask, skip); e != nil {
+			return e
+		}
+	}
+	if e := d.dict.randomEntry(d.mask, skip); e != nil {
+		return e
+	}
+	return d.sparedict.randomEntry(d.sparemask, skip)
+}
+
+// randomEntry returns first filled slot starting from random index
+func (ht hashTable) randomEntry(mask uint32, skip *entry) *entry {
+	index := rand.Uint32() & mask
+	for i := uint32(0); i <= mask; i++ {
+		slot := &ht[(index+i)&mask]
+		if slot.data != nil && !slot.rehashed && slot != skip {
+			return slot
+		}
+	}
+	return nil
+}
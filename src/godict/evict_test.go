@@ -0,0 +1,87 @@
+package godict
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseEvictionPolicy(t *testing.T) {
+	for _, p := range []EvictionPolicy{NoEviction, EvictLRU, EvictLFU, EvictRandom} {
+		res, err := ParseEvictionPolicy(p.String())
+		if err != nil {
+			t.Errorf("Error %v on parsing %v", err, p)
+		}
+		if res != p {
+			t.Errorf("Parsed %v, must be %v", res, p)
+		}
+	}
+	if _, err := ParseEvictionPolicy("fifo"); err == nil {
+		t.Error("Unknown policy parsed without error")
+	}
+}
+
+func TestNoEviction(t *testing.T) {
+	d := New()
+	d.SetMaxEntries(2)
+	d.Set("a", "1")
+	d.Set("b", "2")
+	if err := d.Set("c", "3"); err != ErrOutOfMemory {
+		t.Errorf("Wrong error on set over limit: %v", err)
+	}
+	if err := d.Set("a", "4"); err != nil {
+		t.Errorf("Error %v on overwriting key within limit", err)
+	}
+	if d.Active() != 2 {
+		t.Errorf("Wrong number of active slots: %v, must be 2", d.Active())
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	d := New()
+	limit := 10 * entrySize("key000", "value")
+	d.SetMaxMemory(limit)
+	d.SetEvictionPolicy(EvictRandom)
+	for i := 0; i < 100; i++ {
+		if err := d.Set(fmt.Sprintf("key%03d", i), "value"); err != nil {
+			t.Fatalf("Error %v on set", err)
+		}
+		if d.Used() > limit {
+			t.Fatalf("Used memory %v over limit %v", d.Used(), limit)
+		}
+	}
+	if d.Active() != 10 {
+		t.Errorf("Wrong number of active slots: %v, must be 10", d.Active())
+	}
+	if d.Evicted() != 90 {
+		t.Errorf("Wrong number of evicted keys: %v, must be 90", d.Evicted())
+	}
+	if err := d.Set("big", string(make([]byte, limit))); err != ErrOutOfMemory {
+		t.Errorf("Value bigger than limit stored, err: %v", err)
+	}
+}
+
+func testHotKeySurvives(t *testing.T, p EvictionPolicy, touches int) {
+	d := New()
+	d.SetMaxEntries(100)
+	d.SetEvictionPolicy(p)
+	d.Set("hot", "1")
+	for i := 0; i < 1000; i++ {
+		d.Set(fmt.Sprintf("key%d", i), "1")
+		for j := 0; j < touches; j++ {
+			if _, err := d.Get("hot"); err != nil {
+				t.Fatalf("Hot key evicted by %v policy after %d sets", p, i)
+			}
+		}
+	}
+	if d.Active() != 100 {
+		t.Errorf("Wrong number of active slots: %v, must be 100", d.Active())
+	}
+}
+
+func TestEvictLRU(t *testing.T) {
+	testHotKeySurvives(t, EvictLRU, 1)
+}
+
+func TestEvictLFU(t *testing.T) {
+	testHotKeySurvives(t, EvictLFU, 10)
+}
@@ -0,0 +1,148 @@
+package godict
+
+import (
+	log "logging"
+	"time"
+)
+
+// ExpireConfig contains tunables of active expiration
+type ExpireConfig struct {
+	// Interval between expiration cycles
+	Interval time.Duration
+	// SampleSize is number of keys with expire checked at once
+	SampleSize int
+	// Budget limits time spent by one cycle
+	Budget time.Duration
+	// Cycle is repeated while more than Threshold percents of sample
+	// are expired
+	Threshold int
+}
+
+var DefaultExpireConfig = ExpireConfig{
+	Interval:   100 * time.Millisecond,
+	SampleSize: 20,
+	Budget:     25 * time.Millisecond,
+	Threshold:  25,
+}
+
+// Stats contains dictionary counters
+type Stats struct {
+	Active        uint32
+	Volatile      int
+	Used          uint64
+	Evicted       uint64
+	ExpiredLazy   uint64
+	ExpiredActive uint64
+}
+
+func (d *Dict) Stats() Stats {
+	d.RLock()
+	defer d.RUnlock()
+	return Stats{
+		Active:        d.active,
+		Volatile:      len(d.volatile),
+		Used:          d.used,
+		Evicted:       d.evicted,
+		ExpiredLazy:   d.expiredLazy,
+		ExpiredActive: d.expiredActive,
+	}
+}
+
+// expireSample checks up to n random keys with expire set and removes
+// expired ones
+//
+// returns number of checked and removed keys
+func (d *Dict) expireSample(n int) (sampled, expired int) {
+	d.Lock()
+	defer d.Unlock()
+	if d.keepExpired {
+		return 0, 0
+	}
+	// map iteration order is random, so it is used for sampling
+	for key, hash := range d.volatile {
+		if sampled == n {
+			break
+		}
+		sampled++
+		slot := d.find(key, hash)
+		if slot == nil {
+			delete(d.volatile, key)
+			continue
+		}
+		if slot.expired() {
+			d.remove(slot)
+			d.expiredActive++
+			d.notify(EventExpired, key)
+			expired++
+		}
+	}
+	return
+}
+
+// ExpireCycle removes expired keys until less than Threshold percents of
+// sample are expired or cycle took more than Budget
+//
+// returns number of removed keys
+func (d *Dict) ExpireCycle(cfg ExpireConfig) int {
+	start := time.Now()
+	total := 0
+	for {
+		sampled, expired := d.expireSample(cfg.SampleSize)
+		total += expired
+		if sampled == 0 || expired*100 <= sampled*cfg.Threshold {
+			break
+		}
+		if time.Since(start) > cfg.Budget {
+			log.Debug("Expire cycle is out of time budget, %d keys removed", total)
+			break
+		}
+	}
+	return total
+}
+
+// StartExpiring runs active expiration in background until StopExpiring is
+// called
+func (d *Dict) StartExpiring(cfg ExpireConfig) {
+	d.Lock()
+	defer d.Unlock()
+	if d.stopExpire != nil {
+		return
+	}
+	stop := make(chan struct{})
+	d.stopExpire = stop
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.ExpireCycle(cfg)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// SetKeepExpired makes dictionary keep keys, which expire is over, until
+// they are deleted. Follower keeps them, because its copy of idle deadline
+// isn't moved by reads on leader, and waits for leader to delete them.
+func (d *Dict) SetKeepExpired(keep bool) {
+	d.Lock()
+	defer d.Unlock()
+	d.keepExpired = keep
+}
+
+// isExpired reports if entry must be removed, must be called with lock held
+func (d *Dict) isExpired(e *entry) bool {
+	return !d.keepExpired && e.expired()
+}
+
+func (d *Dict) StopExpiring() {
+	d.Lock()
+	defer d.Unlock()
+	if d.stopExpire != nil {
+		close(d.stopExpire)
+		d.stopExpire = nil
+	}
+}
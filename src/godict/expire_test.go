@@ -0,0 +1,162 @@
+package godict
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// backdate moves deadline of key to the past, so expire fires earlier
+func backdate(d *Dict, key string, dur time.Duration) {
+	d.Lock()
+	defer d.Unlock()
+	slot := d.find(key, GenHash(key))
+	slot.expire -= dur.Milliseconds()
+}
+
+func TestExpireCycle(t *testing.T) {
+	d := New()
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		d.Set(key, "1")
+		if i%2 == 0 {
+			d.Expire(key, 1)
+			backdate(d, key, 2*time.Second)
+		}
+	}
+	d.Set("live", "1")
+	d.Expire("live", 100)
+
+	cfg := DefaultExpireConfig
+	cfg.Threshold = 0
+	if n := d.ExpireCycle(cfg); n != 50 {
+		t.Errorf("Expire cycle removed %v keys, must be 50", n)
+	}
+
+	stats := d.Stats()
+	if stats.Active != 51 {
+		t.Errorf("Wrong number of active slots: %v, must be 51", stats.Active)
+	}
+	if stats.ExpiredActive != 50 || stats.ExpiredLazy != 0 {
+		t.Errorf("Wrong expire counters: %+v", stats)
+	}
+	if stats.Volatile != 1 {
+		t.Errorf("Wrong number of keys with expire: %v, must be 1", stats.Volatile)
+	}
+}
+
+func TestExpireLazyCounter(t *testing.T) {
+	d := New()
+	d.Set("a", "1")
+	d.Expire("a", 1)
+	backdate(d, "a", 2*time.Second)
+	if _, err := d.Get("a"); err == nil {
+		t.Error("Expired key returned")
+	}
+	stats := d.Stats()
+	if stats.ExpiredLazy != 1 || stats.Active != 0 || stats.Volatile != 0 {
+		t.Errorf("Wrong stats after lazy expire: %+v", stats)
+	}
+}
+
+func TestStartExpiring(t *testing.T) {
+	d := New()
+	d.Set("a", "1")
+	d.Expire("a", 1)
+	backdate(d, "a", 2*time.Second)
+
+	cfg := DefaultExpireConfig
+	cfg.Interval = time.Millisecond
+	d.StartExpiring(cfg)
+	defer d.StopExpiring()
+
+	timeout := time.After(time.Second)
+	for d.Stats().ExpiredActive != 1 {
+		select {
+		case <-timeout:
+			t.Fatal("Key was not expired in background")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestAbsoluteExpire(t *testing.T) {
+	d := New()
+	d.SetWithOptions("a", "1", SetOptions{TTL: 100 * time.Millisecond})
+	for i := 0; i < 3; i++ {
+		time.Sleep(40 * time.Millisecond)
+		d.Get("a")
+	}
+	if _, err := d.Get("a"); err == nil {
+		t.Error("Reads extended absolute expire")
+	}
+}
+
+func TestIdleExpire(t *testing.T) {
+	d := New()
+	d.SetWithOptions("a", "1", SetOptions{Idle: 100 * time.Millisecond})
+	d.Set("b", "1")
+	d.ExpireIdle("b", 100*time.Millisecond)
+	for i := 0; i < 5; i++ {
+		time.Sleep(40 * time.Millisecond)
+		for _, key := range []string{"a", "b"} {
+			if _, err := d.Get(key); err != nil {
+				t.Fatalf("Key %v expired while it was read", key)
+			}
+		}
+	}
+	if ttl, _ := d.TTL("a"); ttl <= 90*time.Millisecond || ttl > 100*time.Millisecond {
+		t.Errorf("Wrong TTL %v right after read", ttl)
+	}
+	time.Sleep(120 * time.Millisecond)
+	if _, err := d.Get("a"); err == nil {
+		t.Error("Idle key was not expired")
+	}
+
+	// absolute expire replaces idle timeout and vice versa
+	d.Set("c", "1")
+	d.ExpireIdle("c", 100*time.Millisecond)
+	d.ExpireAt("c", time.Now().Add(100*time.Millisecond))
+	time.Sleep(60 * time.Millisecond)
+	d.Get("c")
+	time.Sleep(60 * time.Millisecond)
+	if _, err := d.Get("c"); err == nil {
+		t.Error("Idle timeout was not replaced by absolute expire")
+	}
+	d.SetWithOptions("d", "1", SetOptions{Idle: time.Minute})
+	d.SetWithOptions("d", "2", SetOptions{KeepTTL: true})
+	d.Persist("d")
+	if ttl, _ := d.TTL("d"); ttl != NoTTL {
+		t.Errorf("Wrong TTL %v after persist of idle key", ttl)
+	}
+	d.Get("d")
+	if ttl, _ := d.TTL("d"); ttl != NoTTL {
+		t.Errorf("Read of persisted key set TTL %v", ttl)
+	}
+}
+
+func TestKeepExpired(t *testing.T) {
+	d := New()
+	d.SetKeepExpired(true)
+	d.SetWithOptions("idle", "1", SetOptions{Idle: time.Second})
+	backdate(d, "idle", 2*time.Second)
+
+	cfg := DefaultExpireConfig
+	cfg.Threshold = 0
+	if n := d.ExpireCycle(cfg); n != 0 {
+		t.Errorf("Expire cycle removed %v kept keys", n)
+	}
+	if _, err := d.Get("idle"); err != nil {
+		t.Errorf("Kept key is not returned: %v", err)
+	}
+	if keys, _ := d.Scan(0, 10); len(keys) != 1 {
+		t.Errorf("Kept key is not scanned: %v", keys)
+	}
+
+	// read moved deadline, so expire it again
+	backdate(d, "idle", 2*time.Second)
+	d.SetKeepExpired(false)
+	if _, err := d.Get("idle"); err == nil {
+		t.Error("Expired key returned after keeping is stopped")
+	}
+}
@@ -0,0 +1,306 @@
+package godict
+
+import (
+	"math"
+	"strconv"
+)
+
+// hashValue is object of KindHash, map of fields to values
+type hashValue struct {
+	fields map[string]string
+	bytes  uint64 // memory used by fields
+}
+
+func newHash() *hashValue {
+	return &hashValue{fields: make(map[string]string)}
+}
+
+func fieldSize(field, value string) uint64 {
+	return uint64(len(field)+len(value)) + elementOverhead
+}
+
+// set sets value of field
+//
+// returns true if field is added
+func (h *hashValue) set(field, value string) bool {
+	old, found := h.fields[field]
+	if found {
+		h.bytes -= fieldSize(field, old)
+	}
+	h.fields[field] = value
+	h.bytes += fieldSize(field, value)
+	return !found
+}
+
+// del removes field
+//
+// returns true if field was present
+func (h *hashValue) del(field string) bool {
+	old, found := h.fields[field]
+	if found {
+		delete(h.fields, field)
+		h.bytes -= fieldSize(field, old)
+	}
+	return found
+}
+
+// grow returns memory needed to set fields to values
+func (h *hashValue) grow(fields, values []string) uint64 {
+	var grow uint64
+	seen := make(map[string]bool, len(fields))
+	for i, field := range fields {
+		if seen[field] {
+			continue
+		}
+		seen[field] = true
+		size := fieldSize(field, values[i])
+		if old, found := h.fields[field]; !found {
+			grow += size
+		} else if oldSize := fieldSize(field, old); size > oldSize {
+			grow += size - oldSize
+		}
+	}
+	return grow
+}
+
+func (h *hashValue) kind() Kind {
+	return KindHash
+}
+
+func (h *hashValue) clone() object {
+	res := &hashValue{fields: make(map[string]string, len(h.fields)), bytes: h.bytes}
+	for field, value := range h.fields {
+		res.fields[field] = value
+	}
+	return res
+}
+
+func (h *hashValue) size() uint64 {
+	return h.bytes
+}
+
+// elements returns fields and values one after another
+func (h *hashValue) elements() []string {
+	res := make([]string, 0, 2*len(h.fields))
+	for field, value := range h.fields {
+		res = append(res, field, value)
+	}
+	return res
+}
+
+// lookUpHash returns hash of key or nil if key is missing, must be called
+// with lock held
+func (d *Dict) lookUpHash(key string, hash uint32) (*entry, *hashValue, error) {
+	slot, err := d.lookUpObject(key, hash, KindHash)
+	if slot == nil {
+		return nil, nil, err
+	}
+	return slot, slot.obj.(*hashValue), nil
+}
+
+// writeHash returns hash of key which fits setting fields to values, missing
+// key is created, must be called with lock held
+func (d *Dict) writeHash(key string, hash uint32, fields, values []string) (*entry, *hashValue, error) {
+	slot, err := d.writeObject(key, hash, KindHash, func(obj object) uint64 {
+		return obj.(*hashValue).grow(fields, values)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return slot, slot.obj.(*hashValue), nil
+}
+
+// HSet sets values of fields of hash stored in key, missing key is created
+//
+// returns number of added fields
+func (d *Dict) HSet(key string, fields, values []string) (int, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, h, err := d.writeHash(key, hash, fields, values)
+	if err != nil {
+		return 0, err
+	}
+	before := slot.size()
+	d.preserve(slot)
+	added := 0
+	for i, field := range fields {
+		if h.set(field, values[i]) {
+			added++
+		}
+	}
+	d.modified(slot, before)
+	d.resizeIfNeeded()
+	return added, nil
+}
+
+// HGet returns value of field of hash stored in key
+func (d *Dict) HGet(key, field string) (string, bool, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, h, err := d.lookUpHash(key, hash)
+	if slot == nil {
+		return "", false, err
+	}
+	d.read(slot)
+	value, found := h.fields[field]
+	return value, found, nil
+}
+
+// HMGet returns values of fields of hash stored in key, found reports which
+// of them are present
+func (d *Dict) HMGet(key string, fields []string) (values []string, found []bool, err error) {
+	hash := GenHash(key)
+	values, found = make([]string, len(fields)), make([]bool, len(fields))
+
+	d.Lock()
+	defer d.Unlock()
+	slot, h, err := d.lookUpHash(key, hash)
+	if slot == nil {
+		return values, found, err
+	}
+	d.read(slot)
+	for i, field := range fields {
+		values[i], found[i] = h.fields[field]
+	}
+	return values, found, nil
+}
+
+// HDel removes fields of hash stored in key, key is removed with last field
+//
+// returns number of removed fields
+func (d *Dict) HDel(key string, fields ...string) (int, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, h, err := d.lookUpHash(key, hash)
+	if slot == nil {
+		return 0, err
+	}
+	before := slot.size()
+	d.preserve(slot)
+	removed := 0
+	for _, field := range fields {
+		if h.del(field) {
+			removed++
+		}
+	}
+	if removed == 0 {
+		d.read(slot)
+		return 0, nil
+	}
+	d.modified(slot, before)
+	return removed, nil
+}
+
+// HExists reports if field of hash stored in key is present
+func (d *Dict) HExists(key, field string) (bool, error) {
+	_, found, err := d.HGet(key, field)
+	return found, err
+}
+
+// HLen returns number of fields of hash stored in key
+func (d *Dict) HLen(key string) (int, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, h, err := d.lookUpHash(key, hash)
+	if slot == nil {
+		return 0, err
+	}
+	d.read(slot)
+	return len(h.fields), nil
+}
+
+// HGetAll returns copy of hash stored in key, missing key is empty hash
+func (d *Dict) HGetAll(key string) (map[string]string, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, h, err := d.lookUpHash(key, hash)
+	if slot == nil {
+		return map[string]string{}, err
+	}
+	d.read(slot)
+	res := make(map[string]string, len(h.fields))
+	for field, value := range h.fields {
+		res[field] = value
+	}
+	return res, nil
+}
+
+// HIncrBy atomically adds delta to decimal 64 bit signed value of field of
+// hash stored in key, missing key or field is taken as 0
+//
+// returns new value
+func (d *Dict) HIncrBy(key, field string, delta int64) (int64, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, h, err := d.lookUpHash(key, hash)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if slot != nil {
+		if value, found := h.fields[field]; found {
+			if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return 0, ErrNotInteger
+			}
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+	n += delta
+	value := strconv.FormatInt(n, 10)
+	slot, h, err = d.writeHash(key, hash, []string{field}, []string{value})
+	if err != nil {
+		return 0, err
+	}
+	before := slot.size()
+	d.preserve(slot)
+	h.set(field, value)
+	d.modified(slot, before)
+	d.resizeIfNeeded()
+	return n, nil
+}
+
+func (s *ShardedDict) HSet(key string, fields, values []string) (int, error) {
+	return s.Shard(key).HSet(key, fields, values)
+}
+
+func (s *ShardedDict) HGet(key, field string) (string, bool, error) {
+	return s.Shard(key).HGet(key, field)
+}
+
+func (s *ShardedDict) HMGet(key string, fields []string) ([]string, []bool, error) {
+	return s.Shard(key).HMGet(key, fields)
+}
+
+func (s *ShardedDict) HDel(key string, fields ...string) (int, error) {
+	return s.Shard(key).HDel(key, fields...)
+}
+
+func (s *ShardedDict) HExists(key, field string) (bool, error) {
+	return s.Shard(key).HExists(key, field)
+}
+
+func (s *ShardedDict) HLen(key string) (int, error) {
+	return s.Shard(key).HLen(key)
+}
+
+func (s *ShardedDict) HGetAll(key string) (map[string]string, error) {
+	return s.Shard(key).HGetAll(key)
+}
+
+func (s *ShardedDict) HIncrBy(key, field string, delta int64) (int64, error) {
+	return s.Shard(key).HIncrBy(key, field, delta)
+}
@@ -0,0 +1,144 @@
+package godict
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHSet(t *testing.T) {
+	d := New()
+	n, err := d.HSet("h", []string{"a", "b", "a"}, []string{"1", "2", "3"})
+	if err != nil || n != 2 {
+		t.Fatalf("Added %v fields with error %v, must be 2", n, err)
+	}
+	if n, _ := d.HSet("h", []string{"b", "c"}, []string{"4", "5"}); n != 1 {
+		t.Errorf("Wrong number of added fields: %v, must be 1", n)
+	}
+	all, err := d.HGetAll("h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "3", "b": "4", "c": "5"}
+	if len(all) != len(want) {
+		t.Fatalf("Wrong hash %v, must be %v", all, want)
+	}
+	for field, value := range want {
+		if all[field] != value {
+			t.Errorf("Wrong value %q of field %v, must be %q", all[field], field, value)
+		}
+	}
+	if value, found, _ := d.HGet("h", "b"); !found || value != "4" {
+		t.Errorf("Wrong value of field b: %q", value)
+	}
+	if _, found, _ := d.HGet("h", "d"); found {
+		t.Error("Missing field is found")
+	}
+	values, found, _ := d.HMGet("h", []string{"a", "d"})
+	if !found[0] || values[0] != "3" || found[1] {
+		t.Errorf("Wrong result of HMGet: %v %v", values, found)
+	}
+	if n, _ := d.HLen("h"); n != 3 {
+		t.Errorf("Wrong number of fields: %v, must be 3", n)
+	}
+}
+
+func TestHDel(t *testing.T) {
+	d := New()
+	d.HSet("h", []string{"a", "b"}, []string{"1", "2"})
+	if n, err := d.HDel("h", "a", "c"); err != nil || n != 1 {
+		t.Errorf("Removed %v fields with error %v, must be 1", n, err)
+	}
+	if ok, _ := d.HExists("h", "a"); ok {
+		t.Error("Removed field exists")
+	}
+	if n, _ := d.HDel("h", "b"); n != 1 {
+		t.Errorf("Wrong number of removed fields: %v, must be 1", n)
+	}
+	if d.Active() != 0 || d.used != 0 {
+		t.Errorf("Empty hash is kept: %v active slots, %v bytes used", d.Active(), d.used)
+	}
+	if n, err := d.HDel("h", "b"); err != nil || n != 0 {
+		t.Errorf("Removed %v fields of missing key with error %v", n, err)
+	}
+}
+
+func TestHIncrBy(t *testing.T) {
+	d := New()
+	if n, err := d.HIncrBy("h", "n", 5); err != nil || n != 5 {
+		t.Errorf("Wrong result of increment of missing key: %v, %v", n, err)
+	}
+	if n, _ := d.HIncrBy("h", "n", -7); n != -2 {
+		t.Errorf("Wrong result of decrement: %v, must be -2", n)
+	}
+	d.HSet("h", []string{"s"}, []string{"str"})
+	if _, err := d.HIncrBy("h", "s", 1); err != ErrNotInteger {
+		t.Errorf("Wrong error on increment of string: %v", err)
+	}
+	d.HSet("h", []string{"max"}, []string{"9223372036854775807"})
+	if _, err := d.HIncrBy("h", "max", 1); err != ErrOverflow {
+		t.Errorf("Wrong error on overflow: %v", err)
+	}
+}
+
+func TestWrongType(t *testing.T) {
+	d := New()
+	d.Set("s", "1")
+	d.HSet("h", []string{"a"}, []string{"1"})
+	if _, err := d.HSet("s", []string{"a"}, []string{"1"}); err != ErrWrongType {
+		t.Errorf("Wrong error on HSet of string: %v", err)
+	}
+	if _, _, err := d.HGet("s", "a"); err != ErrWrongType {
+		t.Errorf("Wrong error on HGet of string: %v", err)
+	}
+	if _, err := d.Get("h"); err != ErrWrongType {
+		t.Errorf("Wrong error on Get of hash: %v", err)
+	}
+	if _, err := d.IncrBy("h", 1); err != ErrWrongType {
+		t.Errorf("Wrong error on IncrBy of hash: %v", err)
+	}
+	if kind, _ := d.Type("h"); kind != KindHash {
+		t.Errorf("Wrong kind of hash: %v", kind)
+	}
+	// set replaces value of any kind
+	if err := d.Set("h", "str"); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := d.Get("h"); err != nil || res.Value() != "str" {
+		t.Errorf("Hash was not replaced by string: %v", err)
+	}
+	if d.used != entrySize("s", "1")+entrySize("h", "str") {
+		t.Errorf("Wrong memory accounting after replace: %v", d.used)
+	}
+}
+
+func TestSnapshotHash(t *testing.T) {
+	d := New()
+	d.HSet("h", []string{"a", "b"}, []string{"1", "2"})
+	d.Expire("h", 100)
+	snap, _ := d.Snapshot()
+	// changed in place after snapshot is taken
+	d.HSet("h", []string{"a"}, []string{"new"})
+	d.HDel("h", "b")
+
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := New()
+	if n, err := loaded.Load(&buf); err != nil || n != 1 {
+		t.Fatalf("Loaded %v keys with error %v, must be 1", n, err)
+	}
+	all, err := loaded.HGetAll("h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all["a"] != "1" || all["b"] != "2" {
+		t.Errorf("Wrong loaded hash: %v", all)
+	}
+	if ttl, _ := loaded.TTL("h"); ttl <= 0 {
+		t.Errorf("Expire of hash was not loaded: %v", ttl)
+	}
+	if loaded.used != d.used+fieldSize("b", "2")-fieldSize("a", "new")+fieldSize("a", "1") {
+		t.Errorf("Wrong memory accounting of loaded hash: %v", loaded.used)
+	}
+}
@@ -0,0 +1,284 @@
+package godict
+
+// minListCap is initial capacity of list, list doesn't shrink below it
+const minListCap = 8
+
+// listValue is object of KindList, deque of values in ring buffer
+type listValue struct {
+	items   []string
+	head, n int
+	bytes   uint64 // memory used by values
+}
+
+func newList() *listValue {
+	return &listValue{}
+}
+
+func itemSize(value string) uint64 {
+	return uint64(len(value)) + elementOverhead
+}
+
+// at returns index of i-th value in items
+func (l *listValue) at(i int) int {
+	return (l.head + i) % len(l.items)
+}
+
+// resize moves values to new ring buffer of capacity size
+func (l *listValue) resize(size int) {
+	items := make([]string, size)
+	for i := 0; i < l.n; i++ {
+		items[i] = l.items[l.at(i)]
+	}
+	l.items, l.head = items, 0
+}
+
+func (l *listValue) pushFront(value string) {
+	if l.n == len(l.items) {
+		l.resize(max(minListCap, 2*l.n))
+	}
+	l.head = (l.head + len(l.items) - 1) % len(l.items)
+	l.items[l.head] = value
+	l.n++
+	l.bytes += itemSize(value)
+}
+
+func (l *listValue) pushBack(value string) {
+	if l.n == len(l.items) {
+		l.resize(max(minListCap, 2*l.n))
+	}
+	l.items[l.at(l.n)] = value
+	l.n++
+	l.bytes += itemSize(value)
+}
+
+// pop removes value from head or tail of not empty list
+func (l *listValue) pop(front bool) string {
+	i := l.at(l.n - 1)
+	if front {
+		i = l.head
+		l.head = l.at(1)
+	}
+	value := l.items[i]
+	l.items[i] = ""
+	l.n--
+	l.bytes -= itemSize(value)
+	if len(l.items) > minListCap && l.n < len(l.items)/4 {
+		l.resize(len(l.items) / 2)
+	}
+	return value
+}
+
+// span converts redis style range, where negative index counts from the
+// end, to indexes of first and after last of n elements
+func span(start, stop int64, n int) (int, int) {
+	if start < 0 {
+		start += int64(n)
+	}
+	if stop < 0 {
+		stop += int64(n)
+	}
+	start = max(start, 0)
+	stop = min(stop, int64(n)-1)
+	if start > stop {
+		return 0, 0
+	}
+	return int(start), int(stop + 1)
+}
+
+func (l *listValue) kind() Kind {
+	return KindList
+}
+
+func (l *listValue) clone() object {
+	res := &listValue{bytes: l.bytes}
+	res.items = l.elements()
+	res.n = len(res.items)
+	return res
+}
+
+func (l *listValue) size() uint64 {
+	return l.bytes
+}
+
+// elements returns values from head to tail
+func (l *listValue) elements() []string {
+	res := make([]string, l.n)
+	for i := range res {
+		res[i] = l.items[l.at(i)]
+	}
+	return res
+}
+
+// lookUpList returns list of key or nil if key is missing, must be called
+// with lock held
+func (d *Dict) lookUpList(key string, hash uint32) (*entry, *listValue, error) {
+	slot, err := d.lookUpObject(key, hash, KindList)
+	if slot == nil {
+		return nil, nil, err
+	}
+	return slot, slot.obj.(*listValue), nil
+}
+
+func (d *Dict) push(key string, values []string, front bool) (int, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, err := d.writeObject(key, hash, KindList, func(object) uint64 {
+		var grow uint64
+		for _, value := range values {
+			grow += itemSize(value)
+		}
+		return grow
+	})
+	if err != nil {
+		return 0, err
+	}
+	l := slot.obj.(*listValue)
+	before := slot.size()
+	d.preserve(slot)
+	for _, value := range values {
+		if front {
+			l.pushFront(value)
+		} else {
+			l.pushBack(value)
+		}
+	}
+	n := l.n
+	d.modified(slot, before)
+	d.resizeIfNeeded()
+	return n, nil
+}
+
+// LPush inserts values at head of list stored in key one by one, so the last
+// value becomes the first one. Missing key is created.
+//
+// returns length of list
+func (d *Dict) LPush(key string, values ...string) (int, error) {
+	return d.push(key, values, true)
+}
+
+// RPush appends values to tail of list stored in key, missing key is created
+//
+// returns length of list
+func (d *Dict) RPush(key string, values ...string) (int, error) {
+	return d.push(key, values, false)
+}
+
+func (d *Dict) pop(key string, front bool) (string, bool, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, l, err := d.lookUpList(key, hash)
+	if slot == nil {
+		return "", false, err
+	}
+	before := slot.size()
+	d.preserve(slot)
+	value := l.pop(front)
+	d.modified(slot, before)
+	return value, true, nil
+}
+
+// LPop removes and returns head of list stored in key, key is removed with
+// last value
+func (d *Dict) LPop(key string) (string, bool, error) {
+	return d.pop(key, true)
+}
+
+// RPop removes and returns tail of list stored in key, key is removed with
+// last value
+func (d *Dict) RPop(key string) (string, bool, error) {
+	return d.pop(key, false)
+}
+
+// LLen returns length of list stored in key, missing key is empty list
+func (d *Dict) LLen(key string) (int, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, l, err := d.lookUpList(key, hash)
+	if slot == nil {
+		return 0, err
+	}
+	d.read(slot)
+	return l.n, nil
+}
+
+// LRange returns values of list stored in key from start to stop inclusive,
+// negative index counts from the end of list
+func (d *Dict) LRange(key string, start, stop int64) ([]string, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, l, err := d.lookUpList(key, hash)
+	if slot == nil {
+		return []string{}, err
+	}
+	d.read(slot)
+	from, to := span(start, stop, l.n)
+	res := make([]string, 0, to-from)
+	for i := from; i < to; i++ {
+		res = append(res, l.items[l.at(i)])
+	}
+	return res, nil
+}
+
+// LTrim keeps only values of list stored in key from start to stop
+// inclusive, key is removed if no values are left
+func (d *Dict) LTrim(key string, start, stop int64) error {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, l, err := d.lookUpList(key, hash)
+	if slot == nil {
+		return err
+	}
+	from, to := span(start, stop, l.n)
+	if from == 0 && to == l.n {
+		d.read(slot)
+		return nil
+	}
+	before := slot.size()
+	d.preserve(slot)
+	for l.n > to {
+		l.pop(false)
+	}
+	for i := 0; i < from; i++ {
+		l.pop(true)
+	}
+	d.modified(slot, before)
+	return nil
+}
+
+func (s *ShardedDict) LPush(key string, values ...string) (int, error) {
+	return s.Shard(key).LPush(key, values...)
+}
+
+func (s *ShardedDict) RPush(key string, values ...string) (int, error) {
+	return s.Shard(key).RPush(key, values...)
+}
+
+func (s *ShardedDict) LPop(key string) (string, bool, error) {
+	return s.Shard(key).LPop(key)
+}
+
+func (s *ShardedDict) RPop(key string) (string, bool, error) {
+	return s.Shard(key).RPop(key)
+}
+
+func (s *ShardedDict) LLen(key string) (int, error) {
+	return s.Shard(key).LLen(key)
+}
+
+func (s *ShardedDict) LRange(key string, start, stop int64) ([]string, error) {
+	return s.Shard(key).LRange(key, start, stop)
+}
+
+func (s *ShardedDict) LTrim(key string, start, stop int64) error {
+	return s.Shard(key).LTrim(key, start, stop)
+}
@@ -0,0 +1,103 @@
+package godict
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func checkRange(t *testing.T, d *Dict, key string, start, stop int64, want ...string) {
+	t.Helper()
+	res, err := d.LRange(key, start, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(res) != fmt.Sprint(want) {
+		t.Errorf("Wrong range %v..%v of %v: %v, must be %v", start, stop, key, res, want)
+	}
+}
+
+func TestPush(t *testing.T) {
+	d := New()
+	if n, err := d.RPush("l", "b", "c"); err != nil || n != 2 {
+		t.Fatalf("Wrong length %v after push with error %v, must be 2", n, err)
+	}
+	if n, _ := d.LPush("l", "a", "z"); n != 4 {
+		t.Errorf("Wrong length %v after push, must be 4", n)
+	}
+	checkRange(t, d, "l", 0, -1, "z", "a", "b", "c")
+	checkRange(t, d, "l", 1, 2, "a", "b")
+	checkRange(t, d, "l", -2, 100, "b", "c")
+	checkRange(t, d, "l", 3, 1)
+	checkRange(t, d, "missing", 0, -1)
+	if n, _ := d.LLen("l"); n != 4 {
+		t.Errorf("Wrong length %v, must be 4", n)
+	}
+}
+
+func TestPop(t *testing.T) {
+	d := New()
+	// wraps around ring buffer and makes it grow and shrink
+	for i := 0; i < 100; i++ {
+		d.LPush("l", fmt.Sprint(i))
+		d.RPush("l", fmt.Sprint(i))
+	}
+	for i := 99; i >= 0; i-- {
+		if res, ok, _ := d.LPop("l"); !ok || res != fmt.Sprint(i) {
+			t.Fatalf("Wrong head %v, must be %v", res, i)
+		}
+		if res, ok, _ := d.RPop("l"); !ok || res != fmt.Sprint(i) {
+			t.Fatalf("Wrong tail %v, must be %v", res, i)
+		}
+	}
+	if _, ok, err := d.LPop("l"); ok || err != nil {
+		t.Errorf("Value was popped from empty list with error %v", err)
+	}
+	if d.Active() != 0 || d.used != 0 {
+		t.Errorf("Empty list is kept: %v active slots, %v bytes used", d.Active(), d.used)
+	}
+	d.Set("s", "1")
+	if _, _, err := d.LPop("s"); err != ErrWrongType {
+		t.Errorf("Wrong error on pop of string: %v", err)
+	}
+}
+
+func TestLTrim(t *testing.T) {
+	d := New()
+	d.RPush("l", "a", "b", "c", "d", "e")
+	if err := d.LTrim("l", 1, -2); err != nil {
+		t.Fatal(err)
+	}
+	checkRange(t, d, "l", 0, -1, "b", "c", "d")
+	used := d.used
+	d.RPush("l", "f")
+	d.LTrim("l", 0, 2)
+	if d.used != used {
+		t.Errorf("Wrong memory accounting after trim: %v, must be %v", d.used, used)
+	}
+	d.LTrim("l", 5, 10)
+	if d.Active() != 0 {
+		t.Error("Key was not removed with all values")
+	}
+}
+
+func TestSnapshotList(t *testing.T) {
+	d := New()
+	d.RPush("l", "a", "b", "c")
+	snap, _ := d.Snapshot()
+	d.LPop("l")
+	d.RPush("l", "d")
+
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := New()
+	if n, err := loaded.Load(&buf); err != nil || n != 1 {
+		t.Fatalf("Loaded %v keys with error %v, must be 1", n, err)
+	}
+	checkRange(t, loaded, "l", 0, -1, "a", "b", "c")
+	if kind, _ := loaded.Type("l"); kind != KindList {
+		t.Errorf("Wrong kind of loaded list: %v", kind)
+	}
+}
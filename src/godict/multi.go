@@ -0,0 +1,116 @@
+package godict
+
+// checkMulti reports error if values don't fit to budget all together,
+// must be called with lock held
+func (d *Dict) checkMulti(keys, values []string, hashes []uint32) error {
+	var grow uint64
+	var added uint32
+	for i, key := range keys {
+		size := entrySize(key, values[i])
+		if d.maxMemory != 0 && size > d.maxMemory {
+			return ErrOutOfMemory
+		}
+		if slot := d.lookUp(key, hashes[i]); slot == nil {
+			grow += size
+			added++
+		} else if old := slot.size(); size > old {
+			grow += size - old
+		}
+	}
+	if d.policy != NoEviction {
+		return nil
+	}
+	if d.maxMemory != 0 && d.used+grow > d.maxMemory {
+		return ErrOutOfMemory
+	}
+	if d.maxEntries != 0 && d.active+added > d.maxEntries {
+		return ErrOutOfMemory
+	}
+	return nil
+}
+
+// setMulti sets values after checkMulti, must be called with lock held
+func (d *Dict) setMulti(keys, values []string, hashes []uint32) error {
+	for i, key := range keys {
+		if _, err := d.set(key, values[i], hashes[i], SetOptions{}); err != nil {
+			return err
+		}
+		d.resizeIfNeeded()
+	}
+	return nil
+}
+
+// SetMulti atomically sets values of keys, either all keys are set or none
+func (d *Dict) SetMulti(keys, values []string) error {
+	hashes := make([]uint32, len(keys))
+	for i, key := range keys {
+		hashes[i] = GenHash(key)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if err := d.checkMulti(keys, values, hashes); err != nil {
+		return err
+	}
+	return d.setMulti(keys, values, hashes)
+}
+
+// SetMulti atomically sets values of keys, shards of keys are locked all at
+// once, so readers never see part of keys changed
+func (s *ShardedDict) SetMulti(keys, values []string) error {
+	type batch struct {
+		keys, values []string
+		hashes       []uint32
+	}
+	batches := make([]*batch, len(s.shards))
+	for i, key := range keys {
+		idx := s.shardIndex(key)
+		b := batches[idx]
+		if b == nil {
+			b = &batch{}
+			batches[idx] = b
+		}
+		b.keys = append(b.keys, key)
+		b.values = append(b.values, values[i])
+		b.hashes = append(b.hashes, GenHash(key))
+	}
+	defer s.lockShards(keys)()
+	// budget of every shard is checked before any key is set
+	for i, b := range batches {
+		if b != nil {
+			if err := s.shards[i].checkMulti(b.keys, b.values, b.hashes); err != nil {
+				return err
+			}
+		}
+	}
+	for i, b := range batches {
+		if b != nil {
+			if err := s.shards[i].setMulti(b.keys, b.values, b.hashes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lockShards locks shards of keys in order of index like Snapshot does
+//
+// returns function, which unlocks them
+func (s *ShardedDict) lockShards(keys []string) func() {
+	locked := make([]bool, len(s.shards))
+	for _, key := range keys {
+		locked[s.shardIndex(key)] = true
+	}
+	for i, d := range s.shards {
+		if locked[i] {
+			d.Lock()
+		}
+	}
+	return func() {
+		for i, d := range s.shards {
+			if locked[i] {
+				d.Unlock()
+			}
+		}
+	}
+}
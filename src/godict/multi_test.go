@@ -0,0 +1,48 @@
+package godict
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSetMulti(t *testing.T) {
+	d := New()
+	var keys, values []string
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+		values = append(values, fmt.Sprintf("value%d", i))
+	}
+	if err := d.SetMulti(keys, values); err != nil {
+		t.Fatal(err)
+	}
+	if d.Active() != 1000 {
+		t.Errorf("Wrong number of active slots: %v, must be 1000", d.Active())
+	}
+	for i, key := range keys {
+		if res, err := d.Get(key); err != nil || res.Value() != values[i] {
+			t.Fatalf("Wrong value of key %v: %v", key, err)
+		}
+	}
+}
+
+func TestSetMultiOverLimit(t *testing.T) {
+	s := NewSharded(4)
+	s.SetMaxEntries(8)
+	s.Set("a", "old")
+	var keys, values []string
+	for i := 0; i < 16; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+		values = append(values, "new")
+	}
+	keys = append(keys, "a")
+	values = append(values, "new")
+	if err := s.SetMulti(keys, values); err != ErrOutOfMemory {
+		t.Errorf("Wrong error on set over limit: %v", err)
+	}
+	if s.Active() != 1 {
+		t.Errorf("Keys were set partially: %v active slots", s.Active())
+	}
+	if res, _ := s.Get("a"); res.Value() != "old" {
+		t.Errorf("Key was changed by failed set to %v", res.Value())
+	}
+}
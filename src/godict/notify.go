@@ -0,0 +1,99 @@
+package godict
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Event is change of key reported to NotifyFunc, events are combined into
+// classes as bit masks
+type Event uint8
+
+const (
+	EventSet     Event = 1 << iota // value of key is written
+	EventDel                       // key is deleted by client
+	EventExpired                   // key is removed when its expire is over
+	EventEvicted                   // key is removed to fit memory limit
+
+	NoEvents  Event = 0
+	AllEvents       = EventSet | EventDel | EventExpired | EventEvicted
+)
+
+var eventNames = []struct {
+	event Event
+	name  string
+}{
+	{EventSet, "set"},
+	{EventDel, "del"},
+	{EventExpired, "expired"},
+	{EventEvicted, "evicted"},
+}
+
+func (e Event) String() string {
+	var names []string
+	for _, n := range eventNames {
+		if e&n.event != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseEvents returns class of events by comma separated names, "all" is
+// every event and empty string is none of them
+func ParseEvents(s string) (Event, error) {
+	res := NoEvents
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.EqualFold(name, "all") {
+			res |= AllEvents
+			continue
+		}
+		found := false
+		for _, n := range eventNames {
+			if strings.EqualFold(n.name, name) {
+				res |= n.event
+				found = true
+			}
+		}
+		if !found {
+			return NoEvents, fmt.Errorf("Unknown event %q", name)
+		}
+	}
+	return res, nil
+}
+
+// NotifyFunc gets events of keys. It is called with lock of dictionary held,
+// so it must be fast and must not use dictionary.
+type NotifyFunc func(event Event, key string)
+
+// SetNotify makes dictionary call f on every event of class events, nil f
+// disables notifications
+func (d *Dict) SetNotify(events Event, f NotifyFunc) {
+	d.Lock()
+	defer d.Unlock()
+	if f == nil {
+		events = NoEvents
+	}
+	d.notifyEvents = events
+	d.notifyFunc = f
+}
+
+// notify reports event of key, must be called with lock held
+func (d *Dict) notify(event Event, key string) {
+	if d.notifyEvents&event != 0 {
+		d.notifyFunc(event, key)
+	}
+}
+
+func (s *ShardedDict) SetNotify(events Event, f NotifyFunc) {
+	for _, d := range s.shards {
+		d.SetNotify(events, f)
+	}
+}
@@ -0,0 +1,54 @@
+package godict
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	d := New()
+	var events []string
+	d.SetNotify(AllEvents, func(event Event, key string) {
+		events = append(events, fmt.Sprintf("%v:%v", event, key))
+	})
+	d.Set("a", "1")
+	d.IncrBy("a", 1)
+	d.HSet("h", []string{"f"}, []string{"v"})
+	d.HDel("h", "f")
+	d.Delete("a")
+	d.SetWithOptions("b", "1", SetOptions{Deadline: time.Now().Add(time.Millisecond)})
+	time.Sleep(2 * time.Millisecond)
+	d.Get("b")
+	res := fmt.Sprint(events)
+	if res != "[set:a set:a set:h del:h del:a set:b expired:b]" {
+		t.Errorf("Wrong events %v", res)
+	}
+
+	events = nil
+	d.SetNotify(EventEvicted, func(event Event, key string) {
+		events = append(events, fmt.Sprintf("%v:%v", event, key))
+	})
+	d.SetEvictionPolicy(EvictLRU)
+	d.SetMaxEntries(1)
+	d.Set("c", "1")
+	d.Set("d", "1")
+	if res := fmt.Sprint(events); res != "[evicted:c]" {
+		t.Errorf("Wrong events %v", res)
+	}
+}
+
+func TestParseEvents(t *testing.T) {
+	if e, err := ParseEvents("set, Expired"); err != nil || e != EventSet|EventExpired {
+		t.Errorf("Wrong events %v with error %v", e, err)
+	}
+	if e, _ := ParseEvents("all"); e.String() != "set,del,expired,evicted" {
+		t.Errorf("Wrong events %v", e)
+	}
+	if e, _ := ParseEvents(""); e != NoEvents {
+		t.Errorf("Wrong events %v", e)
+	}
+	if _, err := ParseEvents("get"); err == nil {
+		t.Error("Unknown event is parsed")
+	}
+}
@@ -0,0 +1,101 @@
+package godict
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+var (
+	ErrNotInteger = errors.New("Value is not an integer or out of range")
+	ErrNotFloat   = errors.New("Value is not a valid float")
+	ErrOverflow   = errors.New("Increment or decrement would overflow")
+)
+
+// upsert atomically replaces value of key with result of f, missing key is
+// created with value f("", false). Flags and expire of existing key are kept.
+func (d *Dict) upsert(key string, f func(value string, found bool) (string, error)) error {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot := d.lookUp(key, hash)
+	if slot != nil {
+		if slot.obj != nil {
+			return ErrWrongType
+		}
+		value, err := f(slot.value, true)
+		if err != nil {
+			return err
+		}
+		return d.update(key, slot, value)
+	}
+	value, err := f("", false)
+	if err != nil {
+		return err
+	}
+	if _, err := d.set(key, value, hash, SetOptions{}); err != nil {
+		return err
+	}
+	d.resizeIfNeeded()
+	return nil
+}
+
+// IncrBy atomically adds delta to decimal 64 bit signed value of key, missing
+// key is taken as 0
+//
+// returns new value
+func (d *Dict) IncrBy(key string, delta int64) (int64, error) {
+	var res int64
+	err := d.upsert(key, func(value string, found bool) (string, error) {
+		var n int64
+		if found {
+			var err error
+			if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return "", ErrNotInteger
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return "", ErrOverflow
+		}
+		res = n + delta
+		return strconv.FormatInt(res, 10), nil
+	})
+	return res, err
+}
+
+// IncrByFloat atomically adds delta to floating point value of key, missing
+// key is taken as 0
+//
+// returns new value
+func (d *Dict) IncrByFloat(key string, delta float64) (float64, error) {
+	var res float64
+	err := d.upsert(key, func(value string, found bool) (string, error) {
+		var n float64
+		if found {
+			var err error
+			if n, err = strconv.ParseFloat(value, 64); err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+				return "", ErrNotFloat
+			}
+		}
+		res = n + delta
+		if math.IsNaN(res) || math.IsInf(res, 0) {
+			return "", ErrOverflow
+		}
+		return FormatFloat(res), nil
+	})
+	return res, err
+}
+
+// FormatFloat formats value the way IncrByFloat stores it
+func FormatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (s *ShardedDict) IncrBy(key string, delta int64) (int64, error) {
+	return s.Shard(key).IncrBy(key, delta)
+}
+
+func (s *ShardedDict) IncrByFloat(key string, delta float64) (float64, error) {
+	return s.Shard(key).IncrByFloat(key, delta)
+}
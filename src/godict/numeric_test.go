@@ -0,0 +1,83 @@
+package godict
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestIncrBy(t *testing.T) {
+	d := New()
+	if n, err := d.IncrBy("counter", 5); err != nil || n != 5 {
+		t.Fatalf("Incr of missing key returned %v, %v, must be 5", n, err)
+	}
+	d.Expire("counter", 100)
+	if n, err := d.IncrBy("counter", -7); err != nil || n != -2 {
+		t.Fatalf("Decr returned %v, %v, must be -2", n, err)
+	}
+	if ttl, _ := d.TTL("counter"); ttl == NoTTL {
+		t.Error("Expire was lost by incr")
+	}
+	res, _ := d.Get("counter")
+	if res.Value() != "-2" {
+		t.Errorf("Wrong stored value %v, must be -2", res.Value())
+	}
+
+	d.Set("text", "abc")
+	if _, err := d.IncrBy("text", 1); err != ErrNotInteger {
+		t.Errorf("Incr of non-numeric value returned error %v", err)
+	}
+	d.Set("max", strconv.FormatInt(math.MaxInt64, 10))
+	if _, err := d.IncrBy("max", 1); err != ErrOverflow {
+		t.Errorf("Overflow returned error %v", err)
+	}
+	d.Set("min", strconv.FormatInt(math.MinInt64, 10))
+	if _, err := d.IncrBy("min", -1); err != ErrOverflow {
+		t.Errorf("Underflow returned error %v", err)
+	}
+	if res, _ := d.Get("max"); res.Value() != strconv.FormatInt(math.MaxInt64, 10) {
+		t.Errorf("Value was changed by failed incr: %v", res.Value())
+	}
+}
+
+func TestIncrByConcurrent(t *testing.T) {
+	s := NewSharded(4)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				s.IncrBy("counter", 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if res, _ := s.Get("counter"); res.Value() != "8000" {
+		t.Errorf("Wrong counter %v, must be 8000", res.Value())
+	}
+}
+
+func TestIncrByFloat(t *testing.T) {
+	d := New()
+	if f, err := d.IncrByFloat("f", 1.5); err != nil || f != 1.5 {
+		t.Fatalf("Incr of missing key returned %v, %v, must be 1.5", f, err)
+	}
+	d.Set("int", "10")
+	if f, err := d.IncrByFloat("int", 0.1); err != nil || f != 10.1 {
+		t.Fatalf("Incr returned %v, %v, must be 10.1", f, err)
+	}
+	res, _ := d.Get("int")
+	if res.Value() != "10.1" {
+		t.Errorf("Wrong stored value %v, must be 10.1", res.Value())
+	}
+	d.Set("text", "abc")
+	if _, err := d.IncrByFloat("text", 1); err != ErrNotFloat {
+		t.Errorf("Incr of non-numeric value returned error %v", err)
+	}
+	d.Set("big", "1e308")
+	if _, err := d.IncrByFloat("big", 1e308); err != ErrOverflow {
+		t.Errorf("Overflow returned error %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package godict
+
+import "math"
+
+const (
+	// Dict cursor is index of slot, flag of sparedict and generation of
+	// dict, ShardedDict keeps index of shard above it
+	scanIndexBits = 32
+	scanGenBits   = 14
+	scanDictBits  = scanIndexBits + 1 + scanGenBits
+	scanGenMask   = 1<<scanGenBits - 1
+
+	// Scan visits up to this many slots for every requested key
+	scanEmptyVisits = 10
+)
+
+// scanCursor is position of Scan, in dict or then in sparedict if scan has
+// reached the end of dict while rehashing
+type scanCursor struct {
+	gen   uint32 // generation of dict, see Dict.tables
+	spare bool
+	index uint32
+}
+
+// 0 is reserved for start and end of scan
+func (c scanCursor) encode() uint64 {
+	res := uint64(c.gen)<<(scanIndexBits+1) | uint64(c.index)
+	if c.spare {
+		res |= 1 << scanIndexBits
+	}
+	return res + 1
+}
+
+func decodeCursor(cursor uint64) scanCursor {
+	cursor--
+	return scanCursor{
+		gen:   uint32(cursor>>(scanIndexBits+1)) & scanGenMask,
+		spare: cursor&(1<<scanIndexBits) != 0,
+		index: uint32(cursor),
+	}
+}
+
+// resume returns position of cursor in current tables, must be called with
+// lock held
+//
+// Open addressing never moves key to other slot of the same table, so every
+// key is met by going through slots in order. Rehashed slots of dict keep
+// their data, so keys of dict are met until it is replaced by sparedict.
+// Then scan of dict starts again from sparedict, which is dict now, or goes
+// on if it has already reached sparedict. Keys may be returned more than
+// once, but keys which are present all the time are never missed.
+func (d *Dict) resume(cursor uint64) scanCursor {
+	gen := d.tables & scanGenMask
+	if cursor == 0 {
+		return scanCursor{gen: gen}
+	}
+	c := decodeCursor(cursor)
+	switch {
+	case c.gen == gen && (!c.spare || d.sparedict != nil):
+		return c
+	case c.spare && (c.gen+1)&scanGenMask == gen:
+		// sparedict became dict
+		return scanCursor{gen: gen, index: c.index}
+	}
+	return scanCursor{gen: gen}
+}
+
+// Scan returns about count keys starting from cursor, 0 starts new scan
+//
+// returns cursor for next call, 0 if scan is over
+func (d *Dict) Scan(cursor uint64, count int) ([]string, uint64) {
+	d.Lock()
+	defer d.Unlock()
+	c := d.resume(cursor)
+	keys := []string{}
+	visits := math.MaxInt
+	if count < math.MaxInt/scanEmptyVisits {
+		visits = count * scanEmptyVisits
+	}
+	for visited := 0; len(keys) < count && visited < visits; visited++ {
+		table := d.dict
+		if c.spare {
+			table = d.sparedict
+		}
+		if int(c.index) >= len(table) {
+			if c.spare || d.sparedict == nil {
+				return keys, 0
+			}
+			c.spare, c.index = true, 0
+			continue
+		}
+		e := &table[c.index]
+		c.index++
+		if e.data == nil || d.isExpired(e) {
+			continue
+		}
+		// key may be changed or deleted in sparedict after it was moved
+		if e.rehashed && !c.spare {
+			if live := d.find(e.key, e.hash); live == nil || d.isExpired(live) {
+				continue
+			}
+		}
+		keys = append(keys, e.key)
+	}
+	return keys, c.encode()
+}
+
+// Keys returns all keys, for which match returns true
+func (d *Dict) Keys(match func(key string) bool) []string {
+	d.Lock()
+	defer d.Unlock()
+	keys := []string{}
+	for _, table := range []hashTable{d.dict, d.sparedict} {
+		for i := range table {
+			e := &table[i]
+			// rehashed keys are met in sparedict
+			if e.data == nil || e.rehashed || d.isExpired(e) {
+				continue
+			}
+			if match(e.key) {
+				keys = append(keys, e.key)
+			}
+		}
+	}
+	return keys
+}
+
+// Scan works like Dict.Scan, shards are scanned one after another
+func (s *ShardedDict) Scan(cursor uint64, count int) ([]string, uint64) {
+	shard := cursor >> scanDictBits
+	cursor &= 1<<scanDictBits - 1
+	keys := []string{}
+	for shard < uint64(len(s.shards)) {
+		found, next := s.shards[shard].Scan(cursor, count-len(keys))
+		keys = append(keys, found...)
+		if next != 0 {
+			return keys, shard<<scanDictBits | next
+		}
+		shard, cursor = shard+1, 0
+		if len(keys) >= count && shard < uint64(len(s.shards)) {
+			return keys, shard<<scanDictBits | cursor
+		}
+	}
+	return keys, 0
+}
+
+// Keys returns keys of all shards, for which match returns true
+func (s *ShardedDict) Keys(match func(key string) bool) []string {
+	var keys []string
+	for _, d := range s.shards {
+		keys = append(keys, d.Keys(match)...)
+	}
+	return keys
+}
@@ -0,0 +1,108 @@
+package godict
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestScan(t *testing.T) {
+	for _, d := range []interface {
+		Set(key, value string) error
+		Scan(cursor uint64, count int) ([]string, uint64)
+	}{New(), NewSharded(4)} {
+		for i := 0; i < 100; i++ {
+			d.Set(fmt.Sprint(i), "v")
+		}
+		seen := make(map[string]bool)
+		var cursor uint64
+		for calls := 0; ; calls++ {
+			if calls > 1000 {
+				t.Fatal("Scan is not finished")
+			}
+			keys, next := d.Scan(cursor, 10)
+			for _, key := range keys {
+				seen[key] = true
+			}
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+		if len(seen) != 100 {
+			t.Errorf("Scan returned %v keys, must be 100", len(seen))
+		}
+	}
+}
+
+func TestScanHugeCount(t *testing.T) {
+	d := NewSharded(4)
+	for i := 0; i < 100; i++ {
+		d.Set(fmt.Sprint(i), "v")
+	}
+	keys, next := d.Scan(0, math.MaxInt)
+	if len(keys) != 100 || next != 0 {
+		t.Errorf("Scan with huge count returned %v keys and cursor %v", len(keys), next)
+	}
+}
+
+func TestScanWhileRehashing(t *testing.T) {
+	d := New()
+	for i := 0; i < 1000; i++ {
+		d.Set(fmt.Sprint(i), "v")
+	}
+	// background rehash changes tables
+	tables := func() uint32 {
+		d.RLock()
+		defer d.RUnlock()
+		return d.tables
+	}
+	seen := make(map[string]bool)
+	var cursor uint64
+	started := tables()
+	for n := 0; ; n++ {
+		keys, next := d.Scan(cursor, 5)
+		for _, key := range keys {
+			seen[key] = true
+		}
+		// new keys make dict grow and move old ones between scan calls
+		for i := 0; tables() == started && i < 20; i++ {
+			d.Set(fmt.Sprintf("new%v-%v", n, i), "v")
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	if tables() == started {
+		t.Fatal("Dict was not rehashed while scanning")
+	}
+	for i := 0; i < 1000; i++ {
+		if !seen[fmt.Sprint(i)] {
+			t.Fatalf("Key %v is not returned by scan", i)
+		}
+	}
+}
+
+func TestScanSkipsDeleted(t *testing.T) {
+	d := New()
+	d.Set("a", "1")
+	d.Set("b", "2")
+	d.Delete("a")
+	if keys, next := d.Scan(0, 10); fmt.Sprint(keys) != "[b]" || next != 0 {
+		t.Errorf("Wrong scan result %v, next cursor %v", keys, next)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	d := NewSharded(4)
+	for _, key := range []string{"user:1", "user:2", "item:1"} {
+		d.Set(key, "v")
+	}
+	d.HSet("user:3", []string{"name"}, []string{"bob"})
+	keys := d.Keys(func(key string) bool { return strings.HasPrefix(key, "user:") })
+	sort.Strings(keys)
+	if fmt.Sprint(keys) != "[user:1 user:2 user:3]" {
+		t.Errorf("Wrong keys %v", keys)
+	}
+}
@@ -0,0 +1,261 @@
+package godict
+
+import (
+	"sort"
+)
+
+// setValue is object of KindSet, unordered collection of unique members
+type setValue struct {
+	members map[string]struct{}
+	bytes   uint64 // memory used by members
+}
+
+func newSet() *setValue {
+	return &setValue{members: make(map[string]struct{})}
+}
+
+// add returns true if member is added
+func (s *setValue) add(member string) bool {
+	if _, found := s.members[member]; found {
+		return false
+	}
+	s.members[member] = struct{}{}
+	s.bytes += itemSize(member)
+	return true
+}
+
+// remove returns true if member was present
+func (s *setValue) remove(member string) bool {
+	if _, found := s.members[member]; !found {
+		return false
+	}
+	delete(s.members, member)
+	s.bytes -= itemSize(member)
+	return true
+}
+
+func (s *setValue) kind() Kind {
+	return KindSet
+}
+
+func (s *setValue) clone() object {
+	res := &setValue{members: make(map[string]struct{}, len(s.members)), bytes: s.bytes}
+	for member := range s.members {
+		res.members[member] = struct{}{}
+	}
+	return res
+}
+
+func (s *setValue) size() uint64 {
+	return s.bytes
+}
+
+func (s *setValue) elements() []string {
+	res := make([]string, 0, len(s.members))
+	for member := range s.members {
+		res = append(res, member)
+	}
+	return res
+}
+
+// lookUpSet returns set of key or nil if key is missing, must be called with
+// lock held
+func (d *Dict) lookUpSet(key string, hash uint32) (*entry, *setValue, error) {
+	slot, err := d.lookUpObject(key, hash, KindSet)
+	if slot == nil {
+		return nil, nil, err
+	}
+	return slot, slot.obj.(*setValue), nil
+}
+
+// SAdd adds members to set stored in key, missing key is created
+//
+// returns number of added members
+func (d *Dict) SAdd(key string, members ...string) (int, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, err := d.writeObject(key, hash, KindSet, func(obj object) uint64 {
+		s := obj.(*setValue)
+		var grow uint64
+		for _, member := range members {
+			if _, found := s.members[member]; !found {
+				grow += itemSize(member)
+			}
+		}
+		return grow
+	})
+	if err != nil {
+		return 0, err
+	}
+	s := slot.obj.(*setValue)
+	before := slot.size()
+	d.preserve(slot)
+	added := 0
+	for _, member := range members {
+		if s.add(member) {
+			added++
+		}
+	}
+	d.modified(slot, before)
+	d.resizeIfNeeded()
+	return added, nil
+}
+
+// SRem removes members from set stored in key, key is removed with last
+// member
+//
+// returns number of removed members
+func (d *Dict) SRem(key string, members ...string) (int, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, s, err := d.lookUpSet(key, hash)
+	if slot == nil {
+		return 0, err
+	}
+	before := slot.size()
+	d.preserve(slot)
+	removed := 0
+	for _, member := range members {
+		if s.remove(member) {
+			removed++
+		}
+	}
+	if removed == 0 {
+		d.read(slot)
+		return 0, nil
+	}
+	d.modified(slot, before)
+	return removed, nil
+}
+
+// SIsMember reports if member is in set stored in key
+func (d *Dict) SIsMember(key, member string) (bool, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, s, err := d.lookUpSet(key, hash)
+	if slot == nil {
+		return false, err
+	}
+	d.read(slot)
+	_, found := s.members[member]
+	return found, nil
+}
+
+// readSet returns members of set stored in key or nil if key is missing,
+// must be called with lock held
+func (d *Dict) readSet(key string) (map[string]struct{}, error) {
+	slot, s, err := d.lookUpSet(key, GenHash(key))
+	if slot == nil {
+		return nil, err
+	}
+	d.read(slot)
+	return s.members, nil
+}
+
+// SMembers returns sorted members of set stored in key
+func (d *Dict) SMembers(key string) ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+	members, err := d.readSet(key)
+	if err != nil {
+		return nil, err
+	}
+	return sortedMembers(members), nil
+}
+
+func sortedMembers(members map[string]struct{}) []string {
+	res := make([]string, 0, len(members))
+	for member := range members {
+		res = append(res, member)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// combine returns sorted intersection or union of sets of keys, read must
+// return set of key with lock of its dictionary held
+func combine(keys []string, inter bool, read func(key string) (map[string]struct{}, error)) ([]string, error) {
+	sets := make([]map[string]struct{}, len(keys))
+	for i, key := range keys {
+		var err error
+		if sets[i], err = read(key); err != nil {
+			return nil, err
+		}
+	}
+	res := make(map[string]struct{})
+	if !inter {
+		for _, set := range sets {
+			for member := range set {
+				res[member] = struct{}{}
+			}
+		}
+		return sortedMembers(res), nil
+	}
+	// missing key is empty set, so intersection is empty too
+	if len(sets) == 0 || sets[0] == nil {
+		return []string{}, nil
+	}
+next:
+	for member := range sets[0] {
+		for _, set := range sets[1:] {
+			if _, found := set[member]; !found {
+				continue next
+			}
+		}
+		res[member] = struct{}{}
+	}
+	return sortedMembers(res), nil
+}
+
+// SInter returns sorted members, which are in all sets stored in keys
+func (d *Dict) SInter(keys ...string) ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+	return combine(keys, true, d.readSet)
+}
+
+// SUnion returns sorted members, which are in any of sets stored in keys
+func (d *Dict) SUnion(keys ...string) ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+	return combine(keys, false, d.readSet)
+}
+
+func (s *ShardedDict) SAdd(key string, members ...string) (int, error) {
+	return s.Shard(key).SAdd(key, members...)
+}
+
+func (s *ShardedDict) SRem(key string, members ...string) (int, error) {
+	return s.Shard(key).SRem(key, members...)
+}
+
+func (s *ShardedDict) SIsMember(key, member string) (bool, error) {
+	return s.Shard(key).SIsMember(key, member)
+}
+
+func (s *ShardedDict) SMembers(key string) ([]string, error) {
+	return s.Shard(key).SMembers(key)
+}
+
+// readSet returns set of key from its shard, shard must be locked
+func (s *ShardedDict) readSet(key string) (map[string]struct{}, error) {
+	return s.Shard(key).readSet(key)
+}
+
+// SInter works like Dict.SInter, shards of keys are locked all at once
+func (s *ShardedDict) SInter(keys ...string) ([]string, error) {
+	defer s.lockShards(keys)()
+	return combine(keys, true, s.readSet)
+}
+
+// SUnion works like Dict.SUnion, shards of keys are locked all at once
+func (s *ShardedDict) SUnion(keys ...string) ([]string, error) {
+	defer s.lockShards(keys)()
+	return combine(keys, false, s.readSet)
+}
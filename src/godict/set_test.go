@@ -0,0 +1,54 @@
+package godict
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSAdd(t *testing.T) {
+	d := New()
+	if n, err := d.SAdd("s", "a", "b", "a"); err != nil || n != 2 {
+		t.Fatalf("Added %v members with error %v, must be 2", n, err)
+	}
+	if n, _ := d.SAdd("s", "b", "c"); n != 1 {
+		t.Errorf("Wrong number of added members: %v, must be 1", n)
+	}
+	if res, _ := d.SMembers("s"); fmt.Sprint(res) != "[a b c]" {
+		t.Errorf("Wrong members %v", res)
+	}
+	if ok, _ := d.SIsMember("s", "c"); !ok {
+		t.Error("Added member is missing")
+	}
+	if n, _ := d.SRem("s", "a", "d"); n != 1 {
+		t.Errorf("Wrong number of removed members: %v, must be 1", n)
+	}
+	d.SRem("s", "b", "c")
+	if d.Active() != 0 || d.used != 0 {
+		t.Errorf("Empty set is kept: %v active slots, %v bytes used", d.Active(), d.used)
+	}
+	d.Set("str", "1")
+	if _, err := d.SAdd("str", "a"); err != ErrWrongType {
+		t.Errorf("Wrong error on add to string: %v", err)
+	}
+}
+
+func TestSInter(t *testing.T) {
+	for _, d := range []interface {
+		SAdd(key string, members ...string) (int, error)
+		SInter(keys ...string) ([]string, error)
+		SUnion(keys ...string) ([]string, error)
+	}{New(), NewSharded(4)} {
+		d.SAdd("a", "1", "2", "3")
+		d.SAdd("b", "2", "3", "4")
+		d.SAdd("c", "3", "5")
+		if res, _ := d.SInter("a", "b", "c"); fmt.Sprint(res) != "[3]" {
+			t.Errorf("Wrong intersection %v", res)
+		}
+		if res, _ := d.SInter("a", "missing"); len(res) != 0 {
+			t.Errorf("Intersection with missing key is not empty: %v", res)
+		}
+		if res, _ := d.SUnion("a", "c", "missing"); fmt.Sprint(res) != "[1 2 3 5]" {
+			t.Errorf("Wrong union %v", res)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package godict
+
+import (
+	mmh "murmur3"
+	"time"
+)
+
+// seed differs from hashSeed, so keys of one shard are spread over its table
+const shardSeed uint32 = 1987
+
+// ShardedDict partitions keys by hash over independently locked Dicts
+type ShardedDict struct {
+	shards []*Dict
+}
+
+func NewSharded(n int) *ShardedDict {
+	if n < 1 {
+		n = 1
+	}
+	s := &ShardedDict{make([]*Dict, n)}
+	for i := range s.shards {
+		s.shards[i] = New()
+	}
+	return s
+}
+
+func (s *ShardedDict) shardIndex(key string) int {
+	return int(mmh.MurMur3_32([]byte(key), shardSeed) % uint32(len(s.shards)))
+}
+
+// Shard returns dictionary which holds key
+func (s *ShardedDict) Shard(key string) *Dict {
+	return s.shards[s.shardIndex(key)]
+}
+
+func (s *ShardedDict) Shards() []*Dict {
+	return s.shards
+}
+
+func (s *ShardedDict) Set(key, value string) error {
+	return s.Shard(key).Set(key, value)
+}
+
+func (s *ShardedDict) SetWithOptions(key, value string, opts SetOptions) (*entry, error) {
+	return s.Shard(key).SetWithOptions(key, value, opts)
+}
+
+func (s *ShardedDict) SetAndGet(key, value string, opts SetOptions) (*entry, error) {
+	return s.Shard(key).SetAndGet(key, value, opts)
+}
+
+func (s *ShardedDict) Update(key string, f func(value string) (string, error)) (*entry, error) {
+	return s.Shard(key).Update(key, f)
+}
+
+func (s *ShardedDict) CompareAndSwap(key, value string, version uint64) (uint64, error) {
+	return s.Shard(key).CompareAndSwap(key, value, version)
+}
+
+func (s *ShardedDict) Flush() {
+	for _, d := range s.shards {
+		d.Flush()
+	}
+}
+
+func (s *ShardedDict) Get(key string) (*entry, error) {
+	return s.Shard(key).Get(key)
+}
+
+func (s *ShardedDict) Delete(key string) error {
+	return s.Shard(key).Delete(key)
+}
+
+func (s *ShardedDict) Expire(key string, sec uint32) error {
+	return s.Shard(key).Expire(key, sec)
+}
+
+func (s *ShardedDict) ExpireAt(key string, t time.Time) error {
+	return s.Shard(key).ExpireAt(key, t)
+}
+
+func (s *ShardedDict) ExpireIdle(key string, timeout time.Duration) error {
+	return s.Shard(key).ExpireIdle(key, timeout)
+}
+
+func (s *ShardedDict) Persist(key string) (bool, error) {
+	return s.Shard(key).Persist(key)
+}
+
+func (s *ShardedDict) TTL(key string) (time.Duration, error) {
+	return s.Shard(key).TTL(key)
+}
+
+func (s *ShardedDict) Version(key string) uint64 {
+	return s.Shard(key).Version(key)
+}
+
+func (s *ShardedDict) Active() uint32 {
+	var n uint32
+	for _, d := range s.shards {
+		n += d.Active()
+	}
+	return n
+}
+
+// perShard divides limit between shards, 0 stays unlimited
+func (s *ShardedDict) perShard(limit uint64) uint64 {
+	n := uint64(len(s.shards))
+	return (limit + n - 1) / n
+}
+
+// SetMaxMemory splits memory budget equally between shards. Every shard
+// enforces its part on its own, so writes to full shard evict keys or fail
+// even if other shards have room.
+func (s *ShardedDict) SetMaxMemory(bytes uint64) {
+	for _, d := range s.shards {
+		d.SetMaxMemory(s.perShard(bytes))
+	}
+}
+
+// SetMaxEntries splits keys limit equally between shards, which enforce
+// their parts on their own like in SetMaxMemory
+func (s *ShardedDict) SetMaxEntries(n uint32) {
+	for _, d := range s.shards {
+		d.SetMaxEntries(uint32(s.perShard(uint64(n))))
+	}
+}
+
+func (s *ShardedDict) SetEvictionPolicy(p EvictionPolicy) {
+	for _, d := range s.shards {
+		d.SetEvictionPolicy(p)
+	}
+}
+
+// Stats returns sum of counters of all shards
+func (s *ShardedDict) Stats() Stats {
+	var res Stats
+	for _, d := range s.shards {
+		st := d.Stats()
+		res.Active += st.Active
+		res.Volatile += st.Volatile
+		res.Used += st.Used
+		res.Evicted += st.Evicted
+		res.ExpiredLazy += st.ExpiredLazy
+		res.ExpiredActive += st.ExpiredActive
+	}
+	return res
+}
+
+func (s *ShardedDict) StartExpiring(cfg ExpireConfig) {
+	for _, d := range s.shards {
+		d.StartExpiring(cfg)
+	}
+}
+
+func (s *ShardedDict) SetKeepExpired(keep bool) {
+	for _, d := range s.shards {
+		d.SetKeepExpired(keep)
+	}
+}
+
+func (s *ShardedDict) StopExpiring() {
+	for _, d := range s.shards {
+		d.StopExpiring()
+	}
+}
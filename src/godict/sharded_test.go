@@ -0,0 +1,101 @@
+package godict
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestShardedSetGet(t *testing.T) {
+	s := NewSharded(4)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := s.Set(key, key); err != nil {
+			t.Fatalf("Error %v while inserting key %v", err, key)
+		}
+	}
+	if s.Active() != 1000 {
+		t.Errorf("Wrong number of active slots: %v, must be 1000", s.Active())
+	}
+	for i, d := range s.Shards() {
+		if d.Active() == 0 {
+			t.Errorf("Shard %d is empty", i)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		res, err := s.Get(key)
+		if err != nil {
+			t.Fatalf("Error %v on retrieving key %v", err, key)
+		}
+		if res.Value() != key {
+			t.Errorf("Wrong value %v for key %v", res.Value(), key)
+		}
+	}
+	if err := s.Delete("key1"); err != nil {
+		t.Errorf("Delete failed with error %v", err)
+	}
+	if _, err := s.Get("key1"); err == nil {
+		t.Error("Get did not fail after delete")
+	}
+}
+
+func TestShardedConcurrent(t *testing.T) {
+	s := NewSharded(8)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("%d:%d", w, i)
+				s.Set(key, "1")
+				if _, err := s.Get(key); err != nil {
+					t.Errorf("Error %v on retrieving key %v", err, key)
+				}
+			}
+		}(w)
+	}
+	// counters are read while writers run, go test -race checks locking
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+			s.Active()
+			s.Stats()
+		}
+	}
+	if s.Active() != 8000 {
+		t.Errorf("Wrong number of active slots: %v, must be 8000", s.Active())
+	}
+}
+
+func TestShardedLimits(t *testing.T) {
+	s := NewSharded(4)
+	s.SetEvictionPolicy(EvictRandom)
+	s.SetMaxEntries(100)
+	for i := 0; i < 1000; i++ {
+		s.Set(fmt.Sprintf("key%d", i), "1")
+	}
+	if s.Active() > 100 {
+		t.Errorf("Wrong number of active slots: %v, must be at most 100", s.Active())
+	}
+	if st := s.Stats(); uint64(st.Active)+st.Evicted != 1000 {
+		t.Errorf("Wrong stats: %+v", st)
+	}
+}
+
+func BenchmarkShardedSetParallel(b *testing.B) {
+	s := NewSharded(16)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.Set(randomString(3), "1")
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package godict
+
+import (
+	"math/rand"
+)
+
+const (
+	skiplistMaxLevel = 32
+	// probability of node to have next level
+	skiplistP = 0.25
+)
+
+// skipNode is member of sorted set in skiplist
+type skipNode struct {
+	member   string
+	score    float64
+	backward *skipNode
+	level    []skipLevel
+}
+
+type skipLevel struct {
+	forward *skipNode
+	span    int // number of nodes skipped by forward link
+}
+
+// skiplist keeps members ordered by score and then by member. Spans of
+// links make rank of member and member by rank O(log n).
+type skiplist struct {
+	header *skipNode
+	tail   *skipNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &skipNode{level: make([]skipLevel, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// before reports if node goes before member with score
+func (n *skipNode) before(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+// insert adds member, which must not be in skiplist
+func (sl *skiplist) insert(score float64, member string) {
+	var update [skiplistMaxLevel]*skipNode
+	var rank [skiplistMaxLevel]int
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		if i != sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	level := randomLevel()
+	for ; sl.level < level; sl.level++ {
+		update[sl.level] = sl.header
+		sl.header.level[sl.level].span = sl.length
+	}
+	x = &skipNode{member: member, score: score, level: make([]skipLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	// links above new node skip it now
+	for i := level; i < sl.level; i++ {
+		update[i].level[i].span++
+	}
+	if update[0] != sl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+	sl.length++
+}
+
+// delete removes member with score, returns false if there is no such
+// member
+func (sl *skiplist) delete(score float64, member string) bool {
+	var update [skiplistMaxLevel]*skipNode
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+	for i := 0; i < sl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		sl.tail = x.backward
+	}
+	for sl.level > 1 && sl.header.level[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+	return true
+}
+
+// rank returns 1-based position of member with score, 0 if it is missing
+func (sl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for f := x.level[i].forward; f != nil && (f.before(score, member) || (f.score == score && f.member == member)); f = x.level[i].forward {
+			rank += x.level[i].span
+			x = f
+		}
+		if x != sl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns node at 1-based position or nil if it is out of range
+func (sl *skiplist) byRank(rank int) *skipNode {
+	traversed := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank && x != sl.header {
+			return x
+		}
+	}
+	return nil
+}
+
+// firstInRange returns first node with score in r or nil if there is none
+func (sl *skiplist) firstInRange(r ScoreRange) *skipNode {
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.aboveMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !r.belowMax(x.score) {
+		return nil
+	}
+	return x
+}
@@ -0,0 +1,589 @@
+package godict
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	log "logging"
+	"time"
+)
+
+// Snapshot file starts with magic and format version and ends with CRC32 of
+// all previous bytes. Between them are records starting with opcode.
+const (
+	snapshotMagic   = "GODICT"
+	snapshotVersion = 1
+
+	opEntry     byte = 0x01
+	opIdleEntry byte = 0x02 // entry followed by idle timeout in milliseconds
+	opObject    byte = 0x03 // entry of composite kind with idle timeout
+	opEOF       byte = 0xff
+
+	// entries copied from dict by one lock acquisition
+	snapshotChunk = 256
+	// sanity limit for length of key or value
+	snapshotMaxString = 1 << 30
+)
+
+var (
+	ErrSnapshotInProgress = errors.New("Snapshot is already in progress")
+	ErrSnapshotChecksum   = errors.New("Snapshot checksum mismatch")
+)
+
+// Snapshot is view of dictionary at moment of its creation. Entries are read
+// in chunks, so writers are blocked only for short periods.
+//
+// Entry changed by writer before snapshot has read it is copied to saved
+// first, new entries are marked as already read. Rehashing is paused while
+// snapshot walks tables, so slots don't move under it.
+type Snapshot struct {
+	d      *Dict
+	epoch  uint32 // entries with this epoch are already read
+	tables []hashTable
+	table  int // position of walk over tables
+	index  int
+	saved  []entry // copies of entries changed before walk reached them
+	// walk is finished, all remaining entries are in saved
+	materialized bool
+	keepExpired  bool // expired entries are written like in dictionary
+}
+
+// Snapshot starts snapshot of dictionary, it must be closed after use
+func (d *Dict) Snapshot() (*Snapshot, error) {
+	d.Lock()
+	defer d.Unlock()
+	return d.beginSnapshot()
+}
+
+// beginSnapshot must be called with lock held
+func (d *Dict) beginSnapshot() (*Snapshot, error) {
+	if d.snap != nil {
+		return nil, ErrSnapshotInProgress
+	}
+	d.epochs++
+	s := &Snapshot{d: d, epoch: d.epochs, keepExpired: d.keepExpired}
+	if d.sparedict != nil {
+		s.tables = append(s.tables, d.sparedict)
+	}
+	s.tables = append(s.tables, d.dict)
+	d.snap = s
+	return s, nil
+}
+
+// rehashPaused reports if snapshot walk is in progress, so rehashing must
+// wait
+func (d *Dict) rehashPaused() bool {
+	return d.snap != nil && !d.snap.materialized
+}
+
+// preserve copies filled slot to snapshot before it is changed, must be
+// called with lock held
+func (d *Dict) preserve(slot *entry) {
+	s := d.snap
+	if s == nil || s.materialized || slot.epoch == s.epoch {
+		return
+	}
+	s.saved = append(s.saved, slot.copy())
+	slot.epoch = s.epoch
+}
+
+// hide marks new slot, so snapshot doesn't see it
+func (d *Dict) hide(slot *entry) {
+	if d.snap != nil {
+		slot.epoch = d.snap.epoch
+	}
+}
+
+// walk moves up to n not yet read entries to saved, n < 0 means all of them
+func (s *Snapshot) walk(n int) {
+	for ; s.table < len(s.tables); s.table, s.index = s.table+1, 0 {
+		ht := s.tables[s.table]
+		for ; s.index < len(ht); s.index++ {
+			if n == 0 {
+				return
+			}
+			slot := &ht[s.index]
+			// rehashed slots are copied to sparedict, which is walked too
+			if slot.data == nil || slot.rehashed || slot.epoch == s.epoch {
+				continue
+			}
+			s.saved = append(s.saved, slot.copy())
+			slot.epoch = s.epoch
+			n--
+		}
+	}
+	s.materialized = true
+	s.tables = nil
+	s.d.resumeRehash()
+}
+
+// materialize finishes walk by copying all remaining entries, after this
+// rehashing may go on. Used when dictionary can't wait for snapshot.
+func (s *Snapshot) materialize() {
+	if !s.materialized {
+		log.Debug("Copying rest of snapshot")
+		s.walk(-1)
+	}
+}
+
+// next returns next chunk of entries, empty result means end of snapshot
+func (s *Snapshot) next() []entry {
+	s.d.Lock()
+	defer s.d.Unlock()
+	if len(s.saved) == 0 {
+		s.walk(snapshotChunk)
+	}
+	res := s.saved
+	s.saved = nil
+	return res
+}
+
+// Close releases dictionary, snapshot can't be used after it
+func (s *Snapshot) Close() {
+	s.d.Lock()
+	defer s.d.Unlock()
+	s.release()
+}
+
+// release detaches snapshot from dictionary, must be called with lock held
+func (s *Snapshot) release() {
+	d := s.d
+	if d.snap != s {
+		return
+	}
+	d.snap = nil
+	if !s.materialized {
+		d.resumeRehash()
+	}
+}
+
+// resumeRehash restarts rehashing goroutine stopped by snapshot, must be
+// called with lock held
+func (d *Dict) resumeRehash() {
+	if d.rehashing {
+		go d.rehash()
+	}
+}
+
+// Record is entry read from snapshot
+type Record struct {
+	Key      string
+	Value    string
+	Flags    uint32
+	Deadline time.Time     // zero if there is no expire
+	Idle     time.Duration // if not 0, every access moves deadline by it
+	Kind     Kind
+	Elements []string // value of composite kind, see object.elements
+}
+
+// TTL returns time left before record expires, NoTTL if there is no expire
+func (rec *Record) TTL(now time.Time) time.Duration {
+	if rec.Deadline.IsZero() {
+		return NoTTL
+	}
+	return rec.Deadline.Sub(now)
+}
+
+// Each calls f for every not expired entry and closes snapshot, expired
+// entries are passed too if dictionary keeps them
+func (s *Snapshot) Each(f func(*Record) error) error {
+	defer s.Close()
+	for {
+		chunk := s.next()
+		if len(chunk) == 0 {
+			return nil
+		}
+		for i := range chunk {
+			e := &chunk[i]
+			if !s.keepExpired && e.expired() {
+				continue
+			}
+			rec := &Record{Key: e.key, Value: e.value, Flags: e.flags}
+			if e.obj != nil {
+				rec.Kind = e.obj.kind()
+				rec.Elements = e.obj.elements()
+			}
+			if e.expire != 0 {
+				rec.Deadline = time.UnixMilli(e.expire)
+				rec.Idle = time.Duration(e.idle) * time.Millisecond
+			}
+			if err := f(rec); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// WriteTo writes snapshot in binary format and closes it
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	sw := newSnapshotWriter(w)
+	sw.header()
+	if err := s.Each(sw.record); err != nil {
+		return sw.n, err
+	}
+	return sw.n, sw.finish()
+}
+
+// snapshotWriter encodes records and counts their checksum
+type snapshotWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	n   int64
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func newSnapshotWriter(w io.Writer) *snapshotWriter {
+	return &snapshotWriter{w: bufio.NewWriter(w), crc: crc32.NewIEEE()}
+}
+
+func (sw *snapshotWriter) write(p []byte) {
+	if sw.err != nil {
+		return
+	}
+	sw.crc.Write(p)
+	var n int
+	n, sw.err = sw.w.Write(p)
+	sw.n += int64(n)
+}
+
+func (sw *snapshotWriter) writeUvarint(x uint64) {
+	sw.write(sw.buf[:binary.PutUvarint(sw.buf[:], x)])
+}
+
+func (sw *snapshotWriter) writeVarint(x int64) {
+	sw.write(sw.buf[:binary.PutVarint(sw.buf[:], x)])
+}
+
+func (sw *snapshotWriter) writeString(s string) {
+	sw.writeUvarint(uint64(len(s)))
+	sw.write([]byte(s))
+}
+
+func (sw *snapshotWriter) header() {
+	sw.write([]byte(snapshotMagic))
+	sw.write([]byte{snapshotVersion})
+}
+
+func (sw *snapshotWriter) record(rec *Record) error {
+	// expire is stored as absolute deadline in milliseconds
+	var deadline int64
+	if !rec.Deadline.IsZero() {
+		deadline = rec.Deadline.UnixNano() / int64(time.Millisecond)
+	}
+	op := opEntry
+	switch {
+	case rec.Kind != KindString:
+		op = opObject
+	case rec.Idle != 0:
+		op = opIdleEntry
+	}
+	sw.write([]byte{op})
+	sw.writeString(rec.Key)
+	if op == opObject {
+		sw.writeUvarint(uint64(rec.Kind))
+		sw.writeUvarint(uint64(len(rec.Elements)))
+		for _, e := range rec.Elements {
+			sw.writeString(e)
+		}
+	} else {
+		sw.writeString(rec.Value)
+	}
+	sw.writeUvarint(uint64(rec.Flags))
+	sw.writeVarint(deadline)
+	if op != opEntry {
+		sw.writeUvarint(uint64(rec.Idle.Milliseconds()))
+	}
+	return sw.err
+}
+
+func (sw *snapshotWriter) finish() error {
+	sw.write([]byte{opEOF})
+	if sw.err != nil {
+		return sw.err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], sw.crc.Sum32())
+	n, err := sw.w.Write(sum[:])
+	sw.n += int64(n)
+	if err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+// snapshotReader decodes records and counts their checksum
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	sr.crc.Write([]byte{b})
+	return b, nil
+}
+
+func (sr *snapshotReader) read(n uint64) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(sr.r, buf); err != nil {
+		return nil, err
+	}
+	sr.crc.Write(buf)
+	return buf, nil
+}
+
+func (sr *snapshotReader) readString() (string, error) {
+	n, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return "", err
+	}
+	if n > snapshotMaxString {
+		return "", fmt.Errorf("Wrong snapshot string length %d", n)
+	}
+	buf, err := sr.read(n)
+	return string(buf), err
+}
+
+func (sr *snapshotReader) header() error {
+	buf, err := sr.read(uint64(len(snapshotMagic) + 1))
+	if err != nil {
+		return err
+	}
+	if string(buf[:len(snapshotMagic)]) != snapshotMagic {
+		return fmt.Errorf("Not a snapshot file")
+	}
+	if v := buf[len(snapshotMagic)]; v != snapshotVersion {
+		return fmt.Errorf("Unsupported snapshot version %d", v)
+	}
+	return nil
+}
+
+// next returns next record or nil at end of snapshot
+func (sr *snapshotReader) next() (*Record, error) {
+	op, err := sr.ReadByte()
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	switch op {
+	case opEOF:
+		var sum [4]byte
+		if _, err := io.ReadFull(sr.r, sum[:]); err != nil {
+			return nil, unexpected(err)
+		}
+		if binary.BigEndian.Uint32(sum[:]) != sr.crc.Sum32() {
+			return nil, ErrSnapshotChecksum
+		}
+		return nil, nil
+	case opEntry, opIdleEntry, opObject:
+	default:
+		return nil, fmt.Errorf("Wrong snapshot record type %#x", op)
+	}
+	rec := new(Record)
+	if rec.Key, err = sr.readString(); err != nil {
+		return nil, unexpected(err)
+	}
+	if op == opObject {
+		if err := sr.readElements(rec); err != nil {
+			return nil, unexpected(err)
+		}
+	} else if rec.Value, err = sr.readString(); err != nil {
+		return nil, unexpected(err)
+	}
+	flags, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	rec.Flags = uint32(flags)
+	deadline, err := binary.ReadVarint(sr)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	if deadline != 0 {
+		rec.Deadline = time.Unix(0, deadline*int64(time.Millisecond))
+	}
+	if op != opEntry {
+		idle, err := binary.ReadUvarint(sr)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		rec.Idle = time.Duration(idle) * time.Millisecond
+	}
+	return rec, nil
+}
+
+// readElements reads kind and elements of composite value
+func (sr *snapshotReader) readElements(rec *Record) error {
+	kind, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return err
+	}
+	rec.Kind = Kind(kind)
+	n, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return err
+	}
+	if n > snapshotMaxString {
+		return fmt.Errorf("Too many elements %d in snapshot record", n)
+	}
+	rec.Elements = make([]string, 0, min(n, snapshotChunk))
+	for i := uint64(0); i < n; i++ {
+		e, err := sr.readString()
+		if err != nil {
+			return err
+		}
+		rec.Elements = append(rec.Elements, e)
+	}
+	return nil
+}
+
+// unexpected converts EOF in the middle of snapshot to error
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readSnapshot calls f for every record of snapshot, buffered reader is used
+// as is, so data after snapshot is left in it
+func readSnapshot(r io.Reader, f func(*Record) error) error {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	sr := &snapshotReader{r: br, crc: crc32.NewIEEE()}
+	if err := sr.header(); err != nil {
+		return unexpected(err)
+	}
+	for {
+		rec, err := sr.next()
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			return nil
+		}
+		if err := f(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// options returns options to set key from record, second result is false
+// if record is already expired
+func (rec *Record) options(now time.Time) (SetOptions, bool) {
+	opts := SetOptions{Flags: rec.Flags, Deadline: rec.Deadline, Idle: rec.Idle}
+	if !rec.Deadline.IsZero() && !rec.Deadline.After(now) {
+		return opts, false
+	}
+	return opts, true
+}
+
+// Load adds entries from snapshot written by WriteTo, expired entries are
+// skipped
+//
+// returns number of loaded keys
+func (d *Dict) Load(r io.Reader) (int, error) {
+	n := 0
+	err := readSnapshot(r, func(rec *Record) error {
+		loaded, err := d.loadRecord(rec)
+		if loaded {
+			n++
+		}
+		return err
+	})
+	return n, err
+}
+
+// ShardedSnapshot is snapshot of all shards taken at the same moment
+type ShardedSnapshot struct {
+	snaps []*Snapshot
+}
+
+// Snapshot starts snapshot of all shards, it must be closed after use
+func (s *ShardedDict) Snapshot() (*ShardedSnapshot, error) {
+	for _, d := range s.shards {
+		d.Lock()
+		defer d.Unlock()
+	}
+	res := &ShardedSnapshot{}
+	for _, d := range s.shards {
+		snap, err := d.beginSnapshot()
+		if err != nil {
+			for _, started := range res.snaps {
+				started.release()
+			}
+			return nil, err
+		}
+		res.snaps = append(res.snaps, snap)
+	}
+	return res, nil
+}
+
+// Each calls f for every not expired entry of all shards and closes
+// snapshot
+func (ss *ShardedSnapshot) Each(f func(*Record) error) error {
+	defer ss.Close()
+	for _, s := range ss.snaps {
+		if err := s.Each(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteTo writes snapshots of all shards as one snapshot, format is the same
+// as of Snapshot.WriteTo
+func (ss *ShardedSnapshot) WriteTo(w io.Writer) (int64, error) {
+	sw := newSnapshotWriter(w)
+	sw.header()
+	if err := ss.Each(sw.record); err != nil {
+		return sw.n, err
+	}
+	return sw.n, sw.finish()
+}
+
+func (ss *ShardedSnapshot) Close() {
+	for _, s := range ss.snaps {
+		s.Close()
+	}
+}
+
+// Load adds entries from snapshot to shards they belong to
+func (s *ShardedDict) Load(r io.Reader) (int, error) {
+	n := 0
+	err := readSnapshot(r, func(rec *Record) error {
+		loaded, err := s.Shard(rec.Key).loadRecord(rec)
+		if loaded {
+			n++
+		}
+		return err
+	})
+	return n, err
+}
+
+// Reload replaces all keys with entries of snapshot, keys are kept if
+// snapshot can't be read. Other goroutines see either old keys or new ones.
+func (s *ShardedDict) Reload(r io.Reader) (int, error) {
+	fresh := NewSharded(len(s.shards))
+	n, err := fresh.Load(r)
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range s.shards {
+		d.Lock()
+		defer d.Unlock()
+	}
+	for i, d := range s.shards {
+		d.replace(fresh.shards[i])
+	}
+	return n, nil
+}
@@ -0,0 +1,279 @@
+package godict
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSnapshotLoad(t *testing.T) {
+	d := New()
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		d.SetWithOptions(key, key, SetOptions{Flags: uint32(i)})
+	}
+	d.Expire("key1", 100)
+	d.Expire("key2", 1)
+	backdate(d, "key2", 2*time.Second)
+
+	snap, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := New()
+	n, err := loaded.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 999 {
+		t.Errorf("Wrong number of loaded keys: %v, must be 999", n)
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		res, err := loaded.Get(key)
+		if i == 2 {
+			if err == nil {
+				t.Error("Expired key was loaded")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error %v on retrieving key %v", err, key)
+		}
+		if res.Value() != key || res.Flags() != uint32(i) {
+			t.Errorf("Wrong value %v or flags %v for key %v", res.Value(), res.Flags(), key)
+		}
+	}
+	ttl, _ := loaded.TTL("key1")
+	if ttl <= 99*time.Second || ttl > 100*time.Second {
+		t.Errorf("Wrong TTL of loaded key: %v", ttl)
+	}
+}
+
+func TestSnapshotIdle(t *testing.T) {
+	d := New()
+	d.SetWithOptions("idle", "1", SetOptions{Idle: time.Minute})
+	d.SetWithOptions("absolute", "1", SetOptions{TTL: time.Minute})
+	snap, _ := d.Snapshot()
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := New()
+	if n, err := loaded.Load(&buf); err != nil || n != 2 {
+		t.Fatalf("Loaded %v keys with error %v, must be 2", n, err)
+	}
+	backdate(loaded, "idle", 30*time.Second)
+	backdate(loaded, "absolute", 30*time.Second)
+	loaded.Get("idle")
+	loaded.Get("absolute")
+	if ttl, _ := loaded.TTL("idle"); ttl <= 59*time.Second {
+		t.Errorf("Idle timeout was not loaded, TTL after read is %v", ttl)
+	}
+	if ttl, _ := loaded.TTL("absolute"); ttl > 30*time.Second {
+		t.Errorf("Absolute expire became idle timeout, TTL after read is %v", ttl)
+	}
+}
+
+func TestSnapshotPointInTime(t *testing.T) {
+	d := New()
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		d.Set(key, "old")
+	}
+	snap, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Snapshot(); err != ErrSnapshotInProgress {
+		t.Errorf("Second snapshot started with error %v", err)
+	}
+	// reads chunk, so changes are made both before and after walk
+	snap.saved = append(snap.saved, snap.next()...)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		switch i % 3 {
+		case 0:
+			d.Set(key, "new")
+		case 1:
+			d.Delete(key)
+		}
+		d.Set(fmt.Sprintf("added%d", i), "new")
+	}
+	// deleted keys are set again, they must not be written twice
+	for i := 1; i < 1000; i += 3 {
+		d.Set(fmt.Sprintf("key%d", i), "new")
+	}
+
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := New()
+	n, err := loaded.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1000 {
+		t.Errorf("Wrong number of loaded keys: %v, must be 1000", n)
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		res, err := loaded.Get(key)
+		if err != nil {
+			t.Fatalf("Error %v on retrieving key %v", err, key)
+		}
+		if res.Value() != "old" {
+			t.Errorf("Wrong value %v for key %v, must be old", res.Value(), key)
+		}
+	}
+	if _, err := d.Snapshot(); err != nil {
+		t.Errorf("Snapshot was not released: %v", err)
+	}
+}
+
+func TestSnapshotRehash(t *testing.T) {
+	d := New()
+	for i := 0; i < 100; i++ {
+		d.Set(fmt.Sprintf("key%d", i), "old")
+	}
+	snap, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// table is outgrown many times, so snapshot has to give up pause
+	for i := 0; i < 10000; i++ {
+		d.Set(fmt.Sprintf("added%d", i), "new")
+		if i < 100 {
+			d.Set(fmt.Sprintf("key%d", i), "new")
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := New()
+	if n, err := loaded.Load(&buf); err != nil || n != 100 {
+		t.Fatalf("Loaded %v keys with error %v, must be 100", n, err)
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if res, err := loaded.Get(key); err != nil || res.Value() != "old" {
+			t.Fatalf("Wrong value of key %v: %v", key, err)
+		}
+	}
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("added%d", i)
+		if _, err := d.Get(key); err != nil {
+			t.Fatalf("Error %v on retrieving key %v", err, key)
+		}
+	}
+}
+
+func TestSnapshotChecksum(t *testing.T) {
+	d := New()
+	d.Set("key", "value")
+	snap, _ := d.Snapshot()
+	var buf bytes.Buffer
+	snap.WriteTo(&buf)
+	data := buf.Bytes()
+
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(snapshotMagic)+4] ^= 1
+	if _, err := New().Load(bytes.NewReader(corrupted)); err == nil {
+		t.Error("Corrupted snapshot was loaded")
+	}
+	if _, err := New().Load(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Error("Truncated snapshot was loaded")
+	}
+	if _, err := New().Load(bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Error("Garbage was loaded")
+	}
+}
+
+func TestShardedSnapshot(t *testing.T) {
+	s := NewSharded(4)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		s.Set(key, key)
+	}
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Flush()
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewSharded(3)
+	if n, err := loaded.Load(&buf); err != nil || n != 1000 {
+		t.Fatalf("Loaded %v keys with error %v, must be 1000", n, err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if res, err := loaded.Get(key); err != nil || res.Value() != key {
+			t.Fatalf("Wrong value of key %v: %v", key, err)
+		}
+	}
+}
+
+func TestShardedReload(t *testing.T) {
+	s := NewSharded(4)
+	for i := 0; i < 1000; i++ {
+		s.Set(fmt.Sprintf("old%d", i), "v")
+	}
+	s.Set("both", "old")
+	old, _ := s.Get("both")
+	other := NewSharded(2)
+	for i := 0; i < 1000; i++ {
+		other.Set(fmt.Sprintf("new%d", i), "v")
+	}
+	other.Set("both", "new")
+	snap, err := other.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// broken snapshot keeps old keys
+	if _, err := s.Reload(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Fatal("Broken snapshot is loaded")
+	}
+	if n := s.Active(); n != 1001 {
+		t.Fatalf("%d keys left after failed reload, must be 1001", n)
+	}
+
+	if n, err := s.Reload(bytes.NewReader(data)); err != nil || n != 1001 {
+		t.Fatalf("Reloaded %v keys with error %v, must be 1001", n, err)
+	}
+	if n := s.Active(); n != 1001 {
+		t.Fatalf("%d keys after reload, must be 1001", n)
+	}
+	if _, err := s.Get("old1"); err == nil {
+		t.Error("Old key is kept by reload")
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := s.Get(fmt.Sprintf("new%d", i)); err != nil {
+			t.Fatalf("Key new%d is missing after reload", i)
+		}
+	}
+	// version of reloaded key differs from all versions seen before
+	if res, err := s.Get("both"); err != nil || res.Value() != "new" || res.Version() <= old.Version() {
+		t.Errorf("Wrong reloaded key %+v: %v", res, err)
+	}
+	s.Set("after", "v")
+	if n := s.Active(); n != 1002 {
+		t.Errorf("%d keys after write, must be 1002", n)
+	}
+}
@@ -0,0 +1,239 @@
+package godict
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Kind is type of value stored in entry
+type Kind uint8
+
+const (
+	KindString Kind = iota
+	KindHash
+	KindList
+	KindSet
+	KindZSet
+)
+
+var kindNames = []string{"string", "hash", "list", "set", "zset"}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("kind(%d)", uint8(k))
+}
+
+// ErrWrongType is returned when operation doesn't fit kind of value of key
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// elementOverhead is approximate memory used by one element of object besides
+// its data
+const elementOverhead uint64 = 16
+
+// object is value of composite kind. Unlike strings it is changed in place,
+// so it is cloned when snapshot needs to keep it.
+type object interface {
+	kind() Kind
+	clone() object
+	// size returns approximate memory used by elements
+	size() uint64
+	// elements returns flat representation of object for snapshots
+	elements() []string
+}
+
+// newObject creates object of kind from elements returned by its elements,
+// no elements make empty object
+func newObject(kind Kind, elements []string) (object, error) {
+	switch kind {
+	case KindHash:
+		if len(elements)%2 != 0 {
+			return nil, fmt.Errorf("Odd number of hash elements %d", len(elements))
+		}
+		h := newHash()
+		for i := 0; i < len(elements); i += 2 {
+			h.set(elements[i], elements[i+1])
+		}
+		return h, nil
+	case KindList:
+		l := newList()
+		for _, e := range elements {
+			l.pushBack(e)
+		}
+		return l, nil
+	case KindSet:
+		s := newSet()
+		for _, e := range elements {
+			s.add(e)
+		}
+		return s, nil
+	case KindZSet:
+		z := newZSet()
+		if err := z.parseElements(elements); err != nil {
+			return nil, err
+		}
+		return z, nil
+	}
+	return nil, fmt.Errorf("Wrong kind of value %d", kind)
+}
+
+// Kind returns type of value of entry
+func (e *entry) Kind() Kind {
+	if e.obj == nil {
+		return KindString
+	}
+	return e.obj.kind()
+}
+
+// copy returns copy of entry, which is not affected by further changes of
+// its object
+func (e *entry) copy() entry {
+	res := *e
+	if e.data != nil && e.obj != nil {
+		data := *e.data
+		data.obj = e.obj.clone()
+		res.data = &data
+	}
+	return res
+}
+
+// read marks slot as accessed by reader, must be called with lock held
+func (d *Dict) read(slot *entry) {
+	if slot.idle != 0 {
+		// deadline is moved
+		d.preserve(slot)
+	}
+	slot.access()
+}
+
+// lookUpKind returns filled slot of key which holds value of kind, must be
+// called with lock held
+func (d *Dict) lookUpKind(key string, hash uint32, kind Kind) (*entry, error) {
+	slot, err := d.lookUpFilledEntry(key, hash)
+	if err != nil {
+		return nil, err
+	}
+	if slot.Kind() != kind {
+		return nil, ErrWrongType
+	}
+	return slot, nil
+}
+
+// lookUpObject returns slot of key holding object of kind or nil if key is
+// missing, must be called with lock held
+func (d *Dict) lookUpObject(key string, hash uint32, kind Kind) (*entry, error) {
+	slot, err := d.lookUpKind(key, hash, kind)
+	if _, ok := err.(KeyError); ok {
+		return nil, nil
+	}
+	return slot, err
+}
+
+// writeObject returns slot of key holding object of kind, missing key is
+// created with empty object. Budget is checked for memory returned by grow
+// for object, which is going to be changed. Must be called with lock held.
+func (d *Dict) writeObject(key string, hash uint32, kind Kind, grow func(obj object) uint64) (*entry, error) {
+	slot, err := d.lookUpObject(key, hash, kind)
+	if err != nil {
+		return nil, err
+	}
+	if slot != nil {
+		if err := d.checkBudget(grow(slot.obj), false); err != nil {
+			return nil, err
+		}
+		return slot, nil
+	}
+	obj, err := newObject(kind, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.checkBudget(entrySize(key, "")+grow(obj), true); err != nil {
+		return nil, err
+	}
+	return d.create(key, hash, obj)
+}
+
+// create adds key holding obj, budget must be checked by caller. Slot must
+// not be used after resizeIfNeeded. Write is reported by modified.
+func (d *Dict) create(key string, hash uint32, obj object) (*entry, error) {
+	slot, err := d.store(key, "", hash, SetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// data is new, so it isn't shared yet
+	slot.obj = obj
+	d.used += obj.size()
+	return slot, nil
+}
+
+// modified accounts change of object of slot, which had size before it,
+// must be called with lock held after preserve and change
+func (d *Dict) modified(slot *entry, before uint64) {
+	d.used = d.used - before + slot.size()
+	slot.access()
+	d.versions++
+	slot.version = d.versions
+	if slot.obj.size() == 0 {
+		// empty objects are not kept
+		key := slot.key
+		d.remove(slot)
+		d.notify(EventDel, key)
+		return
+	}
+	d.notify(EventSet, slot.key)
+	d.evictIfNeeded(slot)
+}
+
+// Type returns kind of value of key
+func (d *Dict) Type(key string) (Kind, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, err := d.lookUpFilledEntry(key, hash)
+	if err != nil {
+		return 0, err
+	}
+	return slot.Kind(), nil
+}
+
+// loadRecord sets key from snapshot record, expired record is skipped
+//
+// returns false if record is skipped
+func (d *Dict) loadRecord(rec *Record) (bool, error) {
+	opts, alive := rec.options(time.Now())
+	if !alive {
+		return false, nil
+	}
+	var obj object
+	if rec.Kind != KindString {
+		var err error
+		if obj, err = newObject(rec.Kind, rec.Elements); err != nil {
+			return false, err
+		}
+		if obj.size() == 0 {
+			return false, nil
+		}
+	}
+	hash := GenHash(rec.Key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, err := d.set(rec.Key, rec.Value, hash, opts)
+	if err != nil {
+		return false, err
+	}
+	if obj != nil {
+		slot.obj = obj
+		d.used += obj.size()
+		d.evictIfNeeded(slot)
+	}
+	d.resizeIfNeeded()
+	return true, nil
+}
+
+func (s *ShardedDict) Type(key string) (Kind, error) {
+	return s.Shard(key).Type(key)
+}
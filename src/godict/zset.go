@@ -0,0 +1,357 @@
+package godict
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+var ErrScoreNaN = errors.New("Resulting score is not a number (NaN)")
+
+// ScoredMember is member of sorted set with its score
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// ScoreRange is range of scores from Min to Max, bounds are excluded if
+// MinEx or MaxEx are set
+type ScoreRange struct {
+	Min, Max     float64
+	MinEx, MaxEx bool
+}
+
+func (r ScoreRange) aboveMin(score float64) bool {
+	if r.MinEx {
+		return score > r.Min
+	}
+	return score >= r.Min
+}
+
+func (r ScoreRange) belowMax(score float64) bool {
+	if r.MaxEx {
+		return score < r.Max
+	}
+	return score <= r.Max
+}
+
+// zsetValue is object of KindZSet, members ordered by score. Map gives
+// score of member and skiplist gives ranges in O(log n + k).
+type zsetValue struct {
+	scores map[string]float64
+	zsl    *skiplist
+	bytes  uint64 // memory used by members
+}
+
+func newZSet() *zsetValue {
+	return &zsetValue{scores: make(map[string]float64), zsl: newSkiplist()}
+}
+
+func zsetItemSize(member string) uint64 {
+	// score is stored both in map and in skiplist
+	return itemSize(member) + 16
+}
+
+// set sets score of member
+//
+// returns true if member is added
+func (z *zsetValue) set(member string, score float64) bool {
+	old, found := z.scores[member]
+	if found {
+		if old == score {
+			return false
+		}
+		z.zsl.delete(old, member)
+	} else {
+		z.bytes += zsetItemSize(member)
+	}
+	z.scores[member] = score
+	z.zsl.insert(score, member)
+	return !found
+}
+
+// remove returns true if member was present
+func (z *zsetValue) remove(member string) bool {
+	score, found := z.scores[member]
+	if !found {
+		return false
+	}
+	delete(z.scores, member)
+	z.zsl.delete(score, member)
+	z.bytes -= zsetItemSize(member)
+	return true
+}
+
+// collect returns up to n members starting from node, n < 0 means all of
+// them, stop limits score of members
+func collect(x *skipNode, n int, stop func(score float64) bool) []ScoredMember {
+	res := []ScoredMember{}
+	for ; x != nil && n != 0 && !stop(x.score); x = x.level[0].forward {
+		res = append(res, ScoredMember{x.member, x.score})
+		n--
+	}
+	return res
+}
+
+func (z *zsetValue) kind() Kind {
+	return KindZSet
+}
+
+func (z *zsetValue) clone() object {
+	res := newZSet()
+	for x := z.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		res.set(x.member, x.score)
+	}
+	return res
+}
+
+func (z *zsetValue) size() uint64 {
+	return z.bytes
+}
+
+// elements returns scores and members one after another in order of score
+func (z *zsetValue) elements() []string {
+	res := make([]string, 0, 2*z.zsl.length)
+	for x := z.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		res = append(res, FormatFloat(x.score), x.member)
+	}
+	return res
+}
+
+// parseElements fills sorted set from its elements
+func (z *zsetValue) parseElements(elements []string) error {
+	if len(elements)%2 != 0 {
+		return errors.New("Odd number of sorted set elements")
+	}
+	for i := 0; i < len(elements); i += 2 {
+		score, err := strconv.ParseFloat(elements[i], 64)
+		if err != nil || math.IsNaN(score) {
+			return ErrNotFloat
+		}
+		z.set(elements[i+1], score)
+	}
+	return nil
+}
+
+// lookUpZSet returns sorted set of key or nil if key is missing, must be
+// called with lock held
+func (d *Dict) lookUpZSet(key string, hash uint32) (*entry, *zsetValue, error) {
+	slot, err := d.lookUpObject(key, hash, KindZSet)
+	if slot == nil {
+		return nil, nil, err
+	}
+	return slot, slot.obj.(*zsetValue), nil
+}
+
+// writeZSet returns sorted set of key, which fits new members, missing key
+// is created, must be called with lock held
+func (d *Dict) writeZSet(key string, hash uint32, members []ScoredMember) (*entry, *zsetValue, error) {
+	slot, err := d.writeObject(key, hash, KindZSet, func(obj object) uint64 {
+		z := obj.(*zsetValue)
+		var grow uint64
+		seen := make(map[string]bool, len(members))
+		for _, m := range members {
+			if _, found := z.scores[m.Member]; !found && !seen[m.Member] {
+				grow += zsetItemSize(m.Member)
+			}
+			seen[m.Member] = true
+		}
+		return grow
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return slot, slot.obj.(*zsetValue), nil
+}
+
+// ZAdd sets scores of members of sorted set stored in key, missing key is
+// created
+//
+// returns number of added members
+func (d *Dict) ZAdd(key string, members ...ScoredMember) (int, error) {
+	for _, m := range members {
+		if math.IsNaN(m.Score) {
+			return 0, ErrNotFloat
+		}
+	}
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, z, err := d.writeZSet(key, hash, members)
+	if err != nil {
+		return 0, err
+	}
+	before := slot.size()
+	d.preserve(slot)
+	added := 0
+	for _, m := range members {
+		if z.set(m.Member, m.Score) {
+			added++
+		}
+	}
+	d.modified(slot, before)
+	d.resizeIfNeeded()
+	return added, nil
+}
+
+// ZIncrBy atomically adds delta to score of member of sorted set stored in
+// key, missing key or member is taken as 0
+//
+// returns new score
+func (d *Dict) ZIncrBy(key, member string, delta float64) (float64, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, z, err := d.lookUpZSet(key, hash)
+	if err != nil {
+		return 0, err
+	}
+	score := delta
+	if slot != nil {
+		score += z.scores[member]
+	}
+	if math.IsNaN(score) {
+		return 0, ErrScoreNaN
+	}
+	slot, z, err = d.writeZSet(key, hash, []ScoredMember{{member, score}})
+	if err != nil {
+		return 0, err
+	}
+	before := slot.size()
+	d.preserve(slot)
+	z.set(member, score)
+	d.modified(slot, before)
+	d.resizeIfNeeded()
+	return score, nil
+}
+
+// ZRem removes members of sorted set stored in key, key is removed with last
+// member
+//
+// returns number of removed members
+func (d *Dict) ZRem(key string, members ...string) (int, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, z, err := d.lookUpZSet(key, hash)
+	if slot == nil {
+		return 0, err
+	}
+	before := slot.size()
+	d.preserve(slot)
+	removed := 0
+	for _, member := range members {
+		if z.remove(member) {
+			removed++
+		}
+	}
+	if removed == 0 {
+		d.read(slot)
+		return 0, nil
+	}
+	d.modified(slot, before)
+	return removed, nil
+}
+
+// ZScore returns score of member of sorted set stored in key
+func (d *Dict) ZScore(key, member string) (float64, bool, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, z, err := d.lookUpZSet(key, hash)
+	if slot == nil {
+		return 0, false, err
+	}
+	d.read(slot)
+	score, found := z.scores[member]
+	return score, found, nil
+}
+
+// ZRank returns 0-based position of member in sorted set stored in key
+func (d *Dict) ZRank(key, member string) (int, bool, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, z, err := d.lookUpZSet(key, hash)
+	if slot == nil {
+		return 0, false, err
+	}
+	d.read(slot)
+	score, found := z.scores[member]
+	if !found {
+		return 0, false, nil
+	}
+	return z.zsl.rank(score, member) - 1, true, nil
+}
+
+// ZRange returns members of sorted set stored in key from start to stop
+// position inclusive, negative position counts from the end
+func (d *Dict) ZRange(key string, start, stop int64) ([]ScoredMember, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, z, err := d.lookUpZSet(key, hash)
+	if slot == nil {
+		return []ScoredMember{}, err
+	}
+	d.read(slot)
+	from, to := span(start, stop, z.zsl.length)
+	if from == to {
+		return []ScoredMember{}, nil
+	}
+	return collect(z.zsl.byRank(from+1), to-from, func(float64) bool { return false }), nil
+}
+
+// ZRangeByScore returns members of sorted set stored in key with scores in
+// r, offset members are skipped and up to count ones are returned, negative
+// count means all of them
+func (d *Dict) ZRangeByScore(key string, r ScoreRange, offset, count int) ([]ScoredMember, error) {
+	hash := GenHash(key)
+
+	d.Lock()
+	defer d.Unlock()
+	slot, z, err := d.lookUpZSet(key, hash)
+	if slot == nil {
+		return []ScoredMember{}, err
+	}
+	d.read(slot)
+	x := z.zsl.firstInRange(r)
+	for ; x != nil && offset > 0; offset-- {
+		x = x.level[0].forward
+	}
+	return collect(x, count, func(score float64) bool { return !r.belowMax(score) }), nil
+}
+
+func (s *ShardedDict) ZAdd(key string, members ...ScoredMember) (int, error) {
+	return s.Shard(key).ZAdd(key, members...)
+}
+
+func (s *ShardedDict) ZIncrBy(key, member string, delta float64) (float64, error) {
+	return s.Shard(key).ZIncrBy(key, member, delta)
+}
+
+func (s *ShardedDict) ZRem(key string, members ...string) (int, error) {
+	return s.Shard(key).ZRem(key, members...)
+}
+
+func (s *ShardedDict) ZScore(key, member string) (float64, bool, error) {
+	return s.Shard(key).ZScore(key, member)
+}
+
+func (s *ShardedDict) ZRank(key, member string) (int, bool, error) {
+	return s.Shard(key).ZRank(key, member)
+}
+
+func (s *ShardedDict) ZRange(key string, start, stop int64) ([]ScoredMember, error) {
+	return s.Shard(key).ZRange(key, start, stop)
+}
+
+func (s *ShardedDict) ZRangeByScore(key string, r ScoreRange, offset, count int) ([]ScoredMember, error) {
+	return s.Shard(key).ZRangeByScore(key, r, offset, count)
+}
@@ -0,0 +1,150 @@
+package godict
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestSkiplist(t *testing.T) {
+	sl := newSkiplist()
+	scores := make(map[string]float64)
+	for i := 0; i < 1000; i++ {
+		member := fmt.Sprint(rand.Intn(500))
+		if old, found := scores[member]; found {
+			if !sl.delete(old, member) {
+				t.Fatalf("Member %v is not deleted", member)
+			}
+		}
+		scores[member] = float64(rand.Intn(100))
+		sl.insert(scores[member], member)
+	}
+	var sorted []ScoredMember
+	for member, score := range scores {
+		sorted = append(sorted, ScoredMember{member, score})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		return a.Score < b.Score || (a.Score == b.Score && a.Member < b.Member)
+	})
+	if sl.length != len(sorted) {
+		t.Fatalf("Wrong length %v, must be %v", sl.length, len(sorted))
+	}
+	for i, m := range sorted {
+		if rank := sl.rank(m.Score, m.Member); rank != i+1 {
+			t.Fatalf("Wrong rank %v of %v, must be %v", rank, m, i+1)
+		}
+		if x := sl.byRank(i + 1); x.member != m.Member {
+			t.Fatalf("Wrong member %v at rank %v, must be %v", x.member, i+1, m)
+		}
+	}
+	x := sl.firstInRange(ScoreRange{Min: 50, Max: 60, MinEx: true})
+	for _, m := range sorted {
+		if m.Score > 50 {
+			if x.member != m.Member {
+				t.Errorf("Wrong first member in range %v, must be %v", x.member, m)
+			}
+			break
+		}
+	}
+	if sl.firstInRange(ScoreRange{Min: 100, Max: 200}) != nil {
+		t.Error("Member is found in empty range")
+	}
+}
+
+func TestZAdd(t *testing.T) {
+	d := New()
+	n, err := d.ZAdd("z", ScoredMember{"a", 3}, ScoredMember{"b", 1}, ScoredMember{"c", 2})
+	if err != nil || n != 3 {
+		t.Fatalf("Added %v members with error %v, must be 3", n, err)
+	}
+	if n, _ := d.ZAdd("z", ScoredMember{"a", 0}, ScoredMember{"d", 5}); n != 1 {
+		t.Errorf("Wrong number of added members: %v, must be 1", n)
+	}
+	res, _ := d.ZRange("z", 0, -1)
+	if fmt.Sprint(res) != "[{a 0} {b 1} {c 2} {d 5}]" {
+		t.Errorf("Wrong range %v", res)
+	}
+	if res, _ := d.ZRange("z", -2, 10); fmt.Sprint(res) != "[{c 2} {d 5}]" {
+		t.Errorf("Wrong range %v", res)
+	}
+	if rank, found, _ := d.ZRank("z", "c"); !found || rank != 2 {
+		t.Errorf("Wrong rank %v of c, must be 2", rank)
+	}
+	if score, found, _ := d.ZScore("z", "d"); !found || score != 5 {
+		t.Errorf("Wrong score %v of d, must be 5", score)
+	}
+	if score, _ := d.ZIncrBy("z", "b", 10); score != 11 {
+		t.Errorf("Wrong score after increment %v, must be 11", score)
+	}
+	if rank, _, _ := d.ZRank("z", "b"); rank != 3 {
+		t.Errorf("Rank was not changed by increment: %v", rank)
+	}
+	if _, err := d.ZAdd("z", ScoredMember{"e", math.NaN()}); err != ErrNotFloat {
+		t.Errorf("Wrong error on NaN score: %v", err)
+	}
+	d.ZAdd("inf", ScoredMember{"a", math.Inf(1)})
+	if _, err := d.ZIncrBy("inf", "a", math.Inf(-1)); err != ErrScoreNaN {
+		t.Errorf("Wrong error on NaN result: %v", err)
+	}
+}
+
+func TestZRangeByScore(t *testing.T) {
+	d := New()
+	for i := 0; i < 10; i++ {
+		d.ZAdd("z", ScoredMember{fmt.Sprint(i), float64(i)})
+	}
+	res, _ := d.ZRangeByScore("z", ScoreRange{Min: 3, Max: 6, MaxEx: true}, 0, -1)
+	if fmt.Sprint(res) != "[{3 3} {4 4} {5 5}]" {
+		t.Errorf("Wrong range %v", res)
+	}
+	res, _ = d.ZRangeByScore("z", ScoreRange{Min: math.Inf(-1), Max: math.Inf(1)}, 2, 3)
+	if fmt.Sprint(res) != "[{2 2} {3 3} {4 4}]" {
+		t.Errorf("Wrong range with limit %v", res)
+	}
+	if res, _ := d.ZRangeByScore("z", ScoreRange{Min: 9, Max: 9, MinEx: true}, 0, -1); len(res) != 0 {
+		t.Errorf("Range is not empty: %v", res)
+	}
+}
+
+func TestZRem(t *testing.T) {
+	d := New()
+	d.ZAdd("z", ScoredMember{"a", 1}, ScoredMember{"b", 2})
+	if n, _ := d.ZRem("z", "a", "c"); n != 1 {
+		t.Errorf("Wrong number of removed members: %v, must be 1", n)
+	}
+	if _, found, _ := d.ZRank("z", "a"); found {
+		t.Error("Removed member is found")
+	}
+	d.ZRem("z", "b")
+	if d.Active() != 0 || d.used != 0 {
+		t.Errorf("Empty sorted set is kept: %v active slots, %v bytes used", d.Active(), d.used)
+	}
+}
+
+func TestSnapshotSets(t *testing.T) {
+	d := New()
+	d.SAdd("s", "a", "b")
+	d.ZAdd("z", ScoredMember{"a", 1.5}, ScoredMember{"b", math.Inf(-1)})
+	snap, _ := d.Snapshot()
+	d.SRem("s", "a")
+	d.ZIncrBy("z", "a", 1)
+
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := New()
+	if n, err := loaded.Load(&buf); err != nil || n != 2 {
+		t.Fatalf("Loaded %v keys with error %v, must be 2", n, err)
+	}
+	if res, _ := loaded.SMembers("s"); fmt.Sprint(res) != "[a b]" {
+		t.Errorf("Wrong loaded set %v", res)
+	}
+	if res, _ := loaded.ZRange("z", 0, -1); fmt.Sprint(res) != "[{b -Inf} {a 1.5}]" {
+		t.Errorf("Wrong loaded sorted set %v", res)
+	}
+}
@@ -16,13 +16,9 @@ func MurMur3_32(key []byte, seed uint32) uint32 {
 
 	length := uint32(len(key))
 
-	h = seed ^ length
+	h = seed
 
-	if length == 0 {
-		return 0
-	}
-
-	for ; length >= 4; length -= 4 {
+	for ; len(key) >= 4; key = key[4:] {
 		k = binary.LittleEndian.Uint32(key)
 
 		k *= c1
@@ -31,15 +27,14 @@ func MurMur3_32(key []byte, seed uint32) uint32 {
 
 		h ^= k
 
-		h = (h << r2) | (k >> (32 - r2))
+		h = (h << r2) | (h >> (32 - r2))
 
-		h *= 5 + 0xe6546b64
-		key = key[4:]
+		h = h*5 + 0xe6546b64
 	}
 
 	k = 0
 
-	switch length {
+	switch len(key) {
 	case 3:
 		k ^= uint32(key[2]) << 16
 		fallthrough
@@ -49,11 +44,13 @@ func MurMur3_32(key []byte, seed uint32) uint32 {
 	case 1:
 		k ^= uint32(key[0])
 		k *= c1
-		k = (k << r1) | (k >> (64 - r1))
+		k = (k << r1) | (k >> (32 - r1))
 		k *= c2
 		h ^= k
 	}
 
+	h ^= length
+
 	h ^= h >> 16
 	h *= 0x85ebca6b
 	h ^= h >> 13
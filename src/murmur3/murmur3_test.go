@@ -0,0 +1,37 @@
+package murmur3
+
+import (
+	"testing"
+)
+
+// published murmur3_32 vectors, they cover every tail length
+var hashTable = []struct {
+	input    string
+	seed     uint32
+	expected uint32
+}{
+	{"", 0, 0},
+	{"", 1, 0x514e28b7},
+	{"", 0xffffffff, 0x81f16f39},
+	{"\x00\x00\x00\x00", 0, 0x2362f9de},
+	{"\xff\xff\xff\xff", 0, 0x76293b50},
+	{"\x21\x43\x65\x87", 0, 0xf55b516b},
+	{"\x21\x43\x65\x87", 0x5082edee, 0x2362f9de},
+	{"\x21\x43\x65", 0, 0x7e4a8634},
+	{"\x21\x43", 0, 0xa0f7b07a},
+	{"\x21", 0, 0x72661cf4},
+	{"a", 0x9747b28c, 0x7fa09ea6},
+	{"aaaa", 0x9747b28c, 0x5a97808a},
+	{"abc", 0, 0xb3dd93fa},
+	{"abcd", 0x9747b28c, 0xf0478627},
+	{"Hello, world!", 0x9747b28c, 0x24884cba},
+	{"The quick brown fox jumps over the lazy dog", 0x9747b28c, 0x2fa826cd},
+}
+
+func TestMurMur3_32(t *testing.T) {
+	for _, h := range hashTable {
+		if res := MurMur3_32([]byte(h.input), h.seed); res != h.expected {
+			t.Errorf("Hash of %q with seed %#x is %#x, must be %#x", h.input, h.seed, res, h.expected)
+		}
+	}
+}